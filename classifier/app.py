@@ -15,11 +15,14 @@ logger = logging.getLogger(__name__)
 app = Flask(__name__)
 CORS(app)
 
+# model id reported with every classification, used to compare models in shadow mode
+MODEL_ID = os.getenv('MODEL_ID', 'openai/clip-vit-base-patch32')
+
 # startup
 try:
     # Load CLIP model and processor
-    model = CLIPModel.from_pretrained("openai/clip-vit-base-patch32")
-    processor = CLIPProcessor.from_pretrained("openai/clip-vit-base-patch32")
+    model = CLIPModel.from_pretrained(MODEL_ID)
+    processor = CLIPProcessor.from_pretrained(MODEL_ID)
     # device = "cuda" if torch.cuda.is_available() else "cpu" - NVIDIA GPUs
     device = "mps" if torch.mps.is_available() else "cpu" # Apple Silicon
     model = model.to(device)
@@ -76,7 +79,8 @@ def classify_image():
 
         return jsonify({
             'label': label,
-            'confidence': confidence
+            'confidence': confidence,
+            'model': MODEL_ID
         })
 
     except Exception as e:
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/health"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/ingest"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/jobs"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/retention"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/stream"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/velocity"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// runIngest runs the firehose subscriber and the maintenance jobs of the tables it writes until ctx is done.
+// Only one process should ingest at a time, onPostAdded is nil when this process doesn't serve feeds.
+func runIngest(ctx context.Context, dbInstance db.DB, checker *health.Checker, onPostAdded func(post db.Post), shutdownTimeout time.Duration, logger *slog.Logger) {
+	// prune old posts and engagement, posts engaged with within the longest top feed window are kept
+	var longestTopWindow time.Duration
+	for _, window := range topFeedWindows() {
+		longestTopWindow = max(longestTopWindow, window.Duration)
+	}
+	retentionPolicy := retention.Policy{
+		PostTTL:       envDuration("POST_RETENTION", 0),
+		LikeTTL:       envDuration("LIKE_RETENTION", 0),
+		RepostTTL:     envDuration("REPOST_RETENTION", 0),
+		ProtectWindow: envDuration("RETENTION_PROTECT_WINDOW", longestTopWindow),
+		BatchSize:     envInt("RETENTION_BATCH_SIZE", 1000),
+		BatchPause:    envDuration("RETENTION_BATCH_PAUSE", 100*time.Millisecond),
+		ArchiveDir:    os.Getenv("RETENTION_ARCHIVE_DIR"),
+	}
+	pruner, err := retention.NewPruner(dbInstance, retentionPolicy, logger)
+	if err != nil {
+		log.Fatalf("Failed to create pruner: %v", err)
+	}
+	if retentionPolicy.Enabled() {
+		go jobs.Run(ctx, logger, "prune-old-rows", envDuration("RETENTION_INTERVAL", time.Hour), pruner.Prune)
+	}
+	// engagement stored while its post was being deleted is cleaned up after the fact
+	go jobs.Run(ctx, logger, "prune-orphaned-rows", envDuration("ORPHAN_CLEANUP_INTERVAL", time.Hour), pruner.PruneOrphans)
+
+	// periodically repair engagement counters that drifted from the engagement tables
+	reconcileInterval := envDuration("STATS_RECONCILE_INTERVAL", time.Hour)
+	reconcileWindow := envDuration("STATS_RECONCILE_WINDOW", 7*24*time.Hour)
+	// recounting posts older than the engagement TTL would undo the counts of pruned likes and reposts
+	if engagementTTL := retentionPolicy.EngagementTTL(); engagementTTL > 0 && engagementTTL < reconcileWindow {
+		logger.Warn(fmt.Sprintf("limiting STATS_RECONCILE_WINDOW to the engagement retention of %s", engagementTTL))
+		reconcileWindow = engagementTTL
+	}
+	go jobs.Run(ctx, logger, "reconcile-post-stats", reconcileInterval, func(ctx context.Context) error {
+		repaired, err := dbInstance.ReconcilePostStats(ctx, time.Now().Add(-reconcileWindow))
+		if err != nil {
+			return err
+		}
+		if repaired > 0 {
+			logger.Warn(fmt.Sprintf("repaired engagement counters of %d posts", repaired))
+		}
+		return nil
+	})
+
+	// engagement velocity is counted in memory and flushed for the rising feed, after a restart
+	// the scores of the previous process are kept until the tracker has a baseline to compare with
+	velocityTracker := velocity.NewTracker()
+	go jobs.Run(ctx, logger, "flush-post-velocity", envDuration("VELOCITY_FLUSH_INTERVAL", time.Minute), func(ctx context.Context) error {
+		now := time.Now()
+		if !velocityTracker.Warm(now) {
+			return nil
+		}
+		return dbInstance.ReplaceVelocities(ctx, velocityTracker.Scores(now))
+	})
+
+	// likes and reposts are written in batches, engagement on posts that aren't indexed
+	// is held for a while in case the post is still being classified, then discarded
+	ingestBuffer, err := ingest.NewBuffer(dbInstance, ingest.Config{
+		BatchSize: int(envInt("INGEST_BATCH_SIZE", 1000)),
+		HoldFor:   envDuration("HELD_ENGAGEMENT_TTL", 2*time.Minute),
+		MaxHeld:   int(envInt("HELD_ENGAGEMENT_MAX", 100000)),
+	}, logger)
+	if err != nil {
+		log.Fatalf("Failed to create ingest buffer: %v", err)
+	}
+	if err := ingestBuffer.Load(ctx); err != nil {
+		log.Fatalf("Failed to load indexed posts: %v", err)
+	}
+	logger.Info(fmt.Sprintf("tracking engagement on %d indexed posts", ingestBuffer.Tracked()))
+	// the buffer is stopped after the subscriber, so engagement from events handled while draining is written
+	bufferCtx, stopBuffer := context.WithCancel(context.WithoutCancel(ctx))
+	bufferStopped := make(chan struct{})
+	go func() {
+		defer close(bufferStopped)
+		ingestBuffer.Run(bufferCtx, envDuration("INGEST_FLUSH_INTERVAL", time.Second))
+	}()
+	// posts approved in review or removed by retention are picked up by reloading the indexed posts
+	go jobs.Run(ctx, logger, "reload-tracked-posts", envDuration("TRACKED_POSTS_RELOAD_INTERVAL", 10*time.Minute), ingestBuffer.Load)
+
+	// start listening for events from bsky firehose
+	subscriber, err := stream.NewSubscriber(ctx, dbInstance, ingestBuffer, velocityTracker, logger)
+	if err != nil {
+		log.Fatalf("Failed to create subscriber: %v", err)
+	}
+	if onPostAdded != nil {
+		subscriber.OnPostAdded(onPostAdded)
+	}
+	checker.Add("classifier", func(ctx context.Context) (any, error) {
+		return nil, subscriber.CheckClassifier(ctx)
+	})
+	maxIngestLag := envDuration("READY_MAX_INGEST_LAG", time.Minute)
+	// the checkpoint falls behind while engagement can't be written, and a restart skips
+	// to the live tip once it is older than FIREHOSE_MAX_REPLAY
+	maxCheckpointLag := envDuration("READY_MAX_CHECKPOINT_LAG", 5*time.Minute)
+	checker.Add("firehose", func(ctx context.Context) (any, error) {
+		lag, err := subscriber.Lag()
+		if err != nil {
+			return nil, err
+		}
+		checkpointLag := subscriber.CheckpointLag()
+		details := map[string]float64{"lag_seconds": lag.Seconds(), "checkpoint_lag_seconds": checkpointLag.Seconds()}
+		if lag > maxIngestLag {
+			return details, fmt.Errorf("ingest lag of %s exceeds %s", lag.Round(time.Second), maxIngestLag)
+		}
+		if checkpointLag > maxCheckpointLag {
+			return details, fmt.Errorf("cursor checkpoint lag of %s exceeds %s", checkpointLag.Round(time.Second), maxCheckpointLag)
+		}
+		return details, nil
+	})
+	// the cursor is checkpointed, so a restarted subscriber resumes where this one stopped
+	go jobs.Run(ctx, logger, "checkpoint-firehose-cursor", envDuration("CURSOR_CHECKPOINT_INTERVAL", 10*time.Second), subscriber.SaveCursor)
+
+	// Run subscriber until shutdown, events already read are handled before it returns
+	if err := subscriber.Run(ctx); err != nil {
+		log.Printf("Subscriber error: %v", err)
+	}
+	stopBuffer()
+	<-bufferStopped
+	// checkpoint once the engagement of every handled event is written
+	checkpointCtx, cancelCheckpoint := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelCheckpoint()
+	if err := subscriber.SaveCursor(checkpointCtx); err != nil {
+		log.Printf("Failed to checkpoint firehose cursor: %v", err)
+	}
+}
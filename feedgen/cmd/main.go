@@ -4,18 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/medhir/bsky-feed-generator/feedgen/pkg/auth"
 	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
-	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feedrouter"
-	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feeds/dynamic"
-	staticfeed "github.com/medhir/bsky-feed-generator/feedgen/pkg/feeds/static"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feeds/windowed"
 	ginendpoints "github.com/medhir/bsky-feed-generator/feedgen/pkg/gin"
-	"github.com/medhir/bsky-feed-generator/feedgen/pkg/stream"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/health"
 	"log"
 	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	ginprometheus "github.com/ericvolp12/go-gin-prometheus"
@@ -29,9 +28,40 @@ import (
 	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
 )
 
+const usage = "usage: feedgen [serve|ingest|all] | feedgen migrate up|down [steps]|status|force <version>"
+
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
+	// without a subcommand feedgen serves the feeds and ingests the firehose in one process
+	mode := "all"
+	if len(os.Args) > 1 {
+		mode = os.Args[1]
+	}
+	switch mode {
+	case "migrate":
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+	case "serve":
+		run(true, false)
+	case "ingest":
+		run(false, true)
+	case "all":
+		run(true, true)
+	default:
+		log.Fatal(usage)
+	}
+}
+
+// run serves the feeds, ingests the firehose, or both, until SIGINT or SIGTERM. Either way
+// the process serves metrics and health probes, and only ingest requires the app password
+// and the classifier, so feed serving can be scaled separately from the single ingester.
+func run(serveFeeds, ingestFirehose bool) {
+	// SIGINT and SIGTERM cancel ctx, which starts a graceful shutdown
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(signalCtx)
 	defer cancel()
+	shutdownTimeout := envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
 
 	// Configure feed generator from environment variables
 
@@ -42,69 +72,67 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		// runs last, so spans of the shutdown are exported too
 		defer func() {
-			if err := shutdown(ctx); err != nil {
-				log.Fatal(err)
+			flushCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := shutdown(flushCtx); err != nil {
+				log.Printf("Failed to flush traces: %v", err)
 			}
 		}()
 	}
 
-	feedActorDID := os.Getenv("FEED_ACTOR_DID")
-	if feedActorDID == "" {
-		log.Fatal("FEED_ACTOR_DID environment variable must be set")
-	}
-
-	// serviceEndpoint is a URL that the feed generator will be available at
-	serviceEndpoint := os.Getenv("SERVICE_ENDPOINT")
-	if serviceEndpoint == "" {
-		log.Fatal("SERVICE_ENDPOINT environment variable must be set")
+	// refuse to serve from a schema this binary doesn't know, replicas migrating
+	// at the same time wait on each other
+	schema, err := db.EnsureSchema(os.Getenv("AUTO_MIGRATE") == "true")
+	if err != nil {
+		log.Fatalf("Database schema is not ready: %v", err)
 	}
+	log.Printf("database schema is at %s", schema)
 
-	// Set the acceptable DIDs for the feed generator to respond to
-	// We'll default to the feedActorDID and the Service Endpoint as a did:web
-	serviceURL, err := url.Parse(serviceEndpoint)
+	dbInstance, err := db.NewDB(ctx)
 	if err != nil {
-		log.Fatal(fmt.Errorf("error parsing feedgen endpoint: %w", err))
+		log.Fatalf("Failed to create DB: %v", err)
 	}
+	logger := slog.Default()
 
-	serviceWebDID := "did:web:" + serviceURL.Hostname()
-
-	log.Printf("feedgen DID Web: %s", serviceWebDID)
-
-	acceptableDIDs := []string{feedActorDID, serviceWebDID}
-
-	// Create a new feed router instance
-	feedRouter, err := feedrouter.NewFeedRouter(ctx, feedActorDID, serviceWebDID, acceptableDIDs, serviceEndpoint)
+	// readiness checks the DB and schema, ingest adds the classifier and firehose once the subscriber is started
+	checker, err := health.NewChecker(envDuration("READY_CHECK_TIMEOUT", 2*time.Second))
 	if err != nil {
-		log.Fatal(fmt.Errorf("error creating feed router: %w", err))
+		log.Fatalf("Failed to create health checker: %v", err)
+	}
+	checker.Add("database", func(ctx context.Context) (any, error) {
+		return nil, dbInstance.Ping(ctx)
+	})
+	checker.Add("schema", func(ctx context.Context) (any, error) {
+		status, err := dbInstance.SchemaStatus(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !status.Current() {
+			return status, fmt.Errorf("database schema is at %s", status)
+		}
+		return status, nil
+	})
+	if ingestFirehose {
+		checker.Add("firehose", func(ctx context.Context) (any, error) {
+			return nil, errors.New("subscriber is not started")
+		})
 	}
-
-	// Here we can add feeds to the Feed Router instance
-	// Feeds conform to the Feed interface, which is defined in
-	// pkg/feedrouter/feedrouter.go
-
-	// For demonstration purposes, we'll use a static feed generator
-	// that will always return the same feed skeleton (one post)
-	staticFeed, staticFeedAliases, err := staticfeed.NewStaticFeed(
-		ctx,
-		feedActorDID,
-		"static",
-		// This static post is the conversation that sparked this demo repo
-		[]string{"at://did:plc:q6gjnaw2blty4crticxkmujt/app.bsky.feed.post/3jx7msc4ive26"},
-	)
-
-	// Add the static feed to the feed generator
-	feedRouter.AddFeed(staticFeedAliases, staticFeed)
 
 	// Create a gin router with default middleware for logging and recovery
 	router := gin.Default()
 
-	// Plug in OTEL Middleware and skip metrics endpoint
+	// Plug in OTEL Middleware and skip metrics and probe endpoints
 	router.Use(
 		otelgin.Middleware(
 			"go-bsky-feed-generator",
 			otelgin.WithFilter(func(req *http.Request) bool {
-				return req.URL.Path != "/metrics"
+				switch req.URL.Path {
+				case "/metrics", "/healthz", "/readyz":
+					return false
+				}
+				return true
 			}),
 		),
 	)
@@ -113,26 +141,16 @@ func main() {
 	p := ginprometheus.NewPrometheus("gin", nil)
 	p.Use(router)
 
-	// Add unauthenticated routes for feed generator
-	ep := ginendpoints.NewEndpoints(feedRouter)
-	router.GET("/.well-known/did.json", ep.GetWellKnownDID)
-	router.GET("/xrpc/app.bsky.feed.describeFeedGenerator", ep.DescribeFeeds)
-
-	// Plug in Authentication Middleware
-	auther, err := auth.NewAuth(
-		100_000,
-		time.Hour*12,
-		5,
-		serviceWebDID,
-	)
-	if err != nil {
-		log.Fatalf("Failed to create Auth: %v", err)
-	}
+	// Add liveness and readiness probes
+	healthEp := ginendpoints.NewHealthEndpoints(checker)
+	router.GET("/healthz", healthEp.Healthz)
+	router.GET("/readyz", healthEp.Readyz)
 
-	router.Use(auther.AuthenticateGinRequestViaJWT)
-
-	// Add authenticated routes for feed generator
-	router.GET("/xrpc/app.bsky.feed.getFeedSkeleton", ep.GetFeedSkeleton)
+	// feed routes are registered before the server starts, the feeds are added as they are created
+	var onPostAdded func(post db.Post)
+	if serveFeeds {
+		onPostAdded = runServe(ctx, router, dbInstance, logger)
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -140,39 +158,74 @@ func main() {
 	}
 
 	log.Printf("Starting server on port %s", port)
+	server := &http.Server{Addr: fmt.Sprintf(":%s", port), Handler: router}
 	go func() {
-		if err := router.Run(fmt.Sprintf(":%s", port)); err != nil {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Printf("HTTP server error: %v", err)
 			cancel()
 		}
 	}()
+	// on shutdown stop accepting requests and let the ones in flight finish
+	serverStopped := make(chan struct{})
+	go func() {
+		defer close(serverStopped)
+		<-ctx.Done()
+		log.Printf("Shutting down, draining HTTP requests for up to %s", shutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("HTTP server shutdown: %v", err)
+		}
+	}()
 
-	dbInstance, err := db.NewDB(ctx)
+	if ingestFirehose {
+		// runs until shutdown, events already read are handled before it returns
+		runIngest(ctx, dbInstance, checker, onPostAdded, shutdownTimeout, logger)
+	} else {
+		<-ctx.Done()
+	}
+	<-serverStopped
+	log.Printf("Shutdown complete")
+}
+
+// topFeedWindows returns the windows of the "top of the period" feeds, retention keeps posts engaged with within them
+func topFeedWindows() []windowed.Window {
+	topWindowsSpec := os.Getenv("TOP_FEED_WINDOWS")
+	if topWindowsSpec == "" {
+		topWindowsSpec = "TopBirdsToday=24h,TopBirdsThisWeek=168h,TopBirdsThisMonth=720h"
+	}
+	topWindows, err := windowed.ParseWindows(topWindowsSpec)
 	if err != nil {
-		log.Fatalf("Failed to create DB: %v", err)
+		log.Fatalf("Failed to parse TOP_FEED_WINDOWS: %v", err)
 	}
-	logger := slog.Default()
+	return topWindows
+}
 
-	// register dynamic feeds
-	justBirdsFeed, justBirdsFeedAliases := dynamic.NewDynamicFeed(ctx, feedActorDID, "JustBirds", dbInstance.MostRecentWithCursor, logger)
-	feedRouter.AddFeed(justBirdsFeedAliases, justBirdsFeed)
-	mostPopularBirds, mostPopularBirdsAliases := dynamic.NewDynamicFeed(ctx, feedActorDID, "MostPopularBirds", dbInstance.MostPopularWithCursor, logger)
-	feedRouter.AddFeed(mostPopularBirdsAliases, mostPopularBirds)
+// envDuration reads a duration such as "90s" or "1h" from an environment variable,
+// falling back to the default when it is unset
+func envDuration(name string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		log.Fatalf("%s must be a positive duration: %q", name, raw)
+	}
+	return d
+}
 
-	// start listening for events from bsky firehose
-	subscriber, err := stream.NewSubscriber(ctx, dbInstance, logger)
-	if err != nil {
-		log.Fatalf("Failed to create subscriber: %v", err)
-	}
-	// Run subscriber in main goroutine
-	for {
-		if err := subscriber.Run(); err != nil && !errors.Is(err, context.Canceled) {
-			log.Printf("Subscriber error: %v, retrying in 1 second...", err)
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		break
+// envInt reads a positive integer from an environment variable, falling back to the default when it is unset
+func envInt(name string, fallback int64) int64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || n <= 0 {
+		log.Fatalf("%s must be a positive integer: %q", name, raw)
 	}
+	return n
 }
 
 // installExportPipeline registers a trace provider instance as a global trace provider,
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+)
+
+var errUsage = errors.New("usage: feedgen migrate up|down [steps]|status|force <version>")
+
+// runMigrate runs the migrate subcommand against the configured database
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	url, err := db.DatabaseURL()
+	if err != nil {
+		return err
+	}
+	m, err := db.NewMigrator(url)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	switch args[0] {
+	case "up":
+		if err := m.Up(); err != nil {
+			return err
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("steps must be an integer: %q", args[1])
+			}
+		}
+		if err := m.Down(steps); err != nil {
+			return err
+		}
+	case "force":
+		if len(args) < 2 {
+			return errUsage
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("version must be an integer: %q", args[1])
+		}
+		if err := m.Force(version); err != nil {
+			return err
+		}
+	case "status":
+	default:
+		return errUsage
+	}
+
+	status, err := m.Status()
+	if err != nil {
+		return err
+	}
+	log.Printf("database schema is at %s", status)
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/auth"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feedrouter"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feeds/cache"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feeds/dynamic"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feeds/snapshot"
+	staticfeed "github.com/medhir/bsky-feed-generator/feedgen/pkg/feeds/static"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feeds/windowed"
+	ginendpoints "github.com/medhir/bsky-feed-generator/feedgen/pkg/gin"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/jobs"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/ranking"
+	"log"
+	"log/slog"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// runServe registers the feed and admin routes and starts the feeds. It returns a function
+// to call with every post the subscriber adds, when this process also ingests the firehose.
+func runServe(ctx context.Context, router *gin.Engine, dbInstance db.DB, logger *slog.Logger) func(post db.Post) {
+	feedActorDID := os.Getenv("FEED_ACTOR_DID")
+	if feedActorDID == "" {
+		log.Fatal("FEED_ACTOR_DID environment variable must be set")
+	}
+
+	// serviceEndpoint is a URL that the feed generator will be available at
+	serviceEndpoint := os.Getenv("SERVICE_ENDPOINT")
+	if serviceEndpoint == "" {
+		log.Fatal("SERVICE_ENDPOINT environment variable must be set")
+	}
+
+	// Set the acceptable DIDs for the feed generator to respond to
+	// We'll default to the feedActorDID and the Service Endpoint as a did:web
+	serviceURL, err := url.Parse(serviceEndpoint)
+	if err != nil {
+		log.Fatal(fmt.Errorf("error parsing feedgen endpoint: %w", err))
+	}
+
+	serviceWebDID := "did:web:" + serviceURL.Hostname()
+
+	log.Printf("feedgen DID Web: %s", serviceWebDID)
+
+	acceptableDIDs := []string{feedActorDID, serviceWebDID}
+
+	// Create a new feed router instance
+	feedRouter, err := feedrouter.NewFeedRouter(ctx, feedActorDID, serviceWebDID, acceptableDIDs, serviceEndpoint)
+	if err != nil {
+		log.Fatal(fmt.Errorf("error creating feed router: %w", err))
+	}
+
+	// Here we can add feeds to the Feed Router instance
+	// Feeds conform to the Feed interface, which is defined in
+	// pkg/feedrouter/feedrouter.go
+
+	// For demonstration purposes, we'll use a static feed generator
+	// that will always return the same feed skeleton (one post)
+	staticFeed, staticFeedAliases, err := staticfeed.NewStaticFeed(
+		ctx,
+		feedActorDID,
+		"static",
+		// This static post is the conversation that sparked this demo repo
+		[]string{"at://did:plc:q6gjnaw2blty4crticxkmujt/app.bsky.feed.post/3jx7msc4ive26"},
+	)
+
+	// Add the static feed to the feed generator
+	feedRouter.AddFeed(staticFeedAliases, staticFeed)
+
+	// ranking parameters are stored in the DB so they can be tuned without redeploying
+	rankingConfig := ranking.NewConfig(dbInstance, logger)
+	if err := rankingConfig.Refresh(ctx); err != nil {
+		log.Fatalf("Failed to load ranking parameters: %v", err)
+	}
+	go jobs.Run(ctx, logger, "refresh-ranking-config", envDuration("RANKING_REFRESH_INTERVAL", 30*time.Second), func(ctx context.Context) error {
+		return rankingConfig.Refresh(ctx)
+	})
+
+	// Add unauthenticated routes for feed generator
+	ep := ginendpoints.NewEndpoints(feedRouter)
+	router.GET("/.well-known/did.json", ep.GetWellKnownDID)
+	router.GET("/xrpc/app.bsky.feed.describeFeedGenerator", ep.DescribeFeeds)
+
+	// Add admin routes, guarded by their own token instead of the JWT middleware
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		adminAuth, err := auth.NewAdminAuth(adminToken)
+		if err != nil {
+			log.Fatalf("Failed to create admin auth: %v", err)
+		}
+		adminEp := ginendpoints.NewAdminEndpoints(dbInstance, rankingConfig)
+		admin := router.Group("/admin", adminAuth.AuthenticateGinRequest)
+		admin.GET("/classifications/report", adminEp.ClassificationReport)
+		admin.GET("/review", adminEp.ListReviewItems)
+		admin.GET("/review/ui", adminEp.ReviewPage)
+		admin.POST("/review/:id/approve", adminEp.ApproveReviewItem)
+		admin.POST("/review/:id/reject", adminEp.RejectReviewItem)
+		admin.GET("/ranking/hot", adminEp.GetHotRanking)
+		admin.PUT("/ranking/hot", adminEp.PutHotRanking)
+	}
+
+	// Plug in Authentication Middleware
+	auther, err := auth.NewAuth(
+		100_000,
+		time.Hour*12,
+		5,
+		serviceWebDID,
+	)
+	if err != nil {
+		log.Fatalf("Failed to create Auth: %v", err)
+	}
+
+	router.Use(auther.AuthenticateGinRequestViaJWT)
+
+	// Add authenticated routes for feed generator
+	router.GET("/xrpc/app.bsky.feed.getFeedSkeleton", ep.GetFeedSkeleton)
+
+	// pages of the most recent feed are shared between users for FEED_CACHE_TTL. They are dropped as posts
+	// are added only when this process also ingests, a serve-only process shows new posts after the TTL.
+	feedCache, err := cache.New(int(envInt("FEED_CACHE_SIZE", 1000)), envDuration("FEED_CACHE_TTL", 5*time.Second))
+	if err != nil {
+		log.Fatalf("Failed to create feed cache: %v", err)
+	}
+
+	// register dynamic feeds
+	justBirdsKey := db.TimeIndexed
+	if raw := os.Getenv("JUST_BIRDS_TIME_KEY"); raw != "" {
+		if justBirdsKey, err = db.ParseTimeKey(raw); err != nil {
+			log.Fatalf("Failed to parse JUST_BIRDS_TIME_KEY: %v", err)
+		}
+	}
+	justBirdsFeed, justBirdsFeedAliases := dynamic.NewDynamicFeed(ctx, feedActorDID, "JustBirds", func(ctx context.Context, limit int64, cursor *db.Cursor) ([]db.FeedPost, error) {
+		return dbInstance.MostRecentWithCursor(ctx, justBirdsKey, limit, cursor)
+	}, logger)
+	feedRouter.AddFeed(justBirdsFeedAliases, feedCache.Wrap(justBirdsFeed))
+
+	// ranking feeds are served from snapshots recomputed in the background, so requests don't run ranking queries
+	snapshotInterval := envDuration("SNAPSHOT_INTERVAL", 30*time.Second)
+	snapshotConfig := snapshot.Config{
+		Size:      envInt("SNAPSHOT_SIZE", 1000),
+		Retention: envDuration("SNAPSHOT_RETENTION", 10*time.Minute),
+	}
+	if os.Getenv("SNAPSHOT_PERSIST") == "true" {
+		snapshotConfig.Store = dbInstance
+	}
+	newSnapshotFeed := func(name string, rank snapshot.RankFunc) (feedrouter.Feed, []string, error) {
+		feed, aliases, err := snapshot.NewSnapshotFeed(feedActorDID, name, rank, snapshotConfig, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		feed.Start(ctx, snapshotInterval)
+		return feed, aliases, nil
+	}
+	for name, rank := range map[string]snapshot.RankFunc{
+		"MostPopularBirds": dbInstance.MostPopularWithCursor,
+		"HotBirds":         rankingConfig.HotFeed,
+		"RisingBirds":      dbInstance.RisingWithCursor,
+	} {
+		feed, aliases, err := newSnapshotFeed(name, rank)
+		if err != nil {
+			log.Fatalf("Failed to create %s feed: %v", name, err)
+		}
+		feedRouter.AddFeed(aliases, feed)
+	}
+	topBirds, topBirdsAliases, err := windowed.NewWindowedFeed(topFeedWindows(), func(window windowed.Window) (feedrouter.Feed, []string, error) {
+		return newSnapshotFeed(window.Name, windowed.Since(window.Duration, dbInstance.TopSinceWithCursor))
+	})
+	if err != nil {
+		log.Fatalf("Failed to create top feeds: %v", err)
+	}
+	feedRouter.AddFeed(topBirdsAliases, topBirds)
+
+	// the subscriber runs in this process in all mode only
+	return func(post db.Post) {
+		feedCache.Invalidate()
+	}
+}
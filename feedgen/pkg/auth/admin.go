@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestedWithHeader must be set on admin requests that change state when they are
+// authenticated with basic auth. Browsers resend cached basic auth credentials on
+// cross-site form posts, but a cross-site page can't set custom headers without CORS.
+const RequestedWithHeader = "X-Requested-With"
+
+// AdminAuth guards the admin endpoints with a shared token
+type AdminAuth struct {
+	token string
+}
+
+// NewAdminAuth creates a new AdminAuth for the given token
+// The token is accepted either as a Bearer token or as the password of HTTP
+// basic auth, so that admin pages can be opened in a browser
+func NewAdminAuth(token string) (*AdminAuth, error) {
+	if token == "" {
+		return nil, fmt.Errorf("admin token must not be empty")
+	}
+	return &AdminAuth{token: token}, nil
+}
+
+func (a *AdminAuth) AuthenticateGinRequest(c *gin.Context) {
+	var provided string
+	user := "admin"
+	username, password, basic := c.Request.BasicAuth()
+	if basic {
+		provided = password
+		if username != "" {
+			user = username
+		}
+	} else if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		provided = bearer
+	}
+
+	if provided == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(a.token)) != 1 {
+		c.Header("WWW-Authenticate", `Basic realm="feedgen admin"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid admin credentials"})
+		c.Abort()
+		return
+	}
+
+	// Bearer tokens are never sent by the browser on its own, basic auth credentials are
+	if basic && !isSafeMethod(c.Request.Method) && c.GetHeader(RequestedWithHeader) == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s header is required", RequestedWithHeader)})
+		c.Abort()
+		return
+	}
+
+	// Set the basic auth username to context so admin actions can be attributed. Everyone
+	// shares the token, so the username is whatever the client sent and only self-reported.
+	c.Set("admin_user", user)
+	c.Next()
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Classifier roles recorded in the classification log. The primary classifier
+// decides what goes into the feed, the candidate classifier is only evaluated
+// in shadow mode.
+const (
+	ClassifierPrimary   = "primary"
+	ClassifierCandidate = "candidate"
+)
+
+// ClassificationLog is a single classifier result for one image of a post
+type ClassificationLog struct {
+	PostURI    string
+	ImageCID   string
+	Label      string
+	Confidence float64
+	Model      string
+	Role       string
+	CreatedAt  time.Time
+}
+
+// ClassificationScore is the highest confidence a post's images received for a
+// label from each classifier role. A nil score means the role never classified the post.
+type ClassificationScore struct {
+	PostURI   string
+	Primary   *float64
+	Candidate *float64
+}
+
+func (d *dbPostgres) LogClassification(ctx context.Context, entry ClassificationLog) error {
+	_, err := d.db.Exec(ctx, `
+        INSERT INTO classification_log (post_uri, image_cid, label, confidence, model, role, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		entry.PostURI, entry.ImageCID, entry.Label, entry.Confidence, entry.Model, entry.Role, entry.CreatedAt)
+	return err
+}
+
+func (d *dbPostgres) ClassificationScores(ctx context.Context, label string, since time.Time) ([]ClassificationScore, error) {
+	query := `
+        SELECT post_uri,
+            MAX(CASE WHEN label = $1 THEN confidence ELSE 0 END) FILTER (WHERE role = $2),
+            MAX(CASE WHEN label = $1 THEN confidence ELSE 0 END) FILTER (WHERE role = $3)
+        FROM classification_log
+        WHERE created_at >= $4
+        GROUP BY post_uri`
+
+	// the report scans the whole window, keep it off the primary
+	var scores []ClassificationScore
+	err := d.read(ctx, func(pool *pgxpool.Pool) error {
+		scores = nil
+		rows, err := pool.Query(ctx, query, label, ClassifierPrimary, ClassifierCandidate, since)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var score ClassificationScore
+			if err := rows.Scan(&score.PostURI, &score.Primary, &score.Candidate); err != nil {
+				return err
+			}
+			scores = append(scores, score)
+		}
+		return rows.Err()
+	})
+	return scores, err
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cursorVersion is bumped whenever the cursor layout changes, cursors of other
+// versions are rejected instead of being misread
+const cursorVersion = "1"
+
+// TimeKey is the time of a post a feed is ordered by
+type TimeKey string
+
+const (
+	// TimeIndexed orders posts by when they were indexed
+	TimeIndexed TimeKey = "indexed_at"
+	// TimeCreated orders posts by the createdAt of their record, clamped to when they were indexed
+	TimeCreated TimeKey = "created_at"
+)
+
+// ParseTimeKey returns the TimeKey named by s
+func ParseTimeKey(s string) (TimeKey, error) {
+	key := TimeKey(s)
+	if _, err := key.column(); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// column returns the post column holding the time, only known keys ever reach a query
+func (k TimeKey) column() (string, error) {
+	switch k {
+	case TimeIndexed:
+		return "indexed_at", nil
+	case TimeCreated:
+		return "created_at", nil
+	}
+	return "", fmt.Errorf("unknown time key %q, expected %s or %s", k, TimeIndexed, TimeCreated)
+}
+
+// FeedPost is a post in a ranked feed along with the sort key it was ranked by
+type FeedPost struct {
+	DID  string
+	Rkey string
+	// Time is the time the feed is ordered by, see TimeKey
+	Time  time.Time
+	Score float64
+}
+
+// URI returns the AT-URI of the post
+func (p FeedPost) URI() string {
+	return fmt.Sprintf("at://%s/app.bsky.feed.post/%s", p.DID, p.Rkey)
+}
+
+// Cursor returns a cursor that continues a feed after this post
+func (p FeedPost) Cursor() *Cursor {
+	return &Cursor{
+		Time:  p.Time,
+		Score: p.Score,
+		DID:   p.DID,
+		Rkey:  p.Rkey,
+	}
+}
+
+// Cursor is the sort key of the last post of a page, the next page starts
+// strictly after it. DID and Rkey break ties between posts with the same key.
+type Cursor struct {
+	Time  time.Time
+	Score float64
+	DID   string
+	Rkey  string
+}
+
+// Encode returns the cursor as an opaque string to hand out to clients
+func (c *Cursor) Encode() string {
+	raw := strings.Join([]string{
+		cursorVersion,
+		strconv.FormatInt(c.Time.UnixMicro(), 10),
+		strconv.FormatFloat(c.Score, 'g', -1, 64),
+		c.DID,
+		c.Rkey,
+	}, "|")
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeCursor parses a cursor produced by Cursor.Encode
+func DecodeCursor(encoded string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor: %w", err)
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 5 || parts[0] != cursorVersion {
+		return nil, fmt.Errorf("unsupported cursor")
+	}
+	micros, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor time: %w", err)
+	}
+	score, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor score: %w", err)
+	}
+	return &Cursor{
+		Time:  time.UnixMicro(micros),
+		Score: score,
+		DID:   parts[3],
+		Rkey:  parts[4],
+	}, nil
+}
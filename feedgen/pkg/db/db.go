@@ -2,162 +2,455 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"strings"
 	"time"
 
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type dbPostgres struct {
-	ctx context.Context
-	db  *pgxpool.Pool
+	db *pgxpool.Pool
+	// replicas serve feed queries when configured, nil otherwise
+	replicas *replicaSet
+}
+
+// Post is a post indexed into the feeds along with the metadata needed to rank,
+// filter and debug it without fetching the post again
+type Post struct {
+	DID   string `json:"did"`
+	Rkey  string `json:"rkey"`
+	URI   string `json:"uri"` // bsky.app web URL
+	ATURI string `json:"at_uri"`
+	CID   string `json:"cid"`
+	// CreatedAt is the client declared creation time. Posts without one or created after
+	// they were indexed are stored with the time they were indexed.
+	CreatedAt time.Time `json:"created_at"`
+	Text      string    `json:"text"`
+	Langs     []string  `json:"langs"`
+	ImageCIDs []string  `json:"image_cids"`
+	AltTexts  []string  `json:"alt_texts"`
+	// Labels are the classifier labels the post matched, with the confidence of the best image
+	Labels     []string  `json:"labels"`
+	Confidence float64   `json:"confidence"`
+	IsReply    bool      `json:"is_reply"`
+	IsQuote    bool      `json:"is_quote"`
+	SelfLabels []string  `json:"self_labels"`
+	IndexedAt  time.Time `json:"indexed_at"`
+}
+
+// Engagement is a like or repost record, keyed by the account that created it
+// and its record key, pointing at the subject post by its author and record key
+type Engagement struct {
+	DID         string
+	Rkey        string
+	SubjectDID  string
+	SubjectRkey string
+}
+
+// RecordKey identifies a record by the account that created it and its record key
+type RecordKey struct {
+	DID  string
+	Rkey string
 }
 
 type DB interface {
-	AddPost(did, rkey, uri string) error
-	DeletePost(rkey string) error
-	AddLike(did, rkey, postRkey string) error
-	DeleteLike(rkey string) error
-	AddRepost(did, rkey, postRkey string) error
-	DeleteRepost(rkey string) error
+	// Ping checks that the database can be reached
+	Ping(ctx context.Context) error
+	// SchemaStatus reads the schema version without taking the migration lock, so it
+	// can be polled by health checks while another process migrates
+	SchemaStatus(ctx context.Context) (SchemaStatus, error)
+	AddPost(ctx context.Context, post Post) error
+	GetPost(ctx context.Context, did, rkey string) (*Post, error)
+	DeletePost(ctx context.Context, did, rkey string) error
+	// AddLike and AddRepost report whether the subject is an indexed post, engagement on other posts is discarded
+	AddLike(ctx context.Context, like Engagement) (bool, error)
+	DeleteLike(ctx context.Context, did, rkey string) error
+	AddRepost(ctx context.Context, repost Engagement) (bool, error)
+	DeleteRepost(ctx context.Context, did, rkey string) error
+	// AddLikes and AddReposts store a batch of engagement at once, skipping engagement that is
+	// already stored or whose subject is not indexed, and return how many were stored
+	AddLikes(ctx context.Context, likes []Engagement) (int64, error)
+	DeleteLikes(ctx context.Context, keys []RecordKey) (int64, error)
+	AddReposts(ctx context.Context, reposts []Engagement) (int64, error)
+	DeleteReposts(ctx context.Context, keys []RecordKey) (int64, error)
+	// PostKeys returns the keys of every indexed post
+	PostKeys(ctx context.Context) ([]RecordKey, error)
+	AddReference(ctx context.Context, ref Reference) error
+	ReconcilePostStats(ctx context.Context, since time.Time) (int64, error)
+	PrunePosts(ctx context.Context, before, protectSince time.Time, limit int64, archive ArchiveFunc) (int64, error)
+	PruneLikes(ctx context.Context, before time.Time, limit int64, archive ArchiveFunc) (int64, error)
+	PruneReposts(ctx context.Context, before time.Time, limit int64, archive ArchiveFunc) (int64, error)
+	// PruneOrphans deletes up to limit engagement, reference, counter and velocity rows whose post is not indexed
+	PruneOrphans(ctx context.Context, limit int64) (int64, error)
 
-	MostRecentWithCursor(limit int64, cursor int64) ([]string, error)
-	MostPopularWithCursor(limit int64, cursor int64) ([]string, error)
+	MostRecentWithCursor(ctx context.Context, key TimeKey, limit int64, cursor *Cursor) ([]FeedPost, error)
+	MostPopularWithCursor(ctx context.Context, limit int64, cursor *Cursor) ([]FeedPost, error)
+	HotWithCursor(ctx context.Context, params HotParams, limit int64, cursor *Cursor) ([]FeedPost, error)
+	TopSinceWithCursor(ctx context.Context, since time.Time, limit int64, cursor *Cursor) ([]FeedPost, error)
+	RisingWithCursor(ctx context.Context, limit int64, cursor *Cursor) ([]FeedPost, error)
+	ReplaceVelocities(ctx context.Context, velocities []Velocity) error
+
+	// SaveFeedSnapshot stores a ranked snapshot of a feed under a version. FeedSnapshot reads a version back
+	// and LatestFeedSnapshot the newest one, both return ErrNotFound if there is none.
+	SaveFeedSnapshot(ctx context.Context, feed string, version int64, posts []FeedPost) error
+	FeedSnapshot(ctx context.Context, feed string, version int64) ([]FeedPost, error)
+	LatestFeedSnapshot(ctx context.Context, feed string) (int64, []FeedPost, error)
+	// PruneFeedSnapshots deletes the snapshots of a feed older than the given version
+	PruneFeedSnapshots(ctx context.Context, feed string, before int64) (int64, error)
+
+	LogClassification(ctx context.Context, entry ClassificationLog) error
+	ClassificationScores(ctx context.Context, label string, since time.Time) ([]ClassificationScore, error)
+
+	AddReviewItem(ctx context.Context, item ReviewItem) error
+	ReviewItems(ctx context.Context, status string, limit int64, cursor int64) ([]ReviewItem, error)
+	DecideReviewItem(ctx context.Context, id int64, decision, reviewer string) (*ReviewItem, error)
+	ImageDecision(ctx context.Context, imageCID string) (string, error)
+
+	GetSetting(ctx context.Context, key string) ([]byte, error)
+	PutSetting(ctx context.Context, key string, value []byte) error
 }
 
+// NewDB connects to the database at DATABASE_URL, falling back to POSTGRES_URL.
+// postgres:// URLs connect to Postgres, sqlite:// URLs open a SQLite file, e.g. sqlite://feedgen.db,
+// and memory:// keeps everything in memory until the process exits.
+// Postgres feed queries are routed to the read replicas in POSTGRES_REPLICA_URLS, see ReplicaConfigFromEnv.
+// Every call is traced and timed, see Instrument
 func NewDB(ctx context.Context) (DB, error) {
-	url := os.Getenv("POSTGRES_URL")
-	if url == "" {
-		return nil, fmt.Errorf("POSTGRES_URL not set")
+	url, err := DatabaseURL()
+	if err != nil {
+		return nil, err
 	}
 
-	dbpool, err := pgxpool.New(ctx, url)
+	var d DB
+	scheme, _, _ := strings.Cut(url, "://")
+	switch scheme {
+	case "postgres", "postgresql":
+		var replicas ReplicaConfig
+		replicas, err = ReplicaConfigFromEnv()
+		if err == nil {
+			d, err = newPostgres(ctx, url, replicas)
+		}
+	case "sqlite":
+		d, err = newSQLite(url)
+	case "memory":
+		d = NewMemoryDB()
+	default:
+		return nil, fmt.Errorf("unsupported database URL scheme: %q", scheme)
+	}
 	if err != nil {
 		return nil, err
 	}
-
-	return &dbPostgres{
-		ctx: ctx,
-		db:  dbpool,
-	}, nil
+	return Instrument(d), nil
 }
 
-func (d *dbPostgres) MostRecentWithCursor(limit int64, cursor int64) ([]string, error) {
-	rows, err := d.db.Query(d.ctx, "SELECT did, record FROM post ORDER BY indexed_at DESC OFFSET $1 LIMIT $2", cursor, limit)
+func newPostgres(ctx context.Context, url string, replicas ReplicaConfig) (*dbPostgres, error) {
+	config, err := newPoolConfig(url)
+	if err != nil {
+		return nil, err
+	}
+	dbpool, err := pgxpool.NewWithConfig(ctx, config)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var posts []string
-	for rows.Next() {
-		var did, record string
-		if err := rows.Scan(&did, &record); err != nil {
+	d := &dbPostgres{db: dbpool}
+	if len(replicas.URLs) > 0 {
+		d.replicas, err = newReplicaSet(ctx, dbpool, replicas)
+		if err != nil {
+			dbpool.Close()
 			return nil, err
 		}
-		atURI := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", did, record)
-		posts = append(posts, atURI)
 	}
-
-	return posts, nil
+	return d, nil
 }
 
-func (d *dbPostgres) MostPopularWithCursor(limit int64, cursor int64) ([]string, error) {
-	query := `
-        SELECT p.did, p.record 
-        FROM post p
-        LEFT JOIN post_like pl ON p.record = pl.post_rkey
-        GROUP BY p.did, p.record
-        ORDER BY COUNT(pl.record) DESC
-        OFFSET $1 LIMIT $2`
+// newPoolConfig parses a Postgres URL into a pool config tracing every query
+func newPoolConfig(url string) (*pgxpool.Config, error) {
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		return nil, err
+	}
+	config.ConnConfig.Tracer = queryTracer{}
+	return config, nil
+}
 
-	rows, err := d.db.Query(d.ctx, query, cursor, limit)
+// MostRecentWithCursor returns the most recent posts by key after the cursor, a nil cursor starts at the top
+func (d *dbPostgres) MostRecentWithCursor(ctx context.Context, key TimeKey, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	column, err := key.column()
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	query := fmt.Sprintf(`
+        SELECT did, record, %[1]s, 0::float8
+        FROM post
+        WHERE $1::timestamptz IS NULL OR (%[1]s, did, record) < ($1, $2, $3)
+        ORDER BY %[1]s DESC, did DESC, record DESC
+        LIMIT $4`, column)
 
-	var posts []string
-	for rows.Next() {
-		var did, record string
-		if err := rows.Scan(&did, &record); err != nil {
-			return nil, err
+	var after *time.Time
+	var did, rkey string
+	if cursor != nil {
+		after, did, rkey = &cursor.Time, cursor.DID, cursor.Rkey
+	}
+	return d.queryFeed(ctx, query, after, did, rkey, limit)
+}
+
+// MostPopularWithCursor returns the most liked posts after the cursor, a nil cursor starts at the top
+func (d *dbPostgres) MostPopularWithCursor(ctx context.Context, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	query := `
+        SELECT s.did, s.record, p.indexed_at, s.likes::float8
+        FROM post_stats s
+        JOIN post p ON p.did = s.did AND p.record = s.record
+        WHERE $1::bigint IS NULL OR (s.likes, s.did, s.record) < ($1, $2, $3)
+        ORDER BY s.likes DESC, s.did DESC, s.record DESC
+        LIMIT $4`
+
+	var after *int64
+	var did, rkey string
+	if cursor != nil {
+		likes := int64(cursor.Score)
+		after, did, rkey = &likes, cursor.DID, cursor.Rkey
+	}
+	return d.queryFeed(ctx, query, after, did, rkey, limit)
+}
+
+// queryFeed runs a feed query selecting did, record, indexed_at and score, on a replica if there is one
+func (d *dbPostgres) queryFeed(ctx context.Context, query string, args ...any) ([]FeedPost, error) {
+	var posts []FeedPost
+	err := d.read(ctx, func(pool *pgxpool.Pool) error {
+		posts = nil
+		rows, err := pool.Query(ctx, query, args...)
+		if err != nil {
+			return err
 		}
-		atURI := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", did, record)
-		posts = append(posts, atURI)
+		defer rows.Close()
+
+		for rows.Next() {
+			var post FeedPost
+			if err := rows.Scan(&post.DID, &post.Rkey, &post.Time, &post.Score); err != nil {
+				return err
+			}
+			posts = append(posts, post)
+		}
+		return rows.Err()
+	})
+	return posts, err
+}
+
+func (d *dbPostgres) Ping(ctx context.Context) error {
+	return d.db.Ping(ctx)
+}
+
+func (d *dbPostgres) SchemaStatus(ctx context.Context) (SchemaStatus, error) {
+	latest, err := latestMigration(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		return SchemaStatus{}, err
+	}
+	status := SchemaStatus{Latest: latest}
+	var version int64
+	err = d.db.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &status.Dirty)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return status, nil
 	}
-	return posts, nil
+	status.Version = uint(version)
+	return status, err
 }
 
-func (d *dbPostgres) AddPost(did, rkey, uri string) error {
-	_, err := d.db.Exec(d.ctx, "INSERT INTO post (did, record, uri, indexed_at) VALUES ($1, $2, $3, $4)", did, rkey, uri, time.Now())
-	return err
+func (d *dbPostgres) AddPost(ctx context.Context, post Post) error {
+	return insertPost(ctx, d.db, post, time.Now())
+}
+
+// execer is implemented by both the pool and transactions
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// createdAt returns the creation time a post is stored with, it is never later than when it was indexed
+func createdAt(post Post, indexedAt time.Time) time.Time {
+	if post.CreatedAt.IsZero() || post.CreatedAt.After(indexedAt) {
+		return indexedAt
+	}
+	return post.CreatedAt
 }
 
-func (d *dbPostgres) DeletePost(rkey string) error {
-	_, err := d.db.Exec(d.ctx, "DELETE FROM post WHERE record = $1", rkey)
+func insertPost(ctx context.Context, db execer, post Post, indexedAt time.Time) error {
+	// every indexed post gets a post_stats row for its engagement counters
+	_, err := db.Exec(ctx, `
+        WITH inserted AS (
+            INSERT INTO post (did, record, uri, at_uri, cid, created_at, text, langs, image_cids, alt_texts,
+                labels, confidence, is_reply, is_quote, self_labels, indexed_at)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+            ON CONFLICT DO NOTHING
+            RETURNING did, record
+        )
+        INSERT INTO post_stats (did, record)
+        SELECT did, record FROM inserted
+        ON CONFLICT DO NOTHING`,
+		post.DID, post.Rkey, post.URI, post.ATURI, post.CID, createdAt(post, indexedAt), post.Text, post.Langs, post.ImageCIDs, post.AltTexts,
+		post.Labels, post.Confidence, post.IsReply, post.IsQuote, post.SelfLabels, indexedAt)
 	return err
 }
 
-func (d *dbPostgres) AddLike(did, rkey, postRkey string) error {
-	tx, err := d.db.Begin(d.ctx)
+func (d *dbPostgres) GetPost(ctx context.Context, did, rkey string) (*Post, error) {
+	var post Post
+	var cid, text *string
+	var confidence *float64
+	err := d.db.QueryRow(ctx, `
+        SELECT did, record, uri, at_uri, cid, created_at, text, langs, image_cids, alt_texts,
+            labels, confidence, is_reply, is_quote, self_labels, indexed_at
+        FROM post WHERE did = $1 AND record = $2`, did, rkey).Scan(
+		&post.DID, &post.Rkey, &post.URI, &post.ATURI, &cid, &post.CreatedAt, &text, &post.Langs, &post.ImageCIDs, &post.AltTexts,
+		&post.Labels, &confidence, &post.IsReply, &post.IsQuote, &post.SelfLabels, &post.IndexedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// posts indexed before metadata was stored have no values for these columns
+	if cid != nil {
+		post.CID = *cid
+	}
+	if text != nil {
+		post.Text = *text
+	}
+	if confidence != nil {
+		post.Confidence = *confidence
+	}
+	return &post, nil
+}
+
+func (d *dbPostgres) DeletePost(ctx context.Context, did, rkey string) error {
+	tx, err := d.db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback(d.ctx)
+	defer tx.Rollback(ctx)
 
-	var exists bool
-	err = tx.QueryRow(d.ctx, "SELECT EXISTS(SELECT 1 FROM post WHERE record = $1)", postRkey).Scan(&exists)
+	_, err = tx.Exec(ctx, "DELETE FROM post WHERE did = $1 AND record = $2", did, rkey)
 	if err != nil {
 		return err
 	}
-	if !exists {
-		return nil
+	_, err = tx.Exec(ctx, "DELETE FROM post_stats WHERE did = $1 AND record = $2", did, rkey)
+	if err != nil {
+		return err
 	}
-
-	_, err = tx.Exec(d.ctx, "INSERT INTO post_like (did, record, post_rkey, indexed_at) VALUES ($1, $2, $3, $4)",
-		did, rkey, postRkey, time.Now())
+	// the deleted post may have been a reply to or a quote of an indexed post
+	_, err = tx.Exec(ctx, `
+        WITH removed AS (
+            DELETE FROM post_reference WHERE did = $1 AND record = $2
+            RETURNING kind, subject_did, subject_rkey
+        ), counts AS (
+            SELECT subject_did, subject_rkey,
+                COUNT(*) FILTER (WHERE kind = $3) AS replies,
+                COUNT(*) FILTER (WHERE kind = $4) AS quotes
+            FROM removed
+            GROUP BY subject_did, subject_rkey
+        )
+        UPDATE post_stats s SET replies = s.replies - c.replies, quotes = s.quotes - c.quotes
+        FROM counts c
+        WHERE s.did = c.subject_did AND s.record = c.subject_rkey`,
+		did, rkey, ReferenceReply, ReferenceQuote)
+	if err != nil {
+		return err
+	}
+	// engagement on the deleted post and references to it are of no use without the post
+	for _, query := range []string{
+		"DELETE FROM post_velocity WHERE did = $1 AND record = $2",
+		"DELETE FROM post_reference WHERE subject_did = $1 AND subject_rkey = $2",
+		"DELETE FROM post_like WHERE subject_did = $1 AND subject_rkey = $2",
+		"DELETE FROM post_repost WHERE subject_did = $1 AND subject_rkey = $2",
+	} {
+		if _, err := tx.Exec(ctx, query, did, rkey); err != nil {
+			return err
+		}
+	}
+	// a deleted post waiting for review must not be added to the feed by approving it
+	_, err = tx.Exec(ctx, "UPDATE review_queue SET status = $1, decided_at = $2 WHERE status = $3 AND did = $4 AND record = $5",
+		ReviewWithdrawn, time.Now(), ReviewPending, did, rkey)
 	if err != nil {
 		return err
 	}
 
-	return tx.Commit(d.ctx)
+	return tx.Commit(ctx)
 }
 
-func (d *dbPostgres) DeleteLike(rkey string) error {
-	_, err := d.db.Exec(d.ctx, "DELETE FROM post_like WHERE record = $1", rkey)
-	return err
+func (d *dbPostgres) AddLike(ctx context.Context, like Engagement) (bool, error) {
+	return d.addEngagement(ctx, "post_like", "likes", like)
+}
+
+func (d *dbPostgres) DeleteLike(ctx context.Context, did, rkey string) error {
+	return d.deleteEngagement(ctx, "post_like", "likes", did, rkey)
 }
 
-func (d *dbPostgres) AddRepost(did, rkey, postRkey string) error {
-	tx, err := d.db.Begin(d.ctx)
+func (d *dbPostgres) AddRepost(ctx context.Context, repost Engagement) (bool, error) {
+	return d.addEngagement(ctx, "post_repost", "reposts", repost)
+}
+
+func (d *dbPostgres) DeleteRepost(ctx context.Context, did, rkey string) error {
+	return d.deleteEngagement(ctx, "post_repost", "reposts", did, rkey)
+}
+
+// addEngagement stores a like or repost if its subject is an indexed post,
+// and increments the subject's counter in the same transaction
+func (d *dbPostgres) addEngagement(ctx context.Context, table, counter string, e Engagement) (bool, error) {
+	tx, err := d.db.Begin(ctx)
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer tx.Rollback(d.ctx)
+	defer tx.Rollback(ctx)
 
 	var exists bool
-	err = tx.QueryRow(d.ctx, "SELECT EXISTS(SELECT 1 FROM post WHERE record = $1)", postRkey).Scan(&exists)
+	err = tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM post WHERE did = $1 AND record = $2)", e.SubjectDID, e.SubjectRkey).Scan(&exists)
 	if err != nil {
-		return err
+		return false, err
 	}
 	if !exists {
-		return nil
+		return false, nil
 	}
 
-	_, err = tx.Exec(d.ctx, "INSERT INTO post_repost (did, record, post_rkey, indexed_at) VALUES ($1, $2, $3, $4)",
-		did, rkey, postRkey, time.Now())
+	// an account's engagement on a post counts once, however many records it creates
+	tag, err := tx.Exec(ctx, `
+        INSERT INTO `+table+` (did, record, subject_did, subject_rkey, indexed_at) VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT DO NOTHING`,
+		e.DID, e.Rkey, e.SubjectDID, e.SubjectRkey, time.Now())
 	if err != nil {
-		return err
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return true, nil
+	}
+	if err := incrementStat(ctx, tx, counter, e.SubjectDID, e.SubjectRkey, 1); err != nil {
+		return false, err
 	}
 
-	return tx.Commit(d.ctx)
+	return true, tx.Commit(ctx)
 }
 
-func (d *dbPostgres) DeleteRepost(rkey string) error {
-	_, err := d.db.Exec(d.ctx, "DELETE FROM post_repost WHERE record = $1", rkey)
-	return err
+// deleteEngagement removes a like or repost and decrements its subject's counter
+func (d *dbPostgres) deleteEngagement(ctx context.Context, table, counter, did, rkey string) error {
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var subjectDID, subjectRkey string
+	err = tx.QueryRow(ctx, "DELETE FROM "+table+" WHERE did = $1 AND record = $2 RETURNING subject_did, subject_rkey", did, rkey).
+		Scan(&subjectDID, &subjectRkey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := incrementStat(ctx, tx, counter, subjectDID, subjectRkey, -1); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
@@ -0,0 +1,867 @@
+// Package dbtest is a conformance test suite for db.DB implementations. Every
+// backend runs the same suite, so they can be swapped without changing behaviour.
+package dbtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+)
+
+// Run runs the conformance suite against a backend. newDB must return an empty
+// database every time it is called.
+func Run(t *testing.T, newDB func(t *testing.T) db.DB) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, d db.DB)
+	}{
+		{"Posts", testPosts},
+		{"DeletePost", testDeletePost},
+		{"Likes", testLikes},
+		{"Reposts", testReposts},
+		{"EngagementOnUnknownPosts", testEngagementOnUnknownPosts},
+		{"EngagementBatches", testEngagementBatches},
+		{"PostKeys", testPostKeys},
+		{"EngagementIntegrity", testEngagementIntegrity},
+		{"References", testReferences},
+		{"MostRecentPagination", testMostRecentPagination},
+		{"MostRecentByCreatedAt", testMostRecentByCreatedAt},
+		{"MostPopularOrdering", testMostPopularOrdering},
+		{"Hot", testHot},
+		{"TopSince", testTopSince},
+		{"Rising", testRising},
+		{"FeedSnapshots", testFeedSnapshots},
+		{"Prune", testPrune},
+		{"Classifications", testClassifications},
+		{"Review", testReview},
+		{"ReviewOfDeletedPost", testReviewOfDeletedPost},
+		{"Settings", testSettings},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newDB(t))
+		})
+	}
+}
+
+const author = "did:plc:author"
+
+var ctx = context.Background()
+
+func newPost(rkey string) db.Post {
+	return db.Post{
+		DID:       author,
+		Rkey:      rkey,
+		URI:       fmt.Sprintf("https://bsky.app/profile/%s/post/%s", author, rkey),
+		ATURI:     fmt.Sprintf("at://%s/app.bsky.feed.post/%s", author, rkey),
+		CID:       "cid-" + rkey,
+		CreatedAt: time.Date(2024, 11, 20, 12, 0, 0, 0, time.UTC),
+		Text:      "a bird",
+		Langs:     []string{"en"},
+		ImageCIDs: []string{"image-" + rkey},
+		AltTexts:  []string{"a robin"},
+		Labels:    []string{"bird"},
+		// exactly representable, so backends storing it as text or binary agree
+		Confidence: 0.875,
+	}
+}
+
+func addPosts(t *testing.T, d db.DB, rkeys ...string) {
+	t.Helper()
+	for _, rkey := range rkeys {
+		if err := d.AddPost(ctx, newPost(rkey)); err != nil {
+			t.Fatalf("AddPost(%s): %v", rkey, err)
+		}
+	}
+}
+
+// engage adds n likes (or reposts) from distinct accounts to a post
+func engage(t *testing.T, add func(context.Context, db.Engagement) (bool, error), rkey string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		tracked, err := add(ctx, db.Engagement{
+			DID:         fmt.Sprintf("did:plc:fan%d", i),
+			Rkey:        "engagement-" + rkey,
+			SubjectDID:  author,
+			SubjectRkey: rkey,
+		})
+		if err != nil {
+			t.Fatalf("adding engagement to %s: %v", rkey, err)
+		}
+		if !tracked {
+			t.Fatalf("engagement on indexed post %s was not tracked", rkey)
+		}
+	}
+}
+
+func rkeys(posts []db.FeedPost) []string {
+	keys := make([]string, len(posts))
+	for i, post := range posts {
+		keys[i] = post.Rkey
+	}
+	return keys
+}
+
+// mostRecent returns the most recent feed ordered by key, to page through with collect
+func mostRecent(d db.DB, key db.TimeKey) func(ctx context.Context, limit int64, cursor *db.Cursor) ([]db.FeedPost, error) {
+	return func(ctx context.Context, limit int64, cursor *db.Cursor) ([]db.FeedPost, error) {
+		return d.MostRecentWithCursor(ctx, key, limit, cursor)
+	}
+}
+
+// collect pages through a feed until it ends
+func collect(t *testing.T, limit int64, fetch func(ctx context.Context, limit int64, cursor *db.Cursor) ([]db.FeedPost, error)) []db.FeedPost {
+	t.Helper()
+	var all []db.FeedPost
+	var cursor *db.Cursor
+	for range 100 {
+		posts, err := fetch(ctx, limit, cursor)
+		if err != nil {
+			t.Fatalf("fetching page: %v", err)
+		}
+		if int64(len(posts)) > limit {
+			t.Fatalf("page has %d posts, limit is %d", len(posts), limit)
+		}
+		all = append(all, posts...)
+		if int64(len(posts)) < limit {
+			return all
+		}
+		// round trip the cursor the way clients do
+		cursor, err = db.DecodeCursor(posts[len(posts)-1].Cursor().Encode())
+		if err != nil {
+			t.Fatalf("decoding cursor: %v", err)
+		}
+	}
+	t.Fatal("feed did not end")
+	return nil
+}
+
+func assertOrder(t *testing.T, posts []db.FeedPost, want ...string) {
+	t.Helper()
+	got := rkeys(posts)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got posts %v, want %v", got, want)
+	}
+}
+
+func assertScore(t *testing.T, d db.DB, rkey string, want float64) {
+	t.Helper()
+	for _, post := range collect(t, 30, d.MostPopularWithCursor) {
+		if post.Rkey == rkey {
+			if post.Score != want {
+				t.Fatalf("post %s has %v likes, want %v", rkey, post.Score, want)
+			}
+			return
+		}
+	}
+	t.Fatalf("post %s is not in the popular feed", rkey)
+}
+
+func testPosts(t *testing.T, d db.DB) {
+	if err := d.Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if status, err := d.SchemaStatus(ctx); err != nil || !status.Current() {
+		t.Errorf("SchemaStatus = %s, %v, want a current schema", status, err)
+	}
+	want := newPost("3kabc")
+	addPosts(t, d, want.Rkey)
+
+	got, err := d.GetPost(ctx, author, want.Rkey)
+	if err != nil {
+		t.Fatalf("GetPost: %v", err)
+	}
+	if got.IndexedAt.IsZero() || time.Since(got.IndexedAt) > time.Minute {
+		t.Errorf("IndexedAt = %v, want about now", got.IndexedAt)
+	}
+	if !got.CreatedAt.Equal(want.CreatedAt) {
+		t.Errorf("CreatedAt = %v, want %v", got.CreatedAt, want.CreatedAt)
+	}
+	got.IndexedAt, got.CreatedAt = time.Time{}, time.Time{}
+	want.CreatedAt = time.Time{}
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("GetPost = %s, want %s", gotJSON, wantJSON)
+	}
+
+	// adding a post twice keeps the first one
+	duplicate := newPost(want.Rkey)
+	duplicate.Text = "changed"
+	if err := d.AddPost(ctx, duplicate); err != nil {
+		t.Fatalf("adding a post twice: %v", err)
+	}
+	if got, _ := d.GetPost(ctx, author, want.Rkey); got.Text != want.Text {
+		t.Errorf("adding a post twice replaced its text with %q", got.Text)
+	}
+	if posts := collect(t, 10, mostRecent(d, db.TimeIndexed)); len(posts) != 1 {
+		t.Errorf("feed has %d posts after adding a post twice, want 1", len(posts))
+	}
+
+	// record keys are only unique per account
+	other := newPost(want.Rkey)
+	other.DID = "did:plc:other"
+	other.ATURI = "at://did:plc:other/app.bsky.feed.post/" + want.Rkey
+	if err := d.AddPost(ctx, other); err != nil {
+		t.Fatalf("AddPost with the same rkey from another account: %v", err)
+	}
+	if posts := collect(t, 10, mostRecent(d, db.TimeIndexed)); len(posts) != 2 {
+		t.Errorf("feed has %d posts, want 2 posts with the same rkey", len(posts))
+	}
+
+	if _, err := d.GetPost(ctx, author, "missing"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetPost of a missing post = %v, want ErrNotFound", err)
+	}
+}
+
+func testDeletePost(t *testing.T, d db.DB) {
+	addPosts(t, d, "a", "b")
+	engage(t, d.AddLike, "a", 2)
+
+	if err := d.DeletePost(ctx, author, "a"); err != nil {
+		t.Fatalf("DeletePost: %v", err)
+	}
+	if _, err := d.GetPost(ctx, author, "a"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetPost after DeletePost = %v, want ErrNotFound", err)
+	}
+	assertOrder(t, collect(t, 10, mostRecent(d, db.TimeIndexed)), "b")
+	assertOrder(t, collect(t, 10, d.MostPopularWithCursor), "b")
+
+	if err := d.DeletePost(ctx, author, "missing"); err != nil {
+		t.Errorf("deleting a missing post: %v", err)
+	}
+}
+
+func testLikes(t *testing.T, d db.DB) {
+	addPosts(t, d, "a")
+	engage(t, d.AddLike, "a", 3)
+	assertScore(t, d, "a", 3)
+
+	if err := d.DeleteLike(ctx, "did:plc:fan0", "engagement-a"); err != nil {
+		t.Fatalf("DeleteLike: %v", err)
+	}
+	assertScore(t, d, "a", 2)
+
+	// deleting twice or deleting an unknown like changes nothing
+	if err := d.DeleteLike(ctx, "did:plc:fan0", "engagement-a"); err != nil {
+		t.Fatalf("deleting a like twice: %v", err)
+	}
+	if err := d.DeleteLike(ctx, "did:plc:stranger", "unknown"); err != nil {
+		t.Fatalf("deleting an unknown like: %v", err)
+	}
+	assertScore(t, d, "a", 2)
+
+	if repaired, err := d.ReconcilePostStats(ctx, time.Time{}); err != nil || repaired != 0 {
+		t.Errorf("ReconcilePostStats = %d, %v, want no repairs", repaired, err)
+	}
+}
+
+func testReposts(t *testing.T, d db.DB) {
+	addPosts(t, d, "a")
+	engage(t, d.AddRepost, "a", 2)
+	// reposts don't count towards the popular feed
+	assertScore(t, d, "a", 0)
+
+	if err := d.DeleteRepost(ctx, "did:plc:fan1", "engagement-a"); err != nil {
+		t.Fatalf("DeleteRepost: %v", err)
+	}
+	if err := d.DeleteRepost(ctx, "did:plc:stranger", "unknown"); err != nil {
+		t.Fatalf("deleting an unknown repost: %v", err)
+	}
+
+	top, err := d.TopSinceWithCursor(ctx, time.Now().Add(-time.Hour), 10, nil)
+	if err != nil {
+		t.Fatalf("TopSinceWithCursor: %v", err)
+	}
+	if len(top) != 1 || top[0].Score != 1 {
+		t.Errorf("top feed = %v, want a with one repost", top)
+	}
+	if repaired, err := d.ReconcilePostStats(ctx, time.Time{}); err != nil || repaired != 0 {
+		t.Errorf("ReconcilePostStats = %d, %v, want no repairs", repaired, err)
+	}
+}
+
+func testEngagementOnUnknownPosts(t *testing.T, d db.DB) {
+	addPosts(t, d, "a")
+	unknown := db.Engagement{DID: "did:plc:fan", Rkey: "like", SubjectDID: author, SubjectRkey: "unknown"}
+	if tracked, err := d.AddLike(ctx, unknown); err != nil || tracked {
+		t.Errorf("AddLike of an unknown post = %v, %v, want untracked", tracked, err)
+	}
+	if tracked, err := d.AddRepost(ctx, unknown); err != nil || tracked {
+		t.Errorf("AddRepost of an unknown post = %v, %v, want untracked", tracked, err)
+	}
+	// same rkey as an indexed post, but by another author
+	otherAuthor := db.Engagement{DID: "did:plc:fan", Rkey: "like2", SubjectDID: "did:plc:other", SubjectRkey: "a"}
+	if tracked, err := d.AddLike(ctx, otherAuthor); err != nil || tracked {
+		t.Errorf("AddLike of another author's post = %v, %v, want untracked", tracked, err)
+	}
+
+	assertScore(t, d, "a", 0)
+	top, err := d.TopSinceWithCursor(ctx, time.Time{}, 10, nil)
+	if err != nil {
+		t.Fatalf("TopSinceWithCursor: %v", err)
+	}
+	if len(top) != 0 {
+		t.Errorf("top feed = %v, want no posts", top)
+	}
+}
+
+func testEngagementBatches(t *testing.T, d db.DB) {
+	addPosts(t, d, "a", "b")
+	like := func(fan int, rkey string) db.Engagement {
+		return db.Engagement{DID: fmt.Sprintf("did:plc:fan%d", fan), Rkey: "like-" + rkey, SubjectDID: author, SubjectRkey: rkey}
+	}
+	batch := []db.Engagement{
+		like(0, "a"), like(1, "a"), like(2, "b"),
+		// duplicates within the batch and engagement on unknown posts are skipped
+		like(0, "a"), like(3, "unknown"),
+	}
+	if added, err := d.AddLikes(ctx, batch); err != nil || added != 3 {
+		t.Fatalf("AddLikes = %d, %v, want 3 added", added, err)
+	}
+	// replaying a batch changes nothing
+	if added, err := d.AddLikes(ctx, batch); err != nil || added != 0 {
+		t.Fatalf("replaying AddLikes = %d, %v, want none added", added, err)
+	}
+	assertScore(t, d, "a", 2)
+	assertScore(t, d, "b", 1)
+
+	if added, err := d.AddReposts(ctx, []db.Engagement{like(0, "a")}); err != nil || added != 1 {
+		t.Fatalf("AddReposts = %d, %v, want 1 added", added, err)
+	}
+
+	keys := []db.RecordKey{{DID: "did:plc:fan0", Rkey: "like-a"}, {DID: "did:plc:fan0", Rkey: "like-a"}, {DID: "did:plc:stranger", Rkey: "unknown"}}
+	if deleted, err := d.DeleteLikes(ctx, keys); err != nil || deleted != 1 {
+		t.Fatalf("DeleteLikes = %d, %v, want 1 deleted", deleted, err)
+	}
+	if deleted, err := d.DeleteReposts(ctx, keys); err != nil || deleted != 1 {
+		t.Fatalf("DeleteReposts = %d, %v, want 1 deleted", deleted, err)
+	}
+	assertScore(t, d, "a", 1)
+
+	// empty batches are a no-op
+	if added, err := d.AddLikes(ctx, nil); err != nil || added != 0 {
+		t.Errorf("AddLikes(nil) = %d, %v", added, err)
+	}
+	if deleted, err := d.DeleteReposts(ctx, nil); err != nil || deleted != 0 {
+		t.Errorf("DeleteReposts(nil) = %d, %v", deleted, err)
+	}
+	if repaired, err := d.ReconcilePostStats(ctx, time.Time{}); err != nil || repaired != 0 {
+		t.Errorf("ReconcilePostStats = %d, %v, want no repairs", repaired, err)
+	}
+}
+
+func testPostKeys(t *testing.T, d db.DB) {
+	if keys, err := d.PostKeys(ctx); err != nil || len(keys) != 0 {
+		t.Fatalf("PostKeys of an empty DB = %v, %v", keys, err)
+	}
+	addPosts(t, d, "a", "b")
+	if err := d.DeletePost(ctx, author, "a"); err != nil {
+		t.Fatalf("DeletePost: %v", err)
+	}
+	keys, err := d.PostKeys(ctx)
+	if err != nil {
+		t.Fatalf("PostKeys: %v", err)
+	}
+	if want := []db.RecordKey{{DID: author, Rkey: "b"}}; fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("PostKeys = %v, want %v", keys, want)
+	}
+}
+
+func testEngagementIntegrity(t *testing.T, d db.DB) {
+	addPosts(t, d, "a", "b")
+	like := func(fan, rkey, subject string) db.Engagement {
+		return db.Engagement{DID: fan, Rkey: rkey, SubjectDID: author, SubjectRkey: subject}
+	}
+	// an account counts once per post, however many records it creates
+	for _, l := range []db.Engagement{like("did:plc:fan", "1", "a"), like("did:plc:fan", "1", "a"), like("did:plc:fan", "2", "a")} {
+		if tracked, err := d.AddLike(ctx, l); err != nil || !tracked {
+			t.Fatalf("AddLike(%s) = %v, %v, want tracked", l.Rkey, tracked, err)
+		}
+	}
+	added, err := d.AddLikes(ctx, []db.Engagement{like("did:plc:fan", "3", "a"), like("did:plc:other", "4", "a"), like("did:plc:other", "5", "a")})
+	if err != nil || added != 1 {
+		t.Errorf("AddLikes with duplicates = %d, %v, want 1", added, err)
+	}
+	if tracked, err := d.AddRepost(ctx, like("did:plc:fan", "1", "a")); err != nil || !tracked {
+		t.Fatalf("AddRepost = %v, %v, want tracked", tracked, err)
+	}
+	if tracked, err := d.AddRepost(ctx, like("did:plc:fan", "2", "a")); err != nil || !tracked {
+		t.Fatalf("second AddRepost = %v, %v, want tracked", tracked, err)
+	}
+	assertScore(t, d, "a", 2)
+	if err := d.AddReference(ctx, db.Reference{DID: author, Rkey: "b", Kind: db.ReferenceQuote, SubjectDID: author, SubjectRkey: "a"}); err != nil {
+		t.Fatalf("AddReference: %v", err)
+	}
+
+	// deleting a post deletes its engagement and the references to it, so nothing
+	// of it is counted if the same post is indexed again
+	if err := d.DeletePost(ctx, author, "a"); err != nil {
+		t.Fatalf("DeletePost: %v", err)
+	}
+	addPosts(t, d, "a")
+	assertScore(t, d, "a", 0)
+	if top, err := d.TopSinceWithCursor(ctx, time.Time{}, 10, nil); err != nil || len(top) != 0 {
+		t.Errorf("top feed after deleting the engaged post = %v, %v, want no posts", top, err)
+	}
+	if repaired, err := d.ReconcilePostStats(ctx, time.Time{}); err != nil || repaired != 0 {
+		t.Errorf("ReconcilePostStats = %d, %v, want no repairs", repaired, err)
+	}
+	if pruned, err := d.PruneOrphans(ctx, 100); err != nil || pruned != 0 {
+		t.Errorf("PruneOrphans = %d, %v, want nothing to prune", pruned, err)
+	}
+}
+
+func testReferences(t *testing.T, d db.DB) {
+	addPosts(t, d, "parent", "reply")
+	if err := d.AddReference(ctx, db.Reference{DID: author, Rkey: "reply", Kind: db.ReferenceReply, SubjectDID: author, SubjectRkey: "parent"}); err != nil {
+		t.Fatalf("AddReference: %v", err)
+	}
+	// adding the same reference twice is ignored
+	if err := d.AddReference(ctx, db.Reference{DID: author, Rkey: "reply", Kind: db.ReferenceReply, SubjectDID: author, SubjectRkey: "parent"}); err != nil {
+		t.Fatalf("adding a reference twice: %v", err)
+	}
+	if err := d.AddReference(ctx, db.Reference{DID: author, Rkey: "reply", Kind: db.ReferenceQuote, SubjectDID: author, SubjectRkey: "unknown"}); err != nil {
+		t.Fatalf("referencing an unknown post: %v", err)
+	}
+	if err := d.AddReference(ctx, db.Reference{DID: author, Rkey: "reply", Kind: "mention", SubjectDID: author, SubjectRkey: "parent"}); err == nil {
+		t.Error("AddReference with an unknown kind succeeded")
+	}
+	if repaired, err := d.ReconcilePostStats(ctx, time.Time{}); err != nil || repaired != 0 {
+		t.Errorf("ReconcilePostStats = %d, %v, want no repairs", repaired, err)
+	}
+
+	if err := d.DeletePost(ctx, author, "reply"); err != nil {
+		t.Fatalf("DeletePost: %v", err)
+	}
+	if repaired, err := d.ReconcilePostStats(ctx, time.Time{}); err != nil || repaired != 0 {
+		t.Errorf("ReconcilePostStats after deleting the reply = %d, %v, want no repairs", repaired, err)
+	}
+}
+
+func testMostRecentPagination(t *testing.T, d db.DB) {
+	if posts, err := d.MostRecentWithCursor(ctx, db.TimeIndexed, 10, nil); err != nil || len(posts) != 0 {
+		t.Fatalf("empty feed = %v, %v", posts, err)
+	}
+
+	want := []string{"a", "b", "c", "d", "e", "f", "g"}
+	addPosts(t, d, want...)
+
+	for _, limit := range []int64{1, 2, 3, 7, 30} {
+		posts := collect(t, limit, mostRecent(d, db.TimeIndexed))
+		if len(posts) != len(want) {
+			t.Fatalf("limit %d: got %v, want every post once", limit, rkeys(posts))
+		}
+		seen := map[string]bool{}
+		for i, post := range posts {
+			if seen[post.Rkey] {
+				t.Fatalf("limit %d: post %s returned twice", limit, post.Rkey)
+			}
+			seen[post.Rkey] = true
+			if i > 0 && post.Time.After(posts[i-1].Time) {
+				t.Fatalf("limit %d: posts are not ordered newest first: %v", limit, rkeys(posts))
+			}
+		}
+	}
+}
+
+func testMostRecentByCreatedAt(t *testing.T, d db.DB) {
+	now := time.Now()
+	for _, post := range []struct {
+		rkey      string
+		createdAt time.Time
+	}{
+		{"new", now.Add(-time.Hour)},
+		{"old", now.Add(-48 * time.Hour)},
+		// posts from the future and posts without a createdAt are stored as created when they were indexed
+		{"future", now.Add(time.Hour)},
+		{"unknown", time.Time{}},
+	} {
+		p := newPost(post.rkey)
+		p.CreatedAt = post.createdAt
+		if err := d.AddPost(ctx, p); err != nil {
+			t.Fatalf("AddPost(%s): %v", post.rkey, err)
+		}
+	}
+
+	assertOrder(t, collect(t, 10, mostRecent(d, db.TimeIndexed)), "unknown", "future", "old", "new")
+	for _, limit := range []int64{1, 3} {
+		assertOrder(t, collect(t, limit, mostRecent(d, db.TimeCreated)), "unknown", "future", "new", "old")
+	}
+
+	future, err := d.GetPost(ctx, author, "future")
+	if err != nil {
+		t.Fatalf("GetPost: %v", err)
+	}
+	if !future.CreatedAt.Equal(future.IndexedAt) {
+		t.Errorf("CreatedAt of a post from the future = %v, want its IndexedAt %v", future.CreatedAt, future.IndexedAt)
+	}
+
+	if _, err := d.MostRecentWithCursor(ctx, db.TimeKey("cid"), 10, nil); err == nil {
+		t.Error("MostRecentWithCursor with an unknown key succeeded")
+	}
+}
+
+func testMostPopularOrdering(t *testing.T, d db.DB) {
+	addPosts(t, d, "none", "one", "three", "tie-a", "tie-b")
+	engage(t, d.AddLike, "one", 1)
+	engage(t, d.AddLike, "three", 3)
+	engage(t, d.AddLike, "tie-a", 2)
+	engage(t, d.AddLike, "tie-b", 2)
+
+	// ties are broken by did and then rkey, descending
+	want := []string{"three", "tie-b", "tie-a", "one", "none"}
+	assertOrder(t, collect(t, 30, d.MostPopularWithCursor), want...)
+	assertOrder(t, collect(t, 2, d.MostPopularWithCursor), want...)
+}
+
+func testHot(t *testing.T, d db.DB) {
+	addPosts(t, d, "quiet", "liked", "reposted")
+	engage(t, d.AddLike, "liked", 3)
+	engage(t, d.AddRepost, "reposted", 3)
+
+	params := db.HotParams{LikeWeight: 1, RepostWeight: 2, HalfLifeHours: 6, MaxAgeHours: 24}
+	hot := func(ctx context.Context, limit int64, cursor *db.Cursor) ([]db.FeedPost, error) {
+		return d.HotWithCursor(ctx, params, limit, cursor)
+	}
+	want := []string{"reposted", "liked", "quiet"}
+	assertOrder(t, collect(t, 30, hot), want...)
+	assertOrder(t, collect(t, 1, hot), want...)
+
+	// posts older than the maximum age are not ranked
+	params.MaxAgeHours = 0
+	if posts, err := d.HotWithCursor(ctx, params, 10, nil); err != nil || len(posts) != 0 {
+		t.Errorf("hot feed with a max age of 0 = %v, %v, want no posts", posts, err)
+	}
+
+	// the rising weight boosts accelerating posts
+	params.MaxAgeHours = 24
+	params.RisingWeight = 100
+	if err := d.ReplaceVelocities(ctx, []db.Velocity{{DID: author, Rkey: "quiet", RecentRate: 10, Score: 1}}); err != nil {
+		t.Fatalf("ReplaceVelocities: %v", err)
+	}
+	assertOrder(t, collect(t, 30, hot), "quiet", "reposted", "liked")
+}
+
+func testTopSince(t *testing.T, d db.DB) {
+	addPosts(t, d, "a", "b", "c")
+	engage(t, d.AddLike, "a", 1)
+	engage(t, d.AddLike, "b", 2)
+	engage(t, d.AddRepost, "b", 1)
+
+	top := func(ctx context.Context, limit int64, cursor *db.Cursor) ([]db.FeedPost, error) {
+		return d.TopSinceWithCursor(ctx, time.Now().Add(-time.Hour), limit, cursor)
+	}
+	posts := collect(t, 1, top)
+	assertOrder(t, posts, "b", "a")
+	if posts[0].Score != 3 {
+		t.Errorf("b has a score of %v, want 3", posts[0].Score)
+	}
+
+	// engagement before the window is not counted
+	if posts, err := d.TopSinceWithCursor(ctx, time.Now().Add(time.Hour), 10, nil); err != nil || len(posts) != 0 {
+		t.Errorf("top feed of an empty window = %v, %v, want no posts", posts, err)
+	}
+}
+
+func testRising(t *testing.T, d db.DB) {
+	addPosts(t, d, "a", "b", "c")
+	err := d.ReplaceVelocities(ctx, []db.Velocity{
+		{DID: author, Rkey: "a", RecentRate: 10, BaselineRate: 1, Score: 2},
+		{DID: author, Rkey: "b", RecentRate: 20, BaselineRate: 1, Score: 3},
+		{DID: author, Rkey: "c", RecentRate: 1, BaselineRate: 1, Score: 0},
+		{DID: author, Rkey: "unknown", RecentRate: 50, BaselineRate: 1, Score: 5},
+	})
+	if err != nil {
+		t.Fatalf("ReplaceVelocities: %v", err)
+	}
+	// posts that aren't accelerating or aren't indexed are left out
+	assertOrder(t, collect(t, 1, d.RisingWithCursor), "b", "a")
+
+	// velocities missing from the next flush are dropped
+	if err := d.ReplaceVelocities(ctx, []db.Velocity{{DID: author, Rkey: "a", RecentRate: 10, Score: 1}}); err != nil {
+		t.Fatalf("ReplaceVelocities: %v", err)
+	}
+	assertOrder(t, collect(t, 30, d.RisingWithCursor), "a")
+
+	if err := d.ReplaceVelocities(ctx, nil); err != nil {
+		t.Fatalf("ReplaceVelocities without velocities: %v", err)
+	}
+	assertOrder(t, collect(t, 30, d.RisingWithCursor))
+}
+
+func testFeedSnapshots(t *testing.T, d db.DB) {
+	if _, _, err := d.LatestFeedSnapshot(ctx, "hot"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("LatestFeedSnapshot without snapshots = %v, want ErrNotFound", err)
+	}
+	indexedAt := time.Date(2024, 11, 20, 12, 0, 0, 0, time.UTC)
+	older := []db.FeedPost{{DID: author, Rkey: "a", Time: indexedAt, Score: 2}, {DID: author, Rkey: "b", Time: indexedAt, Score: 1}}
+	newer := []db.FeedPost{{DID: author, Rkey: "c", Time: indexedAt, Score: 3}, {DID: author, Rkey: "a", Time: indexedAt, Score: 2.5}}
+	for version, posts := range map[int64][]db.FeedPost{1: older, 2: newer} {
+		if err := d.SaveFeedSnapshot(ctx, "hot", version, posts); err != nil {
+			t.Fatalf("SaveFeedSnapshot(%d): %v", version, err)
+		}
+	}
+	// other feeds are kept apart
+	if err := d.SaveFeedSnapshot(ctx, "rising", 3, older); err != nil {
+		t.Fatalf("SaveFeedSnapshot: %v", err)
+	}
+
+	posts, err := d.FeedSnapshot(ctx, "hot", 1)
+	if err != nil {
+		t.Fatalf("FeedSnapshot: %v", err)
+	}
+	assertOrder(t, posts, "a", "b")
+	if !posts[0].Time.Equal(indexedAt) || posts[0].Score != 2 {
+		t.Errorf("FeedSnapshot returned %+v, want the saved post", posts[0])
+	}
+	version, posts, err := d.LatestFeedSnapshot(ctx, "hot")
+	if err != nil || version != 2 {
+		t.Fatalf("LatestFeedSnapshot = %d, %v, want version 2", version, err)
+	}
+	assertOrder(t, posts, "c", "a")
+
+	pruned, err := d.PruneFeedSnapshots(ctx, "hot", 2)
+	if err != nil || pruned != 2 {
+		t.Errorf("PruneFeedSnapshots = %d, %v, want 2", pruned, err)
+	}
+	if _, err := d.FeedSnapshot(ctx, "hot", 1); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("FeedSnapshot of a pruned version = %v, want ErrNotFound", err)
+	}
+	if _, err := d.FeedSnapshot(ctx, "rising", 3); err != nil {
+		t.Errorf("FeedSnapshot of another feed after pruning: %v", err)
+	}
+}
+
+func testPrune(t *testing.T, d db.DB) {
+	addPosts(t, d, "old", "protected")
+	engage(t, d.AddLike, "protected", 3)
+	engage(t, d.AddRepost, "protected", 1)
+
+	// nothing is old enough yet
+	if pruned, err := d.PruneLikes(ctx, time.Now().Add(-time.Hour), 10, nil); err != nil || pruned != 0 {
+		t.Fatalf("PruneLikes of recent likes = %d, %v, want nothing pruned", pruned, err)
+	}
+
+	var archived []json.RawMessage
+	archive := func(rows []json.RawMessage) error {
+		archived = append(archived, rows...)
+		return nil
+	}
+	// likes are pruned in batches
+	for _, want := range []int64{2, 1, 0} {
+		pruned, err := d.PruneLikes(ctx, time.Now().Add(time.Second), 2, archive)
+		if err != nil || pruned != want {
+			t.Fatalf("PruneLikes = %d, %v, want %d", pruned, err, want)
+		}
+	}
+	if len(archived) != 3 {
+		t.Fatalf("archived %d likes, want 3", len(archived))
+	}
+	var like map[string]any
+	if err := json.Unmarshal(archived[0], &like); err != nil || like["subject_rkey"] != "protected" {
+		t.Errorf("archived like = %s, %v", archived[0], err)
+	}
+	// counters of pruned likes are kept
+	assertScore(t, d, "protected", 3)
+
+	// a failing archive keeps the rows, so the repost still protects its post below
+	failing := func(rows []json.RawMessage) error { return errors.New("disk full") }
+	if _, err := d.PruneReposts(ctx, time.Now().Add(time.Second), 10, failing); err == nil {
+		t.Fatal("PruneReposts succeeded although archiving failed")
+	}
+
+	// posts engaged with since protectSince are kept
+	archived = nil
+	pruned, err := d.PrunePosts(ctx, time.Now().Add(time.Second), time.Now().Add(-time.Hour), 10, archive)
+	if err != nil || pruned != 1 {
+		t.Fatalf("PrunePosts = %d, %v, want 1", pruned, err)
+	}
+	if len(archived) != 1 {
+		t.Fatalf("archived %d posts, want 1", len(archived))
+	}
+	if _, err := d.GetPost(ctx, author, "old"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetPost of a pruned post = %v, want ErrNotFound", err)
+	}
+	assertOrder(t, collect(t, 10, mostRecent(d, db.TimeIndexed)), "protected")
+
+	// a zero protectSince protects nothing, and the post's engagement goes with it
+	if pruned, err := d.PrunePosts(ctx, time.Now().Add(time.Second), time.Time{}, 10, nil); err != nil || pruned != 1 {
+		t.Fatalf("PrunePosts without protection = %d, %v, want 1", pruned, err)
+	}
+	if pruned, err := d.PruneReposts(ctx, time.Now().Add(time.Second), 10, nil); err != nil || pruned != 0 {
+		t.Errorf("PruneReposts after pruning their post = %d, %v, want the reposts gone with the post", pruned, err)
+	}
+}
+
+func testClassifications(t *testing.T, d db.DB) {
+	now := time.Now()
+	entries := []db.ClassificationLog{
+		{PostURI: "at://a", ImageCID: "1", Label: "bird", Confidence: 0.5, Model: "clip", Role: db.ClassifierPrimary, CreatedAt: now},
+		{PostURI: "at://a", ImageCID: "2", Label: "bird", Confidence: 0.75, Model: "clip", Role: db.ClassifierPrimary, CreatedAt: now},
+		{PostURI: "at://a", ImageCID: "1", Label: "cat", Confidence: 0.25, Model: "next", Role: db.ClassifierCandidate, CreatedAt: now},
+		{PostURI: "at://b", ImageCID: "3", Label: "bird", Confidence: 0.5, Model: "clip", Role: db.ClassifierPrimary, CreatedAt: now.Add(-48 * time.Hour)},
+	}
+	for _, entry := range entries {
+		if err := d.LogClassification(ctx, entry); err != nil {
+			t.Fatalf("LogClassification: %v", err)
+		}
+	}
+
+	scores, err := d.ClassificationScores(ctx, "bird", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("ClassificationScores: %v", err)
+	}
+	if len(scores) != 1 || scores[0].PostURI != "at://a" {
+		t.Fatalf("ClassificationScores = %v, want only at://a", scores)
+	}
+	if scores[0].Primary == nil || *scores[0].Primary != 0.75 {
+		t.Errorf("primary score = %v, want 0.75", scores[0].Primary)
+	}
+	// the candidate classified the post, but not as a bird
+	if scores[0].Candidate == nil || *scores[0].Candidate != 0 {
+		t.Errorf("candidate score = %v, want 0", scores[0].Candidate)
+	}
+}
+
+func testReview(t *testing.T, d db.DB) {
+	post := newPost("borderline")
+	item := db.ReviewItem{
+		PostURI:    post.ATURI,
+		URI:        post.URI,
+		DID:        post.DID,
+		Rkey:       post.Rkey,
+		ImageCID:   "image-borderline",
+		Label:      "bird",
+		Confidence: 0.75,
+		Model:      "clip",
+		Post:       &post,
+	}
+	for _, queued := range []db.ReviewItem{item, item} {
+		if err := d.AddReviewItem(ctx, queued); err != nil {
+			t.Fatalf("AddReviewItem: %v", err)
+		}
+	}
+	rejected := item
+	rejected.PostURI, rejected.Rkey, rejected.ImageCID, rejected.Post = "at://rejected", "rejected", "image-rejected", nil
+	// the model falls back to the classifier URL, which may be long
+	rejected.Model = "https://classifier.example.com/" + strings.Repeat("model/", 40)
+	if err := d.AddReviewItem(ctx, rejected); err != nil {
+		t.Fatalf("AddReviewItem: %v", err)
+	}
+
+	pending, err := d.ReviewItems(ctx, db.ReviewPending, 10, 0)
+	if err != nil {
+		t.Fatalf("ReviewItems: %v", err)
+	}
+	if len(pending) != 2 || pending[0].PostURI != item.PostURI || pending[0].Post == nil {
+		t.Fatalf("pending items = %+v, want both items once, oldest first", pending)
+	}
+	if next, err := d.ReviewItems(ctx, db.ReviewPending, 10, pending[0].ID); err != nil || len(next) != 1 || next[0].ID != pending[1].ID {
+		t.Fatalf("ReviewItems after the first item = %+v, %v", next, err)
+	}
+
+	if decision, err := d.ImageDecision(ctx, item.ImageCID); err != nil || decision != "" {
+		t.Errorf("ImageDecision before review = %q, %v", decision, err)
+	}
+	approved, err := d.DecideReviewItem(ctx, pending[0].ID, db.ReviewApproved, "reviewer")
+	if err != nil {
+		t.Fatalf("DecideReviewItem: %v", err)
+	}
+	if approved.Status != db.ReviewApproved || approved.DecidedBy == nil || *approved.DecidedBy != "reviewer" || approved.DecidedAt == nil {
+		t.Errorf("approved item = %+v", approved)
+	}
+	if _, err := d.DecideReviewItem(ctx, pending[0].ID, db.ReviewRejected, "reviewer"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("deciding an item twice = %v, want ErrNotFound", err)
+	}
+	// reviewers are the self-reported basic auth username, which may be long
+	if _, err := d.DecideReviewItem(ctx, pending[1].ID, db.ReviewRejected, strings.Repeat("reviewer", 20)); err != nil {
+		t.Fatalf("DecideReviewItem: %v", err)
+	}
+	if decision, err := d.ImageDecision(ctx, item.ImageCID); err != nil || decision != db.ReviewApproved {
+		t.Errorf("ImageDecision = %q, %v, want approved", decision, err)
+	}
+
+	// approved posts are added with the reviewed label, rejected posts are not
+	added, err := d.GetPost(ctx, post.DID, post.Rkey)
+	if err != nil {
+		t.Fatalf("GetPost of the approved post: %v", err)
+	}
+	if added.Text != post.Text || added.Confidence != 1 || fmt.Sprint(added.Labels) != "[bird]" {
+		t.Errorf("approved post = %+v", added)
+	}
+	assertOrder(t, collect(t, 10, mostRecent(d, db.TimeIndexed)), "borderline")
+
+	if pending, err := d.ReviewItems(ctx, db.ReviewPending, 10, 0); err != nil || len(pending) != 0 {
+		t.Errorf("pending items after review = %+v, %v", pending, err)
+	}
+}
+
+func testReviewOfDeletedPost(t *testing.T, d db.DB) {
+	post := newPost("deleted")
+	if err := d.AddReviewItem(ctx, db.ReviewItem{
+		PostURI:    post.ATURI,
+		URI:        post.URI,
+		DID:        post.DID,
+		Rkey:       post.Rkey,
+		ImageCID:   "image-deleted",
+		Label:      "bird",
+		Confidence: 0.75,
+		Model:      "clip",
+		Post:       &post,
+	}); err != nil {
+		t.Fatalf("AddReviewItem: %v", err)
+	}
+	pending, err := d.ReviewItems(ctx, db.ReviewPending, 10, 0)
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("pending items = %+v, %v, want the item", pending, err)
+	}
+
+	// the author deletes the post while it waits for review
+	if err := d.DeletePost(ctx, post.DID, post.Rkey); err != nil {
+		t.Fatalf("DeletePost: %v", err)
+	}
+	if pending, err := d.ReviewItems(ctx, db.ReviewPending, 10, 0); err != nil || len(pending) != 0 {
+		t.Errorf("pending items after deleting the post = %+v, %v, want none", pending, err)
+	}
+	withdrawn, err := d.ReviewItems(ctx, db.ReviewWithdrawn, 10, 0)
+	if err != nil || len(withdrawn) != 1 || withdrawn[0].ID != pending[0].ID || withdrawn[0].DecidedBy != nil {
+		t.Errorf("withdrawn items = %+v, %v, want the item without a reviewer", withdrawn, err)
+	}
+
+	// approving the withdrawn item doesn't bring the deleted post back
+	if _, err := d.DecideReviewItem(ctx, pending[0].ID, db.ReviewApproved, "reviewer"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("approving a withdrawn item = %v, want ErrNotFound", err)
+	}
+	if _, err := d.GetPost(ctx, post.DID, post.Rkey); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetPost of the deleted post = %v, want ErrNotFound", err)
+	}
+	if decision, err := d.ImageDecision(ctx, "image-deleted"); err != nil || decision != "" {
+		t.Errorf("ImageDecision of a withdrawn item = %q, %v, want no decision", decision, err)
+	}
+}
+
+func testSettings(t *testing.T, d db.DB) {
+	if _, err := d.GetSetting(ctx, "ranking.hot"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetSetting of a missing setting = %v, want ErrNotFound", err)
+	}
+	for _, value := range []string{`{"like_weight": 1}`, `{"like_weight": 2}`} {
+		if err := d.PutSetting(ctx, "ranking.hot", []byte(value)); err != nil {
+			t.Fatalf("PutSetting: %v", err)
+		}
+	}
+	value, err := d.GetSetting(ctx, "ranking.hot")
+	if err != nil {
+		t.Fatalf("GetSetting: %v", err)
+	}
+	var decoded map[string]float64
+	if err := json.Unmarshal(value, &decoded); err != nil || decoded["like_weight"] != 2 {
+		t.Errorf("GetSetting = %s, %v, want the last value", value, err)
+	}
+}
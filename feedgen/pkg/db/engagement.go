@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+func (d *dbPostgres) AddLikes(ctx context.Context, likes []Engagement) (int64, error) {
+	return d.addEngagements(ctx, "post_like", "likes", likes)
+}
+
+func (d *dbPostgres) DeleteLikes(ctx context.Context, keys []RecordKey) (int64, error) {
+	return d.deleteEngagements(ctx, "post_like", "likes", keys)
+}
+
+func (d *dbPostgres) AddReposts(ctx context.Context, reposts []Engagement) (int64, error) {
+	return d.addEngagements(ctx, "post_repost", "reposts", reposts)
+}
+
+func (d *dbPostgres) DeleteReposts(ctx context.Context, keys []RecordKey) (int64, error) {
+	return d.deleteEngagements(ctx, "post_repost", "reposts", keys)
+}
+
+// addEngagements stores a batch of likes or reposts whose subjects are indexed posts
+// and increments the subjects' counters in a single statement. Records already stored
+// and further engagement of an account on the same post are skipped.
+func (d *dbPostgres) addEngagements(ctx context.Context, table, counter string, batch []Engagement) (int64, error) {
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	dids := make([]string, len(batch))
+	rkeys := make([]string, len(batch))
+	subjectDIDs := make([]string, len(batch))
+	subjectRkeys := make([]string, len(batch))
+	for i, e := range batch {
+		dids[i], rkeys[i], subjectDIDs[i], subjectRkeys[i] = e.DID, e.Rkey, e.SubjectDID, e.SubjectRkey
+	}
+
+	var added int64
+	err := d.db.QueryRow(ctx, `
+        WITH inserted AS (
+            INSERT INTO `+table+` (did, record, subject_did, subject_rkey, indexed_at)
+            SELECT DISTINCT ON (e.did, e.record) e.did, e.record, e.subject_did, e.subject_rkey, $5::timestamptz
+            FROM unnest($1::varchar[], $2::varchar[], $3::varchar[], $4::varchar[]) AS e(did, record, subject_did, subject_rkey)
+            WHERE EXISTS (SELECT 1 FROM post p WHERE p.did = e.subject_did AND p.record = e.subject_rkey)
+            ON CONFLICT DO NOTHING
+            RETURNING subject_did, subject_rkey
+        ), counts AS (
+            SELECT subject_did, subject_rkey, COUNT(*) AS n
+            FROM inserted
+            GROUP BY subject_did, subject_rkey
+        ), updated AS (
+            UPDATE post_stats s SET `+counter+` = s.`+counter+` + c.n
+            FROM counts c
+            WHERE s.did = c.subject_did AND s.record = c.subject_rkey
+        )
+        SELECT COALESCE(SUM(n), 0)::bigint FROM counts`,
+		dids, rkeys, subjectDIDs, subjectRkeys, time.Now()).Scan(&added)
+	return added, err
+}
+
+// deleteEngagements removes a batch of likes or reposts and decrements their subjects' counters in a single statement
+func (d *dbPostgres) deleteEngagements(ctx context.Context, table, counter string, keys []RecordKey) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	dids := make([]string, len(keys))
+	rkeys := make([]string, len(keys))
+	for i, k := range keys {
+		dids[i], rkeys[i] = k.DID, k.Rkey
+	}
+
+	var deleted int64
+	err := d.db.QueryRow(ctx, `
+        WITH removed AS (
+            DELETE FROM `+table+` e
+            USING unnest($1::varchar[], $2::varchar[]) AS k(did, record)
+            WHERE e.did = k.did AND e.record = k.record
+            RETURNING e.subject_did, e.subject_rkey
+        ), counts AS (
+            SELECT subject_did, subject_rkey, COUNT(*) AS n
+            FROM removed
+            GROUP BY subject_did, subject_rkey
+        ), updated AS (
+            UPDATE post_stats s SET `+counter+` = s.`+counter+` - c.n
+            FROM counts c
+            WHERE s.did = c.subject_did AND s.record = c.subject_rkey
+        )
+        SELECT COALESCE(SUM(n), 0)::bigint FROM counts`,
+		dids, rkeys).Scan(&deleted)
+	return deleted, err
+}
+
+// PostKeys returns the keys of every indexed post
+func (d *dbPostgres) PostKeys(ctx context.Context) ([]RecordKey, error) {
+	rows, err := d.db.Query(ctx, "SELECT did, record FROM post")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []RecordKey
+	for rows.Next() {
+		var key RecordKey
+		if err := rows.Scan(&key.DID, &key.Rkey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
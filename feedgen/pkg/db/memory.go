@@ -0,0 +1,843 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dbMemory keeps everything in memory, it is meant for unit tests and throwaway
+// local runs and mirrors the semantics of the SQL backends
+type dbMemory struct {
+	mu         sync.Mutex
+	posts      map[postKey]*Post
+	stats      map[postKey]*postStats
+	likes      map[postKey]*engagementRow
+	reposts    map[postKey]*engagementRow
+	references map[referenceKey]*engagementRow
+	velocities map[postKey]*velocityRow
+	snapshots  map[string]map[int64][]FeedPost
+
+	classifications []ClassificationLog
+	reviewItems     []*ReviewItem
+	decisions       []reviewDecision
+	settings        map[string][]byte
+}
+
+type postKey struct {
+	did  string
+	rkey string
+}
+
+type referenceKey struct {
+	postKey
+	kind string
+}
+
+type postStats struct {
+	likes, reposts, quotes, replies int64
+}
+
+type engagementRow struct {
+	subject   postKey
+	indexedAt time.Time
+}
+
+type velocityRow struct {
+	Velocity
+	updatedAt time.Time
+}
+
+type reviewDecision struct {
+	imageCID  string
+	decision  string
+	decidedAt time.Time
+}
+
+// NewMemoryDB returns an empty in-memory DB
+func NewMemoryDB() DB {
+	return &dbMemory{
+		posts:      map[postKey]*Post{},
+		stats:      map[postKey]*postStats{},
+		likes:      map[postKey]*engagementRow{},
+		reposts:    map[postKey]*engagementRow{},
+		references: map[referenceKey]*engagementRow{},
+		velocities: map[postKey]*velocityRow{},
+		snapshots:  map[string]map[int64][]FeedPost{},
+		settings:   map[string][]byte{},
+	}
+}
+
+// memoryNow returns the current time at the microsecond precision of the SQL backends,
+// so cursors taken from stored times compare equal to them
+func memoryNow() time.Time {
+	return time.Now().Truncate(time.Microsecond)
+}
+
+func (d *dbMemory) Ping(ctx context.Context) error {
+	return nil
+}
+
+// SchemaStatus reports an empty status, the in-memory DB has no schema to migrate
+func (d *dbMemory) SchemaStatus(ctx context.Context) (SchemaStatus, error) {
+	return SchemaStatus{}, nil
+}
+
+func (d *dbMemory) AddPost(ctx context.Context, post Post) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.insertPost(post, memoryNow())
+	return nil
+}
+
+func (d *dbMemory) insertPost(post Post, indexedAt time.Time) {
+	key := postKey{post.DID, post.Rkey}
+	if _, ok := d.posts[key]; ok {
+		return
+	}
+	for _, p := range d.posts {
+		if p.ATURI == post.ATURI {
+			return
+		}
+	}
+	post.CreatedAt = createdAt(post, indexedAt).Truncate(time.Microsecond)
+	post.IndexedAt = indexedAt
+	d.posts[key] = &post
+	d.stats[key] = &postStats{}
+}
+
+func (d *dbMemory) GetPost(ctx context.Context, did, rkey string) (*Post, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	post, ok := d.posts[postKey{did, rkey}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *post
+	return &copied, nil
+}
+
+func (d *dbMemory) DeletePost(ctx context.Context, did, rkey string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := postKey{did, rkey}
+	delete(d.posts, key)
+	delete(d.stats, key)
+	// the deleted post may have been a reply to or a quote of an indexed post
+	for kind, counter := range referenceCounters {
+		refKey := referenceKey{key, kind}
+		if ref, ok := d.references[refKey]; ok {
+			delete(d.references, refKey)
+			d.incrementStat(counter, ref.subject, -1)
+		}
+	}
+	// engagement on the deleted post and references to it are of no use without the post
+	delete(d.velocities, key)
+	d.deleteOrphans(func(subject postKey) bool { return subject == key }, math.MaxInt64)
+	// a deleted post waiting for review must not be added to the feed by approving it
+	for _, item := range d.reviewItems {
+		if item.Status == ReviewPending && item.DID == did && item.Rkey == rkey {
+			now := memoryNow()
+			item.Status = ReviewWithdrawn
+			item.DecidedAt = &now
+		}
+	}
+	return nil
+}
+
+// deleteOrphans deletes up to limit references and engagement whose subject matches, returning how many it deleted
+func (d *dbMemory) deleteOrphans(orphaned func(subject postKey) bool, limit int64) int64 {
+	var deleted int64
+	for refKey, row := range d.references {
+		if deleted < limit && orphaned(row.subject) {
+			delete(d.references, refKey)
+			deleted++
+		}
+	}
+	for _, table := range []map[postKey]*engagementRow{d.likes, d.reposts} {
+		for engagementKey, row := range table {
+			if deleted < limit && orphaned(row.subject) {
+				delete(table, engagementKey)
+				deleted++
+			}
+		}
+	}
+	return deleted
+}
+
+func (d *dbMemory) incrementStat(counter string, key postKey, delta int64) {
+	stats, ok := d.stats[key]
+	if !ok {
+		return
+	}
+	switch counter {
+	case "likes":
+		stats.likes += delta
+	case "reposts":
+		stats.reposts += delta
+	case "quotes":
+		stats.quotes += delta
+	case "replies":
+		stats.replies += delta
+	}
+}
+
+func (d *dbMemory) AddLike(ctx context.Context, like Engagement) (bool, error) {
+	return d.addEngagement(d.likes, "likes", like)
+}
+
+func (d *dbMemory) DeleteLike(ctx context.Context, did, rkey string) error {
+	return d.deleteEngagement(d.likes, "likes", did, rkey)
+}
+
+func (d *dbMemory) AddRepost(ctx context.Context, repost Engagement) (bool, error) {
+	return d.addEngagement(d.reposts, "reposts", repost)
+}
+
+func (d *dbMemory) DeleteRepost(ctx context.Context, did, rkey string) error {
+	return d.deleteEngagement(d.reposts, "reposts", did, rkey)
+}
+
+func (d *dbMemory) addEngagement(table map[postKey]*engagementRow, counter string, e Engagement) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	subject := postKey{e.SubjectDID, e.SubjectRkey}
+	if _, ok := d.posts[subject]; !ok {
+		return false, nil
+	}
+	key := postKey{e.DID, e.Rkey}
+	if engaged(table, key, subject) {
+		return true, nil
+	}
+	table[key] = &engagementRow{subject: subject, indexedAt: memoryNow()}
+	d.incrementStat(counter, subject, 1)
+	return true, nil
+}
+
+// engaged reports whether a record is stored, or its account already engaged with the subject,
+// like the primary key and the unique (did, subject) index of the SQL backends
+func engaged(table map[postKey]*engagementRow, key, subject postKey) bool {
+	if _, ok := table[key]; ok {
+		return true
+	}
+	for other, row := range table {
+		if other.did == key.did && row.subject == subject {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dbMemory) deleteEngagement(table map[postKey]*engagementRow, counter, did, rkey string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := postKey{did, rkey}
+	row, ok := table[key]
+	if !ok {
+		return nil
+	}
+	delete(table, key)
+	d.incrementStat(counter, row.subject, -1)
+	return nil
+}
+
+func (d *dbMemory) AddLikes(ctx context.Context, likes []Engagement) (int64, error) {
+	return d.addEngagements(d.likes, "likes", likes), nil
+}
+
+func (d *dbMemory) DeleteLikes(ctx context.Context, keys []RecordKey) (int64, error) {
+	return d.deleteEngagements(d.likes, "likes", keys), nil
+}
+
+func (d *dbMemory) AddReposts(ctx context.Context, reposts []Engagement) (int64, error) {
+	return d.addEngagements(d.reposts, "reposts", reposts), nil
+}
+
+func (d *dbMemory) DeleteReposts(ctx context.Context, keys []RecordKey) (int64, error) {
+	return d.deleteEngagements(d.reposts, "reposts", keys), nil
+}
+
+func (d *dbMemory) addEngagements(table map[postKey]*engagementRow, counter string, batch []Engagement) int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var added int64
+	now := memoryNow()
+	for _, e := range batch {
+		subject := postKey{e.SubjectDID, e.SubjectRkey}
+		key := postKey{e.DID, e.Rkey}
+		if _, ok := d.posts[subject]; !ok {
+			continue
+		}
+		if engaged(table, key, subject) {
+			continue
+		}
+		table[key] = &engagementRow{subject: subject, indexedAt: now}
+		d.incrementStat(counter, subject, 1)
+		added++
+	}
+	return added
+}
+
+func (d *dbMemory) deleteEngagements(table map[postKey]*engagementRow, counter string, keys []RecordKey) int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var deleted int64
+	for _, k := range keys {
+		key := postKey{k.DID, k.Rkey}
+		row, ok := table[key]
+		if !ok {
+			continue
+		}
+		delete(table, key)
+		d.incrementStat(counter, row.subject, -1)
+		deleted++
+	}
+	return deleted
+}
+
+func (d *dbMemory) PostKeys(ctx context.Context) ([]RecordKey, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	keys := make([]RecordKey, 0, len(d.posts))
+	for key := range d.posts {
+		keys = append(keys, RecordKey{DID: key.did, Rkey: key.rkey})
+	}
+	return keys, nil
+}
+
+func (d *dbMemory) AddReference(ctx context.Context, ref Reference) error {
+	counter, ok := referenceCounters[ref.Kind]
+	if !ok {
+		return fmt.Errorf("unknown reference kind: %s", ref.Kind)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	subject := postKey{ref.SubjectDID, ref.SubjectRkey}
+	if _, ok := d.posts[subject]; !ok {
+		return nil
+	}
+	key := referenceKey{postKey{ref.DID, ref.Rkey}, ref.Kind}
+	if _, ok := d.references[key]; ok {
+		return nil
+	}
+	d.references[key] = &engagementRow{subject: subject, indexedAt: memoryNow()}
+	d.incrementStat(counter, subject, 1)
+	return nil
+}
+
+func (d *dbMemory) ReconcilePostStats(ctx context.Context, since time.Time) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counted := map[postKey]*postStats{}
+	for key, post := range d.posts {
+		if !post.IndexedAt.Before(since) {
+			counted[key] = &postStats{}
+		}
+	}
+	for _, row := range d.likes {
+		if stats, ok := counted[row.subject]; ok {
+			stats.likes++
+		}
+	}
+	for _, row := range d.reposts {
+		if stats, ok := counted[row.subject]; ok {
+			stats.reposts++
+		}
+	}
+	for key, row := range d.references {
+		if stats, ok := counted[row.subject]; ok {
+			if key.kind == ReferenceReply {
+				stats.replies++
+			} else {
+				stats.quotes++
+			}
+		}
+	}
+
+	var repaired int64
+	for key, stats := range counted {
+		if current, ok := d.stats[key]; !ok || *current != *stats {
+			d.stats[key] = stats
+			repaired++
+		}
+	}
+	return repaired, nil
+}
+
+func (d *dbMemory) PrunePosts(ctx context.Context, before, protectSince time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	protected := map[postKey]bool{}
+	if !protectSince.IsZero() {
+		for _, table := range []map[postKey]*engagementRow{d.likes, d.reposts} {
+			for _, row := range table {
+				if !row.indexedAt.Before(protectSince) {
+					protected[row.subject] = true
+				}
+			}
+		}
+	}
+
+	var expired []*Post
+	for key, post := range d.posts {
+		if post.IndexedAt.Before(before) && !protected[key] {
+			expired = append(expired, post)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].IndexedAt.Before(expired[j].IndexedAt) })
+	expired = expired[:min(int64(len(expired)), limit)]
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	if archive != nil {
+		rows := make([]json.RawMessage, 0, len(expired))
+		for _, post := range expired {
+			row, err := json.Marshal(post)
+			if err != nil {
+				return 0, err
+			}
+			rows = append(rows, row)
+		}
+		if err := archive(rows); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, post := range expired {
+		key := postKey{post.DID, post.Rkey}
+		delete(d.posts, key)
+		delete(d.stats, key)
+		delete(d.velocities, key)
+		for refKey, row := range d.references {
+			if refKey.postKey == key || row.subject == key {
+				delete(d.references, refKey)
+			}
+		}
+		for _, table := range []map[postKey]*engagementRow{d.likes, d.reposts} {
+			for engagementKey, row := range table {
+				if row.subject == key {
+					delete(table, engagementKey)
+				}
+			}
+		}
+	}
+	return int64(len(expired)), nil
+}
+
+func (d *dbMemory) PruneOrphans(ctx context.Context, limit int64) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	notIndexed := func(key postKey) bool {
+		_, ok := d.posts[key]
+		return !ok
+	}
+	pruned := d.deleteOrphans(notIndexed, limit)
+	for key := range d.velocities {
+		if pruned < limit && notIndexed(key) {
+			delete(d.velocities, key)
+			pruned++
+		}
+	}
+	for key := range d.stats {
+		if pruned < limit && notIndexed(key) {
+			delete(d.stats, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+func (d *dbMemory) PruneLikes(ctx context.Context, before time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	return d.pruneEngagement(d.likes, before, limit, archive)
+}
+
+func (d *dbMemory) PruneReposts(ctx context.Context, before time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	return d.pruneEngagement(d.reposts, before, limit, archive)
+}
+
+func (d *dbMemory) pruneEngagement(table map[postKey]*engagementRow, before time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var expired []postKey
+	for key, row := range table {
+		if row.indexedAt.Before(before) {
+			expired = append(expired, key)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return table[expired[i]].indexedAt.Before(table[expired[j]].indexedAt) })
+	expired = expired[:min(int64(len(expired)), limit)]
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	if archive != nil {
+		rows := make([]json.RawMessage, 0, len(expired))
+		for _, key := range expired {
+			row := table[key]
+			encoded, err := json.Marshal(map[string]any{
+				"did":          key.did,
+				"record":       key.rkey,
+				"subject_did":  row.subject.did,
+				"subject_rkey": row.subject.rkey,
+				"indexed_at":   row.indexedAt,
+			})
+			if err != nil {
+				return 0, err
+			}
+			rows = append(rows, encoded)
+		}
+		if err := archive(rows); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, key := range expired {
+		delete(table, key)
+	}
+	return int64(len(expired)), nil
+}
+
+// page sorts candidates by descending sort key, then did and rkey, and returns up
+// to limit posts after the cursor. byTime sorts by Time instead of Score.
+func page(candidates []FeedPost, byTime bool, limit int64, cursor *Cursor) []FeedPost {
+	compare := func(a FeedPost, t time.Time, score float64, did, rkey string) int {
+		switch {
+		case byTime && !a.Time.Equal(t):
+			return a.Time.Compare(t)
+		case !byTime && a.Score != score:
+			if a.Score < score {
+				return -1
+			}
+			return 1
+		case a.DID != did:
+			if a.DID < did {
+				return -1
+			}
+			return 1
+		case a.Rkey < rkey:
+			return -1
+		case a.Rkey > rkey:
+			return 1
+		}
+		return 0
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		b := candidates[j]
+		return compare(candidates[i], b.Time, b.Score, b.DID, b.Rkey) > 0
+	})
+
+	var posts []FeedPost
+	for _, post := range candidates {
+		if int64(len(posts)) == limit {
+			break
+		}
+		if cursor != nil && compare(post, cursor.Time, cursor.Score, cursor.DID, cursor.Rkey) >= 0 {
+			continue
+		}
+		posts = append(posts, post)
+	}
+	return posts
+}
+
+func (d *dbMemory) MostRecentWithCursor(ctx context.Context, key TimeKey, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	if _, err := key.column(); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	candidates := make([]FeedPost, 0, len(d.posts))
+	for _, post := range d.posts {
+		t := post.IndexedAt
+		if key == TimeCreated {
+			t = post.CreatedAt
+		}
+		candidates = append(candidates, FeedPost{DID: post.DID, Rkey: post.Rkey, Time: t})
+	}
+	return page(candidates, true, limit, cursor), nil
+}
+
+func (d *dbMemory) MostPopularWithCursor(ctx context.Context, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	candidates := make([]FeedPost, 0, len(d.posts))
+	for key, post := range d.posts {
+		candidates = append(candidates, FeedPost{DID: post.DID, Rkey: post.Rkey, Time: post.IndexedAt, Score: float64(d.stats[key].likes)})
+	}
+	if cursor != nil {
+		// likes are compared as integers, like the SQL backends do
+		truncated := *cursor
+		truncated.Score = float64(int64(cursor.Score))
+		cursor = &truncated
+	}
+	return page(candidates, false, limit, cursor), nil
+}
+
+func (d *dbMemory) HotWithCursor(ctx context.Context, params HotParams, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	halfLife := params.HalfLifeHours * time.Hour.Seconds()
+	oldest := time.Now().Add(-time.Duration(params.MaxAgeHours * float64(time.Hour)))
+	var candidates []FeedPost
+	for key, post := range d.posts {
+		if post.IndexedAt.Before(oldest) {
+			continue
+		}
+		stats := d.stats[key]
+		score := math.Log2(params.LikeWeight*float64(stats.likes)+params.RepostWeight*float64(stats.reposts)+1) +
+			float64(post.IndexedAt.UnixMicro())/1e6/halfLife
+		if velocity, ok := d.velocities[key]; ok {
+			score += params.RisingWeight * velocity.Score
+		}
+		candidates = append(candidates, FeedPost{DID: post.DID, Rkey: post.Rkey, Time: post.IndexedAt, Score: score})
+	}
+	return page(candidates, false, limit, cursor), nil
+}
+
+func (d *dbMemory) TopSinceWithCursor(ctx context.Context, since time.Time, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counts := map[postKey]float64{}
+	for _, table := range []map[postKey]*engagementRow{d.likes, d.reposts} {
+		for _, row := range table {
+			if !row.indexedAt.Before(since) {
+				counts[row.subject]++
+			}
+		}
+	}
+	var candidates []FeedPost
+	for key, count := range counts {
+		post, ok := d.posts[key]
+		if !ok {
+			continue
+		}
+		candidates = append(candidates, FeedPost{DID: post.DID, Rkey: post.Rkey, Time: post.IndexedAt, Score: count})
+	}
+	return page(candidates, false, limit, cursor), nil
+}
+
+func (d *dbMemory) RisingWithCursor(ctx context.Context, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var candidates []FeedPost
+	for key, velocity := range d.velocities {
+		post, ok := d.posts[key]
+		if !ok || velocity.Score <= 0 {
+			continue
+		}
+		candidates = append(candidates, FeedPost{DID: post.DID, Rkey: post.Rkey, Time: post.IndexedAt, Score: velocity.Score})
+	}
+	return page(candidates, false, limit, cursor), nil
+}
+
+func (d *dbMemory) ReplaceVelocities(ctx context.Context, velocities []Velocity) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := memoryNow()
+	d.velocities = make(map[postKey]*velocityRow, len(velocities))
+	for _, v := range velocities {
+		d.velocities[postKey{v.DID, v.Rkey}] = &velocityRow{Velocity: v, updatedAt: now}
+	}
+	return nil
+}
+
+func (d *dbMemory) SaveFeedSnapshot(ctx context.Context, feed string, version int64, posts []FeedPost) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// like the SQL backends, empty snapshots aren't stored and saving a version twice keeps the first
+	if len(posts) == 0 {
+		return nil
+	}
+	versions, ok := d.snapshots[feed]
+	if !ok {
+		versions = map[int64][]FeedPost{}
+		d.snapshots[feed] = versions
+	}
+	if _, ok := versions[version]; !ok {
+		versions[version] = append([]FeedPost(nil), posts...)
+	}
+	return nil
+}
+
+func (d *dbMemory) FeedSnapshot(ctx context.Context, feed string, version int64) ([]FeedPost, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	posts, ok := d.snapshots[feed][version]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]FeedPost(nil), posts...), nil
+}
+
+func (d *dbMemory) LatestFeedSnapshot(ctx context.Context, feed string) (int64, []FeedPost, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var latest int64
+	var posts []FeedPost
+	for version, snapshot := range d.snapshots[feed] {
+		if posts == nil || version > latest {
+			latest, posts = version, snapshot
+		}
+	}
+	if posts == nil {
+		return 0, nil, ErrNotFound
+	}
+	return latest, append([]FeedPost(nil), posts...), nil
+}
+
+func (d *dbMemory) PruneFeedSnapshots(ctx context.Context, feed string, before int64) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var pruned int64
+	for version, posts := range d.snapshots[feed] {
+		if version < before {
+			pruned += int64(len(posts))
+			delete(d.snapshots[feed], version)
+		}
+	}
+	return pruned, nil
+}
+
+func (d *dbMemory) LogClassification(ctx context.Context, entry ClassificationLog) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.classifications = append(d.classifications, entry)
+	return nil
+}
+
+func (d *dbMemory) ClassificationScores(ctx context.Context, label string, since time.Time) ([]ClassificationScore, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	byPost := map[string]*ClassificationScore{}
+	var order []string
+	for _, entry := range d.classifications {
+		if entry.CreatedAt.Before(since) {
+			continue
+		}
+		score, ok := byPost[entry.PostURI]
+		if !ok {
+			score = &ClassificationScore{PostURI: entry.PostURI}
+			byPost[entry.PostURI] = score
+			order = append(order, entry.PostURI)
+		}
+		confidence := 0.0
+		if entry.Label == label {
+			confidence = entry.Confidence
+		}
+		var target **float64
+		switch entry.Role {
+		case ClassifierPrimary:
+			target = &score.Primary
+		case ClassifierCandidate:
+			target = &score.Candidate
+		default:
+			continue
+		}
+		if *target == nil || **target < confidence {
+			*target = &confidence
+		}
+	}
+
+	var scores []ClassificationScore
+	for _, uri := range order {
+		scores = append(scores, *byPost[uri])
+	}
+	return scores, nil
+}
+
+func (d *dbMemory) AddReviewItem(ctx context.Context, item ReviewItem) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, existing := range d.reviewItems {
+		if existing.PostURI == item.PostURI {
+			return nil
+		}
+	}
+	item.ID = int64(len(d.reviewItems)) + 1
+	item.Status = ReviewPending
+	item.CreatedAt = memoryNow()
+	item.DecidedAt, item.DecidedBy = nil, nil
+	d.reviewItems = append(d.reviewItems, &item)
+	return nil
+}
+
+func (d *dbMemory) ReviewItems(ctx context.Context, status string, limit int64, cursor int64) ([]ReviewItem, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var items []ReviewItem
+	for _, item := range d.reviewItems {
+		if int64(len(items)) == limit {
+			break
+		}
+		if item.Status == status && item.ID > cursor {
+			items = append(items, *item)
+		}
+	}
+	return items, nil
+}
+
+func (d *dbMemory) DecideReviewItem(ctx context.Context, id int64, decision, reviewer string) (*ReviewItem, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if id < 1 || id > int64(len(d.reviewItems)) || d.reviewItems[id-1].Status != ReviewPending {
+		return nil, ErrNotFound
+	}
+	item := d.reviewItems[id-1]
+	now := memoryNow()
+	item.Status = decision
+	item.DecidedAt = &now
+	item.DecidedBy = &reviewer
+	d.decisions = append(d.decisions, reviewDecision{imageCID: item.ImageCID, decision: decision, decidedAt: now})
+
+	if decision == ReviewApproved {
+		post := Post{
+			DID:   item.DID,
+			Rkey:  item.Rkey,
+			URI:   item.URI,
+			ATURI: item.PostURI,
+		}
+		if item.Post != nil {
+			post = *item.Post
+		}
+		// the reviewer's decision replaces the classifier result
+		post.Labels = []string{item.Label}
+		post.Confidence = 1
+		d.insertPost(post, now)
+	}
+
+	decided := *item
+	return &decided, nil
+}
+
+func (d *dbMemory) ImageDecision(ctx context.Context, imageCID string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := len(d.decisions) - 1; i >= 0; i-- {
+		if d.decisions[i].imageCID == imageCID {
+			return d.decisions[i].decision, nil
+		}
+	}
+	return "", nil
+}
+
+func (d *dbMemory) GetSetting(ctx context.Context, key string) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	value, ok := d.settings[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (d *dbMemory) PutSetting(ctx context.Context, key string, value []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.settings[key] = append([]byte(nil), value...)
+	return nil
+}
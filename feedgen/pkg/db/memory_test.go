@@ -0,0 +1,14 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db/dbtest"
+)
+
+func TestMemory(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) db.DB {
+		return db.NewMemoryDB()
+	})
+}
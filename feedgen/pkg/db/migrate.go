@@ -0,0 +1,220 @@
+package db
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	sqlitemigrate "github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrations embed.FS
+
+// ErrNoSchema is returned when migrating a database that has no schema, such as the in-memory DB
+var ErrNoSchema = errors.New("database has no schema to migrate")
+
+// DatabaseURL returns the URL of the configured database, DATABASE_URL or else POSTGRES_URL
+func DatabaseURL() (string, error) {
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		url = os.Getenv("POSTGRES_URL")
+	}
+	if url == "" {
+		return "", fmt.Errorf("DATABASE_URL not set")
+	}
+	return url, nil
+}
+
+// SchemaStatus is the migration version of a database and the newest version embedded in the binary
+type SchemaStatus struct {
+	Version uint `json:"version"`
+	Latest  uint `json:"latest"`
+	// Dirty is set when a migration failed halfway and has to be fixed and forced
+	Dirty bool `json:"dirty"`
+}
+
+// Current reports whether every embedded migration has been applied
+func (s SchemaStatus) Current() bool {
+	return !s.Dirty && s.Version >= s.Latest
+}
+
+func (s SchemaStatus) String() string {
+	status := fmt.Sprintf("version %d of %d", s.Version, s.Latest)
+	if s.Dirty {
+		status += " (dirty)"
+	}
+	return status
+}
+
+// Migrator applies the migrations embedded in the binary. On Postgres every
+// operation holds an advisory lock, so replicas migrating at the same time don't race.
+type Migrator struct {
+	m      *migrate.Migrate
+	latest uint
+}
+
+// NewMigrator returns a Migrator for the database at url
+func NewMigrator(url string) (*Migrator, error) {
+	scheme, _, _ := strings.Cut(url, "://")
+	switch scheme {
+	case "postgres", "postgresql":
+		return newMigrator(postgresMigrations, "migrations/postgres", func(sourceName string, src source.Driver) (*migrate.Migrate, error) {
+			return migrate.NewWithSourceInstance(sourceName, src, url)
+		})
+	case "sqlite":
+		db, err := openSQLite(url)
+		if err != nil {
+			return nil, err
+		}
+		m, err := newSQLiteMigrator(db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return m, nil
+	case "memory":
+		return nil, ErrNoSchema
+	default:
+		return nil, fmt.Errorf("unsupported database URL scheme: %q", scheme)
+	}
+}
+
+func newSQLiteMigrator(db *sql.DB) (*Migrator, error) {
+	return newMigrator(sqliteMigrations, "migrations/sqlite", func(sourceName string, src source.Driver) (*migrate.Migrate, error) {
+		driver, err := sqlitemigrate.WithInstance(db, &sqlitemigrate.Config{})
+		if err != nil {
+			return nil, err
+		}
+		return migrate.NewWithInstance(sourceName, src, "sqlite", driver)
+	})
+}
+
+func newMigrator(migrations fs.FS, dir string, open func(sourceName string, src source.Driver) (*migrate.Migrate, error)) (*Migrator, error) {
+	src, err := iofs.New(migrations, dir)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := latestVersion(src)
+	if err != nil {
+		return nil, err
+	}
+	m, err := open("iofs", src)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{m: m, latest: latest}, nil
+}
+
+// latestMigration returns the version of the last migration embedded for a backend
+func latestMigration(migrations fs.FS, dir string) (uint, error) {
+	src, err := iofs.New(migrations, dir)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	return latestVersion(src)
+}
+
+// latestVersion returns the version of the last migration of a source
+func latestVersion(src source.Driver) (uint, error) {
+	version, err := src.First()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		next, err := src.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version = next
+	}
+}
+
+// Up applies every pending migration
+func (m *Migrator) Up() error {
+	if err := m.m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+	return nil
+}
+
+// Down reverts the given number of migrations
+func (m *Migrator) Down(steps int) error {
+	if steps <= 0 {
+		return fmt.Errorf("steps must be positive")
+	}
+	if err := m.m.Steps(-steps); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+	return nil
+}
+
+// Force sets the schema version without running migrations and clears the dirty flag,
+// after a failed migration has been fixed by hand
+func (m *Migrator) Force(version int) error {
+	return m.m.Force(version)
+}
+
+// Status returns the schema version of the database
+func (m *Migrator) Status() (SchemaStatus, error) {
+	version, dirty, err := m.m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return SchemaStatus{Latest: m.latest}, nil
+	}
+	if err != nil {
+		return SchemaStatus{}, err
+	}
+	return SchemaStatus{Version: version, Latest: m.latest, Dirty: dirty}, nil
+}
+
+// Close releases the migrator's database connection
+func (m *Migrator) Close() error {
+	sourceErr, dbErr := m.m.Close()
+	return errors.Join(sourceErr, dbErr)
+}
+
+// EnsureSchema checks that every embedded migration has been applied to the configured
+// database, applying pending migrations first if autoMigrate is set
+func EnsureSchema(autoMigrate bool) (SchemaStatus, error) {
+	url, err := DatabaseURL()
+	if err != nil {
+		return SchemaStatus{}, err
+	}
+	m, err := NewMigrator(url)
+	if errors.Is(err, ErrNoSchema) {
+		return SchemaStatus{}, nil
+	}
+	if err != nil {
+		return SchemaStatus{}, err
+	}
+	defer m.Close()
+
+	if autoMigrate {
+		if err := m.Up(); err != nil {
+			return SchemaStatus{}, fmt.Errorf("failed to migrate: %w", err)
+		}
+	}
+	status, err := m.Status()
+	if err != nil {
+		return SchemaStatus{}, err
+	}
+	if !status.Current() {
+		return status, fmt.Errorf("database schema is at %s, run `feedgen migrate up` or set AUTO_MIGRATE=true", status)
+	}
+	return status, nil
+}
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS classification_log(
+    id bigserial primary key,
+    post_uri varchar(128) not null,
+    image_cid varchar(128) not null,
+    label varchar(32) not null,
+    confidence double precision not null,
+    model varchar(128) not null,
+    role varchar(16) not null,
+    created_at timestamptz not null
+);
+
+CREATE INDEX IF NOT EXISTS classification_log_created_at_idx ON classification_log (created_at);
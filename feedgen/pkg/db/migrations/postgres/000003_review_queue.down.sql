@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS review_decision;
+DROP TABLE IF EXISTS review_queue;
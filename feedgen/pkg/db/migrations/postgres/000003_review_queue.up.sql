@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS review_queue(
+    id bigserial primary key,
+    post_uri varchar(128) unique not null,
+    uri varchar(76) not null,
+    record varchar(59) not null,
+    did varchar(32) not null,
+    image_cid varchar(128) not null,
+    label varchar(32) not null,
+    confidence double precision not null,
+    model varchar(128) not null,
+    status varchar(16) not null,
+    created_at timestamptz not null,
+    decided_at timestamptz,
+    decided_by varchar(64)
+);
+
+CREATE INDEX IF NOT EXISTS review_queue_status_idx ON review_queue (status, id);
+
+CREATE TABLE IF NOT EXISTS review_decision(
+    id bigserial primary key,
+    review_id bigint not null references review_queue (id) on delete cascade,
+    image_cid varchar(128) not null,
+    label varchar(32) not null,
+    confidence double precision not null,
+    model varchar(128) not null,
+    decision varchar(16) not null,
+    decided_by varchar(64) not null,
+    decided_at timestamptz not null
+);
+
+CREATE INDEX IF NOT EXISTS review_decision_image_cid_idx ON review_decision (image_cid, decided_at);
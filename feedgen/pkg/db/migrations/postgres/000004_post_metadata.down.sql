@@ -0,0 +1,15 @@
+ALTER TABLE review_queue DROP COLUMN IF EXISTS post;
+
+ALTER TABLE post
+    DROP COLUMN IF EXISTS at_uri,
+    DROP COLUMN IF EXISTS cid,
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS text,
+    DROP COLUMN IF EXISTS langs,
+    DROP COLUMN IF EXISTS image_cids,
+    DROP COLUMN IF EXISTS alt_texts,
+    DROP COLUMN IF EXISTS labels,
+    DROP COLUMN IF EXISTS confidence,
+    DROP COLUMN IF EXISTS is_reply,
+    DROP COLUMN IF EXISTS is_quote,
+    DROP COLUMN IF EXISTS self_labels;
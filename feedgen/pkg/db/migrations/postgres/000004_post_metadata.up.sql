@@ -0,0 +1,20 @@
+ALTER TABLE post
+    ADD COLUMN IF NOT EXISTS at_uri varchar(128),
+    ADD COLUMN IF NOT EXISTS cid varchar(128),
+    ADD COLUMN IF NOT EXISTS created_at timestamptz,
+    ADD COLUMN IF NOT EXISTS text text,
+    ADD COLUMN IF NOT EXISTS langs text[],
+    ADD COLUMN IF NOT EXISTS image_cids text[],
+    ADD COLUMN IF NOT EXISTS alt_texts text[],
+    ADD COLUMN IF NOT EXISTS labels text[],
+    ADD COLUMN IF NOT EXISTS confidence double precision,
+    ADD COLUMN IF NOT EXISTS is_reply boolean not null default false,
+    ADD COLUMN IF NOT EXISTS is_quote boolean not null default false,
+    ADD COLUMN IF NOT EXISTS self_labels text[];
+
+UPDATE post SET at_uri = 'at://' || did || '/app.bsky.feed.post/' || record WHERE at_uri IS NULL;
+
+ALTER TABLE post ALTER COLUMN at_uri SET NOT NULL;
+
+-- posts waiting for review keep their metadata so approving them stores the full post
+ALTER TABLE review_queue ADD COLUMN IF NOT EXISTS post jsonb;
@@ -0,0 +1,19 @@
+-- rows that collide on record alone can't be represented in the old schema and are dropped
+DELETE FROM post_repost a USING post_repost b WHERE a.record = b.record AND a.did > b.did;
+DROP INDEX IF EXISTS post_repost_subject_idx;
+ALTER TABLE post_repost DROP CONSTRAINT IF EXISTS post_repost_pkey;
+ALTER TABLE post_repost ADD PRIMARY KEY (record);
+ALTER TABLE post_repost RENAME COLUMN subject_rkey TO post_rkey;
+ALTER TABLE post_repost DROP COLUMN IF EXISTS subject_did;
+
+DELETE FROM post_like a USING post_like b WHERE a.record = b.record AND a.did > b.did;
+DROP INDEX IF EXISTS post_like_subject_idx;
+ALTER TABLE post_like DROP CONSTRAINT IF EXISTS post_like_pkey;
+ALTER TABLE post_like ADD PRIMARY KEY (record);
+ALTER TABLE post_like RENAME COLUMN subject_rkey TO post_rkey;
+ALTER TABLE post_like DROP COLUMN IF EXISTS subject_did;
+
+DELETE FROM post a USING post b WHERE a.record = b.record AND a.did > b.did;
+DROP INDEX IF EXISTS post_at_uri_idx;
+ALTER TABLE post DROP CONSTRAINT IF EXISTS post_pkey;
+ALTER TABLE post ADD PRIMARY KEY (record);
@@ -0,0 +1,41 @@
+-- did:web identifiers don't fit in 32 characters
+ALTER TABLE post ALTER COLUMN did TYPE varchar(2048);
+ALTER TABLE post ALTER COLUMN uri TYPE varchar(2200);
+ALTER TABLE post ALTER COLUMN at_uri TYPE varchar(2200);
+ALTER TABLE post_like ALTER COLUMN did TYPE varchar(2048);
+ALTER TABLE post_repost ALTER COLUMN did TYPE varchar(2048);
+ALTER TABLE review_queue ALTER COLUMN did TYPE varchar(2048);
+ALTER TABLE review_queue ALTER COLUMN uri TYPE varchar(2200);
+ALTER TABLE review_queue ALTER COLUMN post_uri TYPE varchar(2200);
+ALTER TABLE classification_log ALTER COLUMN post_uri TYPE varchar(2200);
+
+-- record keys are only unique per account, so posts, likes and reposts are keyed by (did, record)
+ALTER TABLE post DROP CONSTRAINT IF EXISTS post_pkey;
+ALTER TABLE post ADD PRIMARY KEY (did, record);
+CREATE UNIQUE INDEX IF NOT EXISTS post_at_uri_idx ON post (at_uri);
+
+-- engagement subjects were stored as a bare rkey, resolve the subject's did from the
+-- indexed posts and drop rows that can't be attributed to exactly one post
+ALTER TABLE post_like ADD COLUMN IF NOT EXISTS subject_did varchar(2048);
+UPDATE post_like pl SET subject_did = p.did
+FROM post p
+WHERE p.record = pl.post_rkey
+  AND (SELECT COUNT(*) FROM post p2 WHERE p2.record = pl.post_rkey) = 1;
+DELETE FROM post_like WHERE subject_did IS NULL;
+ALTER TABLE post_like ALTER COLUMN subject_did SET NOT NULL;
+ALTER TABLE post_like RENAME COLUMN post_rkey TO subject_rkey;
+ALTER TABLE post_like DROP CONSTRAINT IF EXISTS post_like_pkey;
+ALTER TABLE post_like ADD PRIMARY KEY (did, record);
+CREATE INDEX IF NOT EXISTS post_like_subject_idx ON post_like (subject_did, subject_rkey);
+
+ALTER TABLE post_repost ADD COLUMN IF NOT EXISTS subject_did varchar(2048);
+UPDATE post_repost pr SET subject_did = p.did
+FROM post p
+WHERE p.record = pr.post_rkey
+  AND (SELECT COUNT(*) FROM post p2 WHERE p2.record = pr.post_rkey) = 1;
+DELETE FROM post_repost WHERE subject_did IS NULL;
+ALTER TABLE post_repost ALTER COLUMN subject_did SET NOT NULL;
+ALTER TABLE post_repost RENAME COLUMN post_rkey TO subject_rkey;
+ALTER TABLE post_repost DROP CONSTRAINT IF EXISTS post_repost_pkey;
+ALTER TABLE post_repost ADD PRIMARY KEY (did, record);
+CREATE INDEX IF NOT EXISTS post_repost_subject_idx ON post_repost (subject_did, subject_rkey);
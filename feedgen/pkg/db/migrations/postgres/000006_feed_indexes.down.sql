@@ -0,0 +1 @@
+DROP INDEX IF EXISTS post_indexed_at_idx;
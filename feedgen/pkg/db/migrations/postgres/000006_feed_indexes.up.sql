@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS post_indexed_at_idx ON post (indexed_at DESC, did DESC, record DESC);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS post_reference;
+DROP TABLE IF EXISTS post_stats;
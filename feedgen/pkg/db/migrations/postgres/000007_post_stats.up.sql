@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS post_stats(
+    did varchar(2048) not null,
+    record varchar(59) not null,
+    likes bigint not null default 0,
+    reposts bigint not null default 0,
+    quotes bigint not null default 0,
+    replies bigint not null default 0,
+    primary key (did, record)
+);
+
+CREATE INDEX IF NOT EXISTS post_stats_likes_idx ON post_stats (likes DESC, did DESC, record DESC);
+
+-- replies and quotes of indexed posts, kept so the counters can be decremented when they are deleted
+CREATE TABLE IF NOT EXISTS post_reference(
+    did varchar(2048) not null,
+    record varchar(59) not null,
+    kind varchar(8) not null,
+    subject_did varchar(2048) not null,
+    subject_rkey varchar(59) not null,
+    indexed_at timestamptz not null,
+    primary key (did, record, kind)
+);
+
+CREATE INDEX IF NOT EXISTS post_reference_subject_idx ON post_reference (subject_did, subject_rkey);
+
+INSERT INTO post_stats (did, record, likes, reposts)
+SELECT p.did, p.record,
+    (SELECT COUNT(*) FROM post_like l WHERE l.subject_did = p.did AND l.subject_rkey = p.record),
+    (SELECT COUNT(*) FROM post_repost r WHERE r.subject_did = p.did AND r.subject_rkey = p.record)
+FROM post p
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,6 @@
+-- runtime settings that can be changed without redeploying, e.g. ranking parameters
+CREATE TABLE IF NOT EXISTS setting(
+    key varchar(128) primary key not null,
+    value jsonb not null,
+    updated_at timestamptz not null
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS post_repost_indexed_at_idx;
+DROP INDEX IF EXISTS post_like_indexed_at_idx;
@@ -0,0 +1,3 @@
+-- windowed rankings only read engagement within the window, covering indexes keep them index-only scans
+CREATE INDEX IF NOT EXISTS post_like_indexed_at_idx ON post_like (indexed_at) INCLUDE (subject_did, subject_rkey);
+CREATE INDEX IF NOT EXISTS post_repost_indexed_at_idx ON post_repost (indexed_at) INCLUDE (subject_did, subject_rkey);
@@ -0,0 +1,12 @@
+-- engagement velocity computed in memory by the subscriber and flushed periodically
+CREATE TABLE IF NOT EXISTS post_velocity(
+    did varchar(2048) not null,
+    record varchar(59) not null,
+    recent_rate double precision not null,
+    baseline_rate double precision not null,
+    score double precision not null,
+    updated_at timestamptz not null,
+    primary key (did, record)
+);
+
+CREATE INDEX IF NOT EXISTS post_velocity_score_idx ON post_velocity (score DESC, did DESC, record DESC);
@@ -0,0 +1,11 @@
+-- ranked feeds precomputed by the snapshot job, one row per position of every snapshot version
+CREATE TABLE IF NOT EXISTS feed_snapshot(
+    feed varchar(64) not null,
+    version bigint not null,
+    position integer not null,
+    did varchar(2048) not null,
+    record varchar(59) not null,
+    indexed_at timestamptz not null,
+    score double precision not null,
+    primary key (feed, version, position)
+);
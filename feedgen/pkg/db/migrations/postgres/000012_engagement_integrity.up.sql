@@ -0,0 +1,24 @@
+-- an account counts once per post, keep the first like or repost of duplicates
+DELETE FROM post_like l USING post_like d
+WHERE l.did = d.did AND l.subject_did = d.subject_did AND l.subject_rkey = d.subject_rkey
+    AND (l.indexed_at, l.record) > (d.indexed_at, d.record);
+DELETE FROM post_repost r USING post_repost d
+WHERE r.did = d.did AND r.subject_did = d.subject_did AND r.subject_rkey = d.subject_rkey
+    AND (r.indexed_at, r.record) > (d.indexed_at, d.record);
+
+CREATE UNIQUE INDEX IF NOT EXISTS post_like_account_subject_idx ON post_like (did, subject_did, subject_rkey);
+CREATE UNIQUE INDEX IF NOT EXISTS post_repost_account_subject_idx ON post_repost (did, subject_did, subject_rkey);
+
+-- rows left behind by deleted posts
+DELETE FROM post_like l WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = l.subject_did AND p.record = l.subject_rkey);
+DELETE FROM post_repost r WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = r.subject_did AND p.record = r.subject_rkey);
+DELETE FROM post_reference r WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = r.subject_did AND p.record = r.subject_rkey);
+DELETE FROM post_stats s WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = s.did AND p.record = s.record);
+DELETE FROM post_velocity v WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = v.did AND p.record = v.record);
+
+-- recount the likes and reposts of posts that had duplicates
+UPDATE post_stats s SET
+    likes = (SELECT COUNT(*) FROM post_like l WHERE l.subject_did = s.did AND l.subject_rkey = s.record),
+    reposts = (SELECT COUNT(*) FROM post_repost r WHERE r.subject_did = s.did AND r.subject_rkey = s.record)
+WHERE s.likes <> (SELECT COUNT(*) FROM post_like l WHERE l.subject_did = s.did AND l.subject_rkey = s.record)
+    OR s.reposts <> (SELECT COUNT(*) FROM post_repost r WHERE r.subject_did = s.did AND r.subject_rkey = s.record);
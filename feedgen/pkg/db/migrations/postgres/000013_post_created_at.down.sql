@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS post_created_at_idx;
+ALTER TABLE post ALTER COLUMN created_at DROP NOT NULL;
@@ -0,0 +1,6 @@
+-- posts are stored with a createdAt no later than when they were indexed, fill in posts
+-- from before that so feeds can be ordered by it
+UPDATE post SET created_at = indexed_at WHERE created_at IS NULL OR created_at > indexed_at;
+ALTER TABLE post ALTER COLUMN created_at SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS post_created_at_idx ON post (created_at DESC, did DESC, record DESC);
@@ -0,0 +1,5 @@
+ALTER TABLE review_decision ALTER COLUMN decided_by TYPE varchar(64) USING left(decided_by, 64);
+ALTER TABLE review_decision ALTER COLUMN model TYPE varchar(128) USING left(model, 128);
+ALTER TABLE review_queue ALTER COLUMN decided_by TYPE varchar(64) USING left(decided_by, 64);
+ALTER TABLE review_queue ALTER COLUMN model TYPE varchar(128) USING left(model, 128);
+ALTER TABLE classification_log ALTER COLUMN model TYPE varchar(128) USING left(model, 128);
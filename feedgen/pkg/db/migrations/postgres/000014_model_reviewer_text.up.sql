@@ -0,0 +1,7 @@
+-- model ids fall back to the classifier URL and reviewers are the self-reported basic auth
+-- username, neither has a length limit
+ALTER TABLE classification_log ALTER COLUMN model TYPE text;
+ALTER TABLE review_queue ALTER COLUMN model TYPE text;
+ALTER TABLE review_queue ALTER COLUMN decided_by TYPE text;
+ALTER TABLE review_decision ALTER COLUMN model TYPE text;
+ALTER TABLE review_decision ALTER COLUMN decided_by TYPE text;
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS setting;
+DROP TABLE IF EXISTS review_decision;
+DROP TABLE IF EXISTS review_queue;
+DROP TABLE IF EXISTS classification_log;
+DROP TABLE IF EXISTS post_velocity;
+DROP TABLE IF EXISTS post_reference;
+DROP TABLE IF EXISTS post_stats;
+DROP TABLE IF EXISTS post_repost;
+DROP TABLE IF EXISTS post_like;
+DROP TABLE IF EXISTS post;
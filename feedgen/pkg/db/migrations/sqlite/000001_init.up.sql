@@ -0,0 +1,136 @@
+-- the SQLite schema mirrors the Postgres schema, times are stored as unix microseconds
+-- and arrays as JSON text
+CREATE TABLE IF NOT EXISTS post(
+    did text not null,
+    record text not null,
+    uri text not null,
+    at_uri text not null,
+    cid text,
+    created_at integer,
+    text text,
+    langs text,
+    image_cids text,
+    alt_texts text,
+    labels text,
+    confidence real,
+    is_reply integer not null default 0,
+    is_quote integer not null default 0,
+    self_labels text,
+    indexed_at integer not null,
+    primary key (did, record)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS post_at_uri_idx ON post (at_uri);
+CREATE INDEX IF NOT EXISTS post_indexed_at_idx ON post (indexed_at DESC, did DESC, record DESC);
+
+CREATE TABLE IF NOT EXISTS post_like(
+    did text not null,
+    record text not null,
+    subject_did text not null,
+    subject_rkey text not null,
+    indexed_at integer not null,
+    primary key (did, record)
+);
+
+CREATE INDEX IF NOT EXISTS post_like_subject_idx ON post_like (subject_did, subject_rkey);
+CREATE INDEX IF NOT EXISTS post_like_indexed_at_idx ON post_like (indexed_at, subject_did, subject_rkey);
+
+CREATE TABLE IF NOT EXISTS post_repost(
+    did text not null,
+    record text not null,
+    subject_did text not null,
+    subject_rkey text not null,
+    indexed_at integer not null,
+    primary key (did, record)
+);
+
+CREATE INDEX IF NOT EXISTS post_repost_subject_idx ON post_repost (subject_did, subject_rkey);
+CREATE INDEX IF NOT EXISTS post_repost_indexed_at_idx ON post_repost (indexed_at, subject_did, subject_rkey);
+
+CREATE TABLE IF NOT EXISTS post_stats(
+    did text not null,
+    record text not null,
+    likes integer not null default 0,
+    reposts integer not null default 0,
+    quotes integer not null default 0,
+    replies integer not null default 0,
+    primary key (did, record)
+);
+
+CREATE INDEX IF NOT EXISTS post_stats_likes_idx ON post_stats (likes DESC, did DESC, record DESC);
+
+CREATE TABLE IF NOT EXISTS post_reference(
+    did text not null,
+    record text not null,
+    kind text not null,
+    subject_did text not null,
+    subject_rkey text not null,
+    indexed_at integer not null,
+    primary key (did, record, kind)
+);
+
+CREATE INDEX IF NOT EXISTS post_reference_subject_idx ON post_reference (subject_did, subject_rkey);
+
+CREATE TABLE IF NOT EXISTS post_velocity(
+    did text not null,
+    record text not null,
+    recent_rate real not null,
+    baseline_rate real not null,
+    score real not null,
+    updated_at integer not null,
+    primary key (did, record)
+);
+
+CREATE INDEX IF NOT EXISTS post_velocity_score_idx ON post_velocity (score DESC, did DESC, record DESC);
+
+CREATE TABLE IF NOT EXISTS classification_log(
+    id integer primary key autoincrement,
+    post_uri text not null,
+    image_cid text not null,
+    label text not null,
+    confidence real not null,
+    model text not null,
+    role text not null,
+    created_at integer not null
+);
+
+CREATE INDEX IF NOT EXISTS classification_log_created_at_idx ON classification_log (created_at);
+
+CREATE TABLE IF NOT EXISTS review_queue(
+    id integer primary key autoincrement,
+    post_uri text unique not null,
+    uri text not null,
+    record text not null,
+    did text not null,
+    image_cid text not null,
+    label text not null,
+    confidence real not null,
+    model text not null,
+    status text not null,
+    created_at integer not null,
+    decided_at integer,
+    decided_by text,
+    post text
+);
+
+CREATE INDEX IF NOT EXISTS review_queue_status_idx ON review_queue (status, id);
+
+CREATE TABLE IF NOT EXISTS review_decision(
+    id integer primary key autoincrement,
+    review_id integer not null references review_queue (id) on delete cascade,
+    image_cid text not null,
+    label text not null,
+    confidence real not null,
+    model text not null,
+    decision text not null,
+    decided_by text not null,
+    decided_at integer not null
+);
+
+CREATE INDEX IF NOT EXISTS review_decision_image_cid_idx ON review_decision (image_cid, decided_at);
+
+CREATE TABLE IF NOT EXISTS setting(
+    key text primary key not null,
+    value text not null,
+    updated_at integer not null
+);
@@ -0,0 +1,11 @@
+-- ranked feeds precomputed by the snapshot job, one row per position of every snapshot version
+CREATE TABLE IF NOT EXISTS feed_snapshot(
+    feed text not null,
+    version integer not null,
+    position integer not null,
+    did text not null,
+    record text not null,
+    indexed_at integer not null,
+    score real not null,
+    primary key (feed, version, position)
+);
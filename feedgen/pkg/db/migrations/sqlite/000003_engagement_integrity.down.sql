@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS post_repost_account_subject_idx;
+DROP INDEX IF EXISTS post_like_account_subject_idx;
@@ -0,0 +1,24 @@
+-- an account counts once per post, keep the first like or repost of duplicates
+DELETE FROM post_like WHERE EXISTS (
+    SELECT 1 FROM post_like d
+    WHERE d.did = post_like.did AND d.subject_did = post_like.subject_did AND d.subject_rkey = post_like.subject_rkey
+        AND (d.indexed_at, d.record) < (post_like.indexed_at, post_like.record));
+DELETE FROM post_repost WHERE EXISTS (
+    SELECT 1 FROM post_repost d
+    WHERE d.did = post_repost.did AND d.subject_did = post_repost.subject_did AND d.subject_rkey = post_repost.subject_rkey
+        AND (d.indexed_at, d.record) < (post_repost.indexed_at, post_repost.record));
+
+CREATE UNIQUE INDEX IF NOT EXISTS post_like_account_subject_idx ON post_like (did, subject_did, subject_rkey);
+CREATE UNIQUE INDEX IF NOT EXISTS post_repost_account_subject_idx ON post_repost (did, subject_did, subject_rkey);
+
+-- rows left behind by deleted posts
+DELETE FROM post_like WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = post_like.subject_did AND p.record = post_like.subject_rkey);
+DELETE FROM post_repost WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = post_repost.subject_did AND p.record = post_repost.subject_rkey);
+DELETE FROM post_reference WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = post_reference.subject_did AND p.record = post_reference.subject_rkey);
+DELETE FROM post_stats WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = post_stats.did AND p.record = post_stats.record);
+DELETE FROM post_velocity WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = post_velocity.did AND p.record = post_velocity.record);
+
+-- recount the likes and reposts of posts that had duplicates
+UPDATE post_stats SET
+    likes = (SELECT COUNT(*) FROM post_like l WHERE l.subject_did = post_stats.did AND l.subject_rkey = post_stats.record),
+    reposts = (SELECT COUNT(*) FROM post_repost r WHERE r.subject_did = post_stats.did AND r.subject_rkey = post_stats.record);
@@ -0,0 +1,50 @@
+package db_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db/dbtest"
+)
+
+// TestPostgres runs the conformance suite against the Postgres database at
+// TEST_POSTGRES_URL, e.g. the docker-compose database. Every table in it is truncated.
+func TestPostgres(t *testing.T) {
+	url := os.Getenv("TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("TEST_POSTGRES_URL not set")
+	}
+
+	m, err := db.NewMigrator(url)
+	if err != nil {
+		t.Fatalf("loading migrations: %v", err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	m.Close()
+
+	dbtest.Run(t, func(t *testing.T) db.DB {
+		ctx := context.Background()
+		conn, err := pgx.Connect(ctx, url)
+		if err != nil {
+			t.Fatalf("connecting: %v", err)
+		}
+		defer conn.Close(ctx)
+		_, err = conn.Exec(ctx, `TRUNCATE post, post_like, post_repost, post_stats, post_reference, post_velocity, feed_snapshot,
+            classification_log, review_queue, review_decision, setting RESTART IDENTITY`)
+		if err != nil {
+			t.Fatalf("truncating tables: %v", err)
+		}
+
+		t.Setenv("DATABASE_URL", url)
+		d, err := db.NewDB(ctx)
+		if err != nil {
+			t.Fatalf("NewDB: %v", err)
+		}
+		return d
+	})
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// HotParams tunes the hot ranking, where a post's engagement decays by half
+// every HalfLifeHours. Posts older than MaxAgeHours are not ranked at all.
+// RisingWeight boosts posts by their velocity score, see RisingWithCursor.
+type HotParams struct {
+	LikeWeight    float64 `json:"like_weight"`
+	RepostWeight  float64 `json:"repost_weight"`
+	HalfLifeHours float64 `json:"half_life_hours"`
+	MaxAgeHours   float64 `json:"max_age_hours"`
+	RisingWeight  float64 `json:"rising_weight"`
+}
+
+// HotWithCursor returns posts ranked by time decayed engagement after the cursor,
+// a nil cursor starts at the top.
+// The decayed score (w_l*likes + w_r*reposts + 1) * 2^(-age/half_life) is ranked by
+// its logarithm, log2(w_l*likes + w_r*reposts + 1) + indexed_at/half_life, which
+// orders posts the same way but doesn't change as time passes, so cursors stay valid.
+// The velocity boost does change over time, so pages may shift when RisingWeight is set.
+func (d *dbPostgres) HotWithCursor(ctx context.Context, params HotParams, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	query := `
+        SELECT did, record, indexed_at, score
+        FROM (
+            SELECT s.did, s.record, p.indexed_at,
+                ln($4::float8 * s.likes + $5::float8 * s.reposts + 1) / ln(2)
+                    + extract(epoch FROM p.indexed_at)::float8 / $6::float8
+                    + $7::float8 * COALESCE(v.score, 0) AS score
+            FROM post p
+            JOIN post_stats s ON s.did = p.did AND s.record = p.record
+            LEFT JOIN post_velocity v ON v.did = p.did AND v.record = p.record
+            WHERE p.indexed_at >= $8
+        ) ranked
+        WHERE $1::float8 IS NULL OR (score, did, record) < ($1, $2, $3)
+        ORDER BY score DESC, did DESC, record DESC
+        LIMIT $9`
+
+	var after *float64
+	var did, rkey string
+	if cursor != nil {
+		after, did, rkey = &cursor.Score, cursor.DID, cursor.Rkey
+	}
+	halfLife := params.HalfLifeHours * time.Hour.Seconds()
+	maxAge := time.Duration(params.MaxAgeHours * float64(time.Hour))
+	return d.queryFeed(ctx, query, after, did, rkey, params.LikeWeight, params.RepostWeight, halfLife,
+		params.RisingWeight, time.Now().Add(-maxAge), limit)
+}
+
+// TopSinceWithCursor returns posts ranked by the likes and reposts they received
+// since the given time, after the cursor. A nil cursor starts at the top.
+func (d *dbPostgres) TopSinceWithCursor(ctx context.Context, since time.Time, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	query := `
+        SELECT did, record, indexed_at, score
+        FROM (
+            SELECT p.did, p.record, p.indexed_at, COUNT(*)::float8 AS score
+            FROM (
+                SELECT subject_did, subject_rkey FROM post_like WHERE indexed_at >= $4
+                UNION ALL
+                SELECT subject_did, subject_rkey FROM post_repost WHERE indexed_at >= $4
+            ) e
+            JOIN post p ON p.did = e.subject_did AND p.record = e.subject_rkey
+            GROUP BY p.did, p.record, p.indexed_at
+        ) ranked
+        WHERE $1::float8 IS NULL OR (score, did, record) < ($1, $2, $3)
+        ORDER BY score DESC, did DESC, record DESC
+        LIMIT $5`
+
+	var after *float64
+	var did, rkey string
+	if cursor != nil {
+		after, did, rkey = &cursor.Score, cursor.DID, cursor.Rkey
+	}
+	return d.queryFeed(ctx, query, after, did, rkey, since, limit)
+}
@@ -0,0 +1,308 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var replicaHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "feedgen_db_replica_healthy",
+	Help: "Whether a read replica is reachable and within the maximum replication lag",
+}, []string{"replica"})
+
+var replicaLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "feedgen_db_replica_lag_seconds",
+	Help: "Replication lag of a read replica as of the last health check",
+}, []string{"replica"})
+
+var replicaFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_db_replica_fallbacks_total",
+	Help: "Number of reads that went to the primary because no replica was healthy or the replica failed",
+}, []string{"reason"})
+
+// serializationFailure is reported by a replica when a query conflicts with WAL replay
+const serializationFailure = "40001"
+
+// ReplicaConfig configures the read replicas feed queries are routed to
+type ReplicaConfig struct {
+	URLs []string
+	// MaxLag is the replication lag above which a replica is skipped
+	MaxLag time.Duration
+	// CheckInterval is how often replicas are checked for health and lag
+	CheckInterval time.Duration
+}
+
+// ReplicaConfigFromEnv reads the comma separated POSTGRES_REPLICA_URLS, REPLICA_MAX_LAG (default 10s)
+// and REPLICA_CHECK_INTERVAL (default 5s)
+func ReplicaConfigFromEnv() (ReplicaConfig, error) {
+	config := ReplicaConfig{
+		MaxLag:        10 * time.Second,
+		CheckInterval: 5 * time.Second,
+	}
+	for _, url := range strings.Split(os.Getenv("POSTGRES_REPLICA_URLS"), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			config.URLs = append(config.URLs, url)
+		}
+	}
+	for name, d := range map[string]*time.Duration{"REPLICA_MAX_LAG": &config.MaxLag, "REPLICA_CHECK_INTERVAL": &config.CheckInterval} {
+		raw := os.Getenv(name)
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed <= 0 {
+			return ReplicaConfig{}, fmt.Errorf("%s must be a positive duration: %q", name, raw)
+		}
+		*d = parsed
+	}
+	return config, nil
+}
+
+type replica struct {
+	name    string
+	pool    *pgxpool.Pool
+	healthy atomic.Bool
+}
+
+// walSample is the WAL position of the primary at the time of a health check
+type walSample struct {
+	at  time.Time
+	lsn uint64
+}
+
+// replicaSet spreads reads over the healthy replicas
+type replicaSet struct {
+	primary  *pgxpool.Pool
+	replicas []*replica
+	maxLag   time.Duration
+	next     atomic.Uint64
+	log      *slog.Logger
+	// samples are the WAL positions of the primary over the last maxLag, oldest first.
+	// They are only used by check, which doesn't run concurrently.
+	samples []walSample
+}
+
+func newReplicaSet(ctx context.Context, primary *pgxpool.Pool, config ReplicaConfig) (*replicaSet, error) {
+	set := &replicaSet{
+		primary: primary,
+		maxLag:  config.MaxLag,
+		log:     slog.Default(),
+	}
+	for _, url := range config.URLs {
+		poolConfig, err := newPoolConfig(url)
+		if err != nil {
+			set.close()
+			return nil, fmt.Errorf("invalid replica URL: %w", err)
+		}
+		pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+		if err != nil {
+			set.close()
+			return nil, err
+		}
+		set.replicas = append(set.replicas, &replica{
+			name: fmt.Sprintf("%s:%d", poolConfig.ConnConfig.Host, poolConfig.ConnConfig.Port),
+			pool: pool,
+		})
+	}
+	// replicas only take reads once they passed a health check
+	set.check(ctx)
+	go set.run(ctx, config.CheckInterval)
+	return set, nil
+}
+
+// pick returns a healthy replica, round robin, or nil if none is healthy
+func (s *replicaSet) pick() *replica {
+	n := uint64(len(s.replicas))
+	start := s.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		r := s.replicas[(start+i)%n]
+		if r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *replicaSet) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.close()
+			return
+		case <-ticker.C:
+			s.check(ctx)
+		}
+	}
+}
+
+// close closes the pools of the replicas
+func (s *replicaSet) close() {
+	for _, r := range s.replicas {
+		r.pool.Close()
+	}
+}
+
+// check marks replicas healthy that answer and are within the maximum lag
+func (s *replicaSet) check(ctx context.Context) {
+	now := time.Now()
+	sampleErr := s.sampleWAL(ctx, now)
+	for _, r := range s.replicas {
+		var lag time.Duration
+		err := sampleErr
+		if err == nil {
+			lag, err = s.replicationLag(ctx, r.pool, now)
+		}
+		healthy := err == nil && lag <= s.maxLag
+		if healthy != r.healthy.Load() {
+			switch {
+			case err != nil:
+				s.log.Warn(fmt.Sprintf("replica %s is unhealthy: %s", r.name, err.Error()))
+			case !healthy:
+				s.log.Warn(fmt.Sprintf("replica %s is %s behind, skipping it", r.name, lag))
+			default:
+				s.log.Info(fmt.Sprintf("replica %s is healthy", r.name))
+			}
+		}
+		r.healthy.Store(healthy)
+		replicaLag.WithLabelValues(r.name).Set(lag.Seconds())
+		if healthy {
+			replicaHealthy.WithLabelValues(r.name).Set(1)
+		} else {
+			replicaHealthy.WithLabelValues(r.name).Set(0)
+		}
+	}
+}
+
+// sampleWAL records the current WAL position of the primary, keeping the samples needed to
+// tell how long ago the primary was at a position up to maxLag back
+func (s *replicaSet) sampleWAL(ctx context.Context, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	var raw string
+	if err := s.primary.QueryRow(ctx, `SELECT pg_current_wal_lsn()::text`).Scan(&raw); err != nil {
+		return fmt.Errorf("failed to read the WAL position of the primary: %w", err)
+	}
+	lsn, err := parseLSN(raw)
+	if err != nil {
+		return err
+	}
+	s.samples = append(s.samples, walSample{at: now, lsn: lsn})
+	for len(s.samples) > 1 && now.Sub(s.samples[1].at) >= s.maxLag {
+		s.samples = s.samples[1:]
+	}
+	return nil
+}
+
+// replicationLag returns how long ago the primary was at the position the replica has replayed,
+// at the resolution of the health checks. Comparing with the primary instead of with what the
+// replica received catches replicas that lost their connection to the primary. A replica that
+// has replayed everything the primary wrote is not lagging, even if that was a while ago.
+func (s *replicaSet) replicationLag(ctx context.Context, pool *pgxpool.Pool, now time.Time) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	var inRecovery bool
+	var raw string
+	var replayedSeconds *float64
+	err := pool.QueryRow(ctx, `
+        SELECT pg_is_in_recovery(),
+            COALESCE(pg_last_wal_replay_lsn()::text, ''),
+            EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())::float8`).Scan(&inRecovery, &raw, &replayedSeconds)
+	if err != nil {
+		return 0, err
+	}
+	if !inRecovery {
+		return 0, nil
+	}
+	replayed, err := parseLSN(raw)
+	if err != nil {
+		return 0, err
+	}
+	var replayedAge *time.Duration
+	if replayedSeconds != nil {
+		age := time.Duration(*replayedSeconds * float64(time.Second))
+		replayedAge = &age
+	}
+	return lagBehind(s.samples, replayed, replayedAge, now)
+}
+
+// lagBehind returns how long ago the primary was at the replayed position, given the samples of
+// its WAL position oldest first and the age of the last transaction replayed, nil if there is none
+func lagBehind(samples []walSample, replayed uint64, replayedAge *time.Duration, now time.Time) (time.Duration, error) {
+	for i := len(samples) - 1; i >= 0; i-- {
+		if samples[i].lsn <= replayed {
+			return now.Sub(samples[i].at), nil
+		}
+	}
+	// the replica is behind every sample, e.g. on the first check. It is at least as far behind
+	// as the oldest sample, and the age of the last transaction it replayed bounds it from above.
+	if replayedAge == nil {
+		return 0, fmt.Errorf("replica hasn't replayed any transaction")
+	}
+	if len(samples) == 0 {
+		return *replayedAge, nil
+	}
+	return max(now.Sub(samples[0].at), *replayedAge), nil
+}
+
+// parseLSN parses a WAL position in the X/Y hex notation of pg_lsn
+func parseLSN(raw string) (uint64, error) {
+	hi, lo, ok := strings.Cut(raw, "/")
+	if !ok {
+		return 0, fmt.Errorf("malformed WAL position: %q", raw)
+	}
+	high, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("malformed WAL position: %q", raw)
+	}
+	low, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("malformed WAL position: %q", raw)
+	}
+	return high<<32 | low, nil
+}
+
+// read runs a read-only query on a healthy replica, falling back to the primary
+// when there is none or the replica fails. fn may be called twice and must reset its results.
+func (d *dbPostgres) read(ctx context.Context, fn func(pool *pgxpool.Pool) error) error {
+	if d.replicas == nil {
+		return fn(d.db)
+	}
+	r := d.replicas.pick()
+	if r == nil {
+		replicaFallbacks.WithLabelValues("no_healthy_replica").Inc()
+		return fn(d.db)
+	}
+	err := fn(r.pool)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// the query itself failed, the primary would fail it too
+		if pgErr.Code != serializationFailure {
+			return err
+		}
+		replicaFallbacks.WithLabelValues("replay_conflict").Inc()
+		return fn(d.db)
+	}
+	// the replica can't be reached, stop using it until the next health check passes
+	d.replicas.log.Warn(fmt.Sprintf("read from replica %s failed, using the primary: %s", r.name, err.Error()))
+	r.healthy.Store(false)
+	replicaHealthy.WithLabelValues(r.name).Set(0)
+	replicaFallbacks.WithLabelValues("replica_error").Inc()
+	return fn(d.db)
+}
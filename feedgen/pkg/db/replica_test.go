@@ -0,0 +1,70 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLSN(t *testing.T) {
+	for _, tt := range []struct {
+		raw     string
+		want    uint64
+		wantErr bool
+	}{
+		{raw: "0/0", want: 0},
+		{raw: "0/16B3748", want: 0x16B3748},
+		{raw: "1/0", want: 1 << 32},
+		{raw: "A/FF", want: 0xA<<32 | 0xFF},
+		{raw: "ffffffff/ffffffff", want: 1<<64 - 1},
+		{raw: "", wantErr: true},
+		{raw: "16B3748", wantErr: true},
+		{raw: "0/", wantErr: true},
+		{raw: "/0", wantErr: true},
+		{raw: "0/G", wantErr: true},
+		// each half is at most 32 bits
+		{raw: "100000000/0", wantErr: true},
+		{raw: "0/100000000", wantErr: true},
+	} {
+		got, err := parseLSN(tt.raw)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseLSN(%q) = %#x, %v, want %#x, error %v", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLagBehind(t *testing.T) {
+	now := time.Unix(1000, 0)
+	// the primary was at 100 ten seconds ago, at 200 five seconds ago and at 300 now
+	samples := []walSample{
+		{at: now.Add(-10 * time.Second), lsn: 100},
+		{at: now.Add(-5 * time.Second), lsn: 200},
+		{at: now, lsn: 300},
+	}
+	age := func(d time.Duration) *time.Duration { return &d }
+	for _, tt := range []struct {
+		name        string
+		samples     []walSample
+		replayed    uint64
+		replayedAge *time.Duration
+		want        time.Duration
+		wantErr     bool
+	}{
+		{name: "caught up", samples: samples, replayed: 300, want: 0},
+		// the replica is compared with the newest position it has replayed
+		{name: "ahead of a sample", samples: samples, replayed: 250, want: 5 * time.Second},
+		{name: "at a sample", samples: samples, replayed: 200, want: 5 * time.Second},
+		{name: "ahead of the primary", samples: samples, replayed: 400, want: 0},
+		// behind every sample the oldest sample bounds the lag from below, the replay age from above
+		{name: "behind every sample", samples: samples, replayed: 50, replayedAge: age(time.Minute), want: time.Minute},
+		{name: "replayed recently but behind", samples: samples, replayed: 50, replayedAge: age(time.Second), want: 10 * time.Second},
+		{name: "nothing replayed", samples: samples, replayed: 50, wantErr: true},
+		{name: "no samples", replayed: 50, replayedAge: age(time.Minute), want: time.Minute},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lagBehind(tt.samples, tt.replayed, tt.replayedAge, now)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("lagBehind = %s, %v, want %s, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
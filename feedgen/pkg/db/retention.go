@@ -0,0 +1,168 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ArchiveFunc receives the pruned rows of a batch as JSON objects before the batch is committed,
+// returning an error aborts the batch
+type ArchiveFunc func(rows []json.RawMessage) error
+
+// PrunePosts deletes up to limit posts indexed before the given time, along with their
+// counters, references and engagement. Posts that were liked or reposted since protectSince
+// are kept, a zero protectSince protects nothing. It returns the number of pruned posts.
+func (d *dbPostgres) PrunePosts(ctx context.Context, before, protectSince time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	var protect *time.Time
+	if !protectSince.IsZero() {
+		protect = &protectSince
+	}
+
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+        WITH batch AS (
+            SELECT p.did, p.record FROM post p
+            WHERE p.indexed_at < $1
+                AND ($2::timestamptz IS NULL OR (
+                    NOT EXISTS (SELECT 1 FROM post_like l WHERE l.subject_did = p.did AND l.subject_rkey = p.record AND l.indexed_at >= $2)
+                    AND NOT EXISTS (SELECT 1 FROM post_repost r WHERE r.subject_did = p.did AND r.subject_rkey = p.record AND r.indexed_at >= $2)))
+            ORDER BY p.indexed_at
+            LIMIT $3
+            FOR UPDATE SKIP LOCKED
+        )
+        DELETE FROM post p USING batch b
+        WHERE p.did = b.did AND p.record = b.record
+        RETURNING p.did, p.record, row_to_json(p.*)`,
+		before, protect, limit)
+	if err != nil {
+		return 0, err
+	}
+	var dids, rkeys []string
+	var archived []json.RawMessage
+	for rows.Next() {
+		var did, rkey string
+		var row json.RawMessage
+		if err := rows.Scan(&did, &rkey, &row); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		dids, rkeys, archived = append(dids, did), append(rkeys, rkey), append(archived, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(dids) == 0 {
+		return 0, nil
+	}
+
+	// the engagement and counters of pruned posts are of no use without the post
+	for _, query := range []string{
+		"DELETE FROM post_stats s USING unnest($1::varchar[], $2::varchar[]) AS k(did, record) WHERE s.did = k.did AND s.record = k.record",
+		"DELETE FROM post_velocity v USING unnest($1::varchar[], $2::varchar[]) AS k(did, record) WHERE v.did = k.did AND v.record = k.record",
+		"DELETE FROM post_reference r USING unnest($1::varchar[], $2::varchar[]) AS k(did, record) WHERE (r.did = k.did AND r.record = k.record) OR (r.subject_did = k.did AND r.subject_rkey = k.record)",
+		"DELETE FROM post_like l USING unnest($1::varchar[], $2::varchar[]) AS k(did, record) WHERE l.subject_did = k.did AND l.subject_rkey = k.record",
+		"DELETE FROM post_repost r USING unnest($1::varchar[], $2::varchar[]) AS k(did, record) WHERE r.subject_did = k.did AND r.subject_rkey = k.record",
+	} {
+		if _, err := tx.Exec(ctx, query, dids, rkeys); err != nil {
+			return 0, err
+		}
+	}
+
+	if archive != nil {
+		if err := archive(archived); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(dids)), tx.Commit(ctx)
+}
+
+// PruneLikes deletes up to limit likes indexed before the given time, returning the number of pruned likes
+// The like counters of the subjects are kept.
+func (d *dbPostgres) PruneLikes(ctx context.Context, before time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	return d.pruneEngagement(ctx, "post_like", before, limit, archive)
+}
+
+// PruneReposts deletes up to limit reposts indexed before the given time, returning the number of pruned reposts
+// The repost counters of the subjects are kept.
+func (d *dbPostgres) PruneReposts(ctx context.Context, before time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	return d.pruneEngagement(ctx, "post_repost", before, limit, archive)
+}
+
+func (d *dbPostgres) pruneEngagement(ctx context.Context, table string, before time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+        WITH batch AS (
+            SELECT did, record FROM `+table+`
+            WHERE indexed_at < $1
+            ORDER BY indexed_at
+            LIMIT $2
+            FOR UPDATE SKIP LOCKED
+        )
+        DELETE FROM `+table+` e USING batch b
+        WHERE e.did = b.did AND e.record = b.record
+        RETURNING row_to_json(e.*)`,
+		before, limit)
+	if err != nil {
+		return 0, err
+	}
+	archived, err := pgx.CollectRows(rows, pgx.RowTo[json.RawMessage])
+	if err != nil {
+		return 0, err
+	}
+	if len(archived) == 0 {
+		return 0, nil
+	}
+
+	if archive != nil {
+		if err := archive(archived); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(archived)), tx.Commit(ctx)
+}
+
+// postgresOrphans select up to $1 keys of rows whose post is not indexed, by table and key columns
+var postgresOrphans = []struct{ table, key, query string }{
+	{"post_like", "did, record", `SELECT did, record FROM post_like e
+        WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = e.subject_did AND p.record = e.subject_rkey) LIMIT $1`},
+	{"post_repost", "did, record", `SELECT did, record FROM post_repost e
+        WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = e.subject_did AND p.record = e.subject_rkey) LIMIT $1`},
+	{"post_reference", "did, record, kind", `SELECT did, record, kind FROM post_reference r
+        WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = r.subject_did AND p.record = r.subject_rkey) LIMIT $1`},
+	{"post_stats", "did, record", `SELECT did, record FROM post_stats s
+        WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = s.did AND p.record = s.record) LIMIT $1`},
+	{"post_velocity", "did, record", `SELECT did, record FROM post_velocity v
+        WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = v.did AND p.record = v.record) LIMIT $1`},
+}
+
+// PruneOrphans deletes up to limit rows left behind by posts that are no longer indexed, e.g. likes
+// stored while their post was deleted. Their posts are gone, so there are no counters to update.
+func (d *dbPostgres) PruneOrphans(ctx context.Context, limit int64) (int64, error) {
+	var pruned int64
+	for _, orphans := range postgresOrphans {
+		if pruned >= limit {
+			break
+		}
+		tag, err := d.db.Exec(ctx, "DELETE FROM "+orphans.table+" WHERE ("+orphans.key+") IN ("+orphans.query+")", limit-pruned)
+		if err != nil {
+			return pruned, fmt.Errorf("failed to prune orphaned %s rows: %w", orphans.table, err)
+		}
+		pruned += tag.RowsAffected()
+	}
+	return pruned, nil
+}
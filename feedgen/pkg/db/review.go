@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Review statuses of items in the review queue
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+	// ReviewWithdrawn items were pending when their post was deleted, they can't be decided
+	ReviewWithdrawn = "withdrawn"
+)
+
+// ErrNotFound is returned when a record to update does not exist
+var ErrNotFound = errors.New("not found")
+
+// ReviewItem is a borderline classified post waiting for a human decision
+type ReviewItem struct {
+	ID         int64      `json:"id"`
+	PostURI    string     `json:"post_uri"`
+	URI        string     `json:"uri"`
+	DID        string     `json:"did"`
+	Rkey       string     `json:"rkey"`
+	ImageCID   string     `json:"image_cid"`
+	Label      string     `json:"label"`
+	Confidence float64    `json:"confidence"`
+	Model      string     `json:"model"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	DecidedAt  *time.Time `json:"decided_at,omitempty"`
+	DecidedBy  *string    `json:"decided_by,omitempty"`
+	// Post holds the post metadata that is stored when the item is approved
+	Post *Post `json:"post,omitempty"`
+}
+
+const reviewItemColumns = `id, post_uri, uri, record, did, image_cid, label, confidence, model, status, created_at, decided_at, decided_by, post`
+
+func scanReviewItem(row pgx.Row) (*ReviewItem, error) {
+	var item ReviewItem
+	err := row.Scan(&item.ID, &item.PostURI, &item.URI, &item.Rkey, &item.DID, &item.ImageCID, &item.Label,
+		&item.Confidence, &item.Model, &item.Status, &item.CreatedAt, &item.DecidedAt, &item.DecidedBy, &item.Post)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// AddReviewItem queues a post for review, posts that are already queued are ignored
+func (d *dbPostgres) AddReviewItem(ctx context.Context, item ReviewItem) error {
+	_, err := d.db.Exec(ctx, `
+        INSERT INTO review_queue (post_uri, uri, record, did, image_cid, label, confidence, model, status, created_at, post)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+        ON CONFLICT (post_uri) DO NOTHING`,
+		item.PostURI, item.URI, item.Rkey, item.DID, item.ImageCID, item.Label, item.Confidence, item.Model, ReviewPending, time.Now(), item.Post)
+	return err
+}
+
+// ReviewItems lists review items with the given status, oldest first
+// The cursor is the ID of the last item of the previous page
+func (d *dbPostgres) ReviewItems(ctx context.Context, status string, limit int64, cursor int64) ([]ReviewItem, error) {
+	rows, err := d.db.Query(ctx, `SELECT `+reviewItemColumns+` FROM review_queue WHERE status = $1 AND id > $2 ORDER BY id LIMIT $3`,
+		status, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []ReviewItem
+	for rows.Next() {
+		item, err := scanReviewItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *item)
+	}
+	return items, rows.Err()
+}
+
+// DecideReviewItem approves or rejects a pending review item and logs the decision
+// Approved posts are added to the feed. ErrNotFound is returned if there is no pending item with the ID,
+// including items that were decided or withdrawn since they were listed.
+func (d *dbPostgres) DecideReviewItem(ctx context.Context, id int64, decision, reviewer string) (*ReviewItem, error) {
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	item, err := scanReviewItem(tx.QueryRow(ctx, `
+        UPDATE review_queue SET status = $1, decided_at = $2, decided_by = $3
+        WHERE id = $4 AND status = $5
+        RETURNING `+reviewItemColumns,
+		decision, now, reviewer, id, ReviewPending))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `
+        INSERT INTO review_decision (review_id, image_cid, label, confidence, model, decision, decided_by, decided_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		item.ID, item.ImageCID, item.Label, item.Confidence, item.Model, decision, reviewer, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if decision == ReviewApproved {
+		post := Post{
+			DID:   item.DID,
+			Rkey:  item.Rkey,
+			URI:   item.URI,
+			ATURI: item.PostURI,
+		}
+		if item.Post != nil {
+			post = *item.Post
+		}
+		// the reviewer's decision replaces the classifier result
+		post.Labels = []string{item.Label}
+		post.Confidence = 1
+		if err := insertPost(ctx, tx, post, now); err != nil {
+			return nil, err
+		}
+	}
+
+	return item, tx.Commit(ctx)
+}
+
+// ImageDecision returns the most recent review decision for an image, or an empty string
+// if the image has never been reviewed
+func (d *dbPostgres) ImageDecision(ctx context.Context, imageCID string) (string, error) {
+	var decision string
+	err := d.db.QueryRow(ctx, "SELECT decision FROM review_decision WHERE image_cid = $1 ORDER BY decided_at DESC LIMIT 1", imageCID).Scan(&decision)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return decision, err
+}
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// GetSetting returns the JSON value of a runtime setting, or ErrNotFound if it was never set
+func (d *dbPostgres) GetSetting(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := d.db.QueryRow(ctx, "SELECT value FROM setting WHERE key = $1", key).Scan(&value)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+// PutSetting stores the JSON value of a runtime setting
+func (d *dbPostgres) PutSetting(ctx context.Context, key string, value []byte) error {
+	_, err := d.db.Exec(ctx, `
+        INSERT INTO setting (key, value, updated_at) VALUES ($1, $2, $3)
+        ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = EXCLUDED.updated_at`,
+		key, string(value), time.Now())
+	return err
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SaveFeedSnapshot stores a ranked snapshot of a feed under a version, saving a version twice keeps the first.
+// Snapshots are read back from the primary, a replica may not have the latest version yet.
+func (d *dbPostgres) SaveFeedSnapshot(ctx context.Context, feed string, version int64, posts []FeedPost) error {
+	dids := make([]string, len(posts))
+	rkeys := make([]string, len(posts))
+	indexedAts := make([]time.Time, len(posts))
+	scores := make([]float64, len(posts))
+	for i, post := range posts {
+		dids[i], rkeys[i], indexedAts[i], scores[i] = post.DID, post.Rkey, post.Time, post.Score
+	}
+
+	_, err := d.db.Exec(ctx, `
+        INSERT INTO feed_snapshot (feed, version, position, did, record, indexed_at, score)
+        SELECT $1, $2, p.position - 1, p.did, p.record, p.indexed_at, p.score
+        FROM unnest($3::varchar[], $4::varchar[], $5::timestamptz[], $6::float8[])
+            WITH ORDINALITY AS p(did, record, indexed_at, score, position)
+        ON CONFLICT (feed, version, position) DO NOTHING`,
+		feed, version, dids, rkeys, indexedAts, scores)
+	return err
+}
+
+// FeedSnapshot returns the posts of a snapshot version in ranked order
+func (d *dbPostgres) FeedSnapshot(ctx context.Context, feed string, version int64) ([]FeedPost, error) {
+	rows, err := d.db.Query(ctx, `
+        SELECT did, record, indexed_at, score FROM feed_snapshot
+        WHERE feed = $1 AND version = $2
+        ORDER BY position`, feed, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []FeedPost
+	for rows.Next() {
+		var post FeedPost
+		if err := rows.Scan(&post.DID, &post.Rkey, &post.Time, &post.Score); err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// a snapshot without posts is never saved, so no rows means the version doesn't exist
+	if len(posts) == 0 {
+		return nil, ErrNotFound
+	}
+	return posts, nil
+}
+
+// LatestFeedSnapshot returns the newest snapshot version of a feed and its posts
+func (d *dbPostgres) LatestFeedSnapshot(ctx context.Context, feed string) (int64, []FeedPost, error) {
+	var version int64
+	err := d.db.QueryRow(ctx, "SELECT version FROM feed_snapshot WHERE feed = $1 ORDER BY version DESC LIMIT 1", feed).Scan(&version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil, ErrNotFound
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	posts, err := d.FeedSnapshot(ctx, feed, version)
+	return version, posts, err
+}
+
+// PruneFeedSnapshots deletes the snapshots of a feed older than the given version
+func (d *dbPostgres) PruneFeedSnapshots(ctx context.Context, feed string, before int64) (int64, error) {
+	tag, err := d.db.Exec(ctx, "DELETE FROM feed_snapshot WHERE feed = $1 AND version < $2", feed, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,492 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// dbSQLite stores everything in a single SQLite file, for small feeds and local development.
+// Times are stored as unix microseconds and arrays as JSON text.
+type dbSQLite struct {
+	db *sql.DB
+}
+
+// sqliteDefaults wait for locks instead of failing, allow readers while writing,
+// and take the write lock when a transaction begins so transactions don't deadlock upgrading it
+var sqliteDefaults = url.Values{
+	"_pragma": {"busy_timeout(5000)", "journal_mode(WAL)", "foreign_keys(1)"},
+	"_txlock": {"immediate"},
+}
+
+// newSQLite opens the SQLite file of a sqlite:// URL and applies its migrations,
+// there is no separate migration step for SQLite
+func newSQLite(rawURL string) (*dbSQLite, error) {
+	db, err := openSQLite(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newSQLiteMigrator(db)
+	if err == nil {
+		err = m.Up()
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate sqlite database: %w", err)
+	}
+
+	return &dbSQLite{db: db}, nil
+}
+
+func openSQLite(rawURL string) (*sql.DB, error) {
+	path, rawQuery, _ := strings.Cut(strings.TrimPrefix(rawURL, "sqlite://"), "?")
+	if path == "" {
+		return nil, fmt.Errorf("sqlite URL has no path: %q", rawURL)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sqlite URL parameters: %w", err)
+	}
+	for key, values := range sqliteDefaults {
+		if !query.Has(key) || key == "_pragma" {
+			// pragmas from the URL are applied after the defaults, so they take precedence
+			query[key] = append(append([]string(nil), values...), query[key]...)
+		}
+	}
+	return sql.Open("sqlite", "file:"+path+"?"+query.Encode())
+}
+
+// toJSONArray encodes a slice for a JSON text column, nil slices are stored as NULL
+func toJSONArray(values []string) (*string, error) {
+	if values == nil {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	s := string(encoded)
+	return &s, nil
+}
+
+func fromJSONArray(raw *string) ([]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	var values []string
+	err := json.Unmarshal([]byte(*raw), &values)
+	return values, err
+}
+
+func (d *dbSQLite) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+func (d *dbSQLite) SchemaStatus(ctx context.Context) (SchemaStatus, error) {
+	latest, err := latestMigration(sqliteMigrations, "migrations/sqlite")
+	if err != nil {
+		return SchemaStatus{}, err
+	}
+	status := SchemaStatus{Latest: latest}
+	var version int64
+	err = d.db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &status.Dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return status, nil
+	}
+	status.Version = uint(version)
+	return status, err
+}
+
+func (d *dbSQLite) AddPost(ctx context.Context, post Post) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertSQLitePost(ctx, tx, post, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertSQLitePost(ctx context.Context, tx *sql.Tx, post Post, indexedAt time.Time) error {
+	var arrays [5]*string
+	for i, values := range [][]string{post.Langs, post.ImageCIDs, post.AltTexts, post.Labels, post.SelfLabels} {
+		encoded, err := toJSONArray(values)
+		if err != nil {
+			return err
+		}
+		arrays[i] = encoded
+	}
+
+	result, err := tx.ExecContext(ctx, `
+        INSERT INTO post (did, record, uri, at_uri, cid, created_at, text, langs, image_cids, alt_texts,
+            labels, confidence, is_reply, is_quote, self_labels, indexed_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT DO NOTHING`,
+		post.DID, post.Rkey, post.URI, post.ATURI, post.CID, createdAt(post, indexedAt).UnixMicro(), post.Text, arrays[0], arrays[1], arrays[2],
+		arrays[3], post.Confidence, post.IsReply, post.IsQuote, arrays[4], indexedAt.UnixMicro())
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		return err
+	}
+	// every indexed post gets a post_stats row for its engagement counters
+	_, err = tx.ExecContext(ctx, "INSERT INTO post_stats (did, record) VALUES (?, ?) ON CONFLICT DO NOTHING", post.DID, post.Rkey)
+	return err
+}
+
+func (d *dbSQLite) GetPost(ctx context.Context, did, rkey string) (*Post, error) {
+	var post Post
+	var cid, text *string
+	var createdAt *int64
+	var confidence *float64
+	var indexedAt int64
+	var arrays [5]*string
+	err := d.db.QueryRowContext(ctx, `
+        SELECT did, record, uri, at_uri, cid, created_at, text, langs, image_cids, alt_texts,
+            labels, confidence, is_reply, is_quote, self_labels, indexed_at
+        FROM post WHERE did = ? AND record = ?`, did, rkey).Scan(
+		&post.DID, &post.Rkey, &post.URI, &post.ATURI, &cid, &createdAt, &text, &arrays[0], &arrays[1], &arrays[2],
+		&arrays[3], &confidence, &post.IsReply, &post.IsQuote, &arrays[4], &indexedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, target := range []*[]string{&post.Langs, &post.ImageCIDs, &post.AltTexts, &post.Labels, &post.SelfLabels} {
+		if *target, err = fromJSONArray(arrays[i]); err != nil {
+			return nil, err
+		}
+	}
+	if cid != nil {
+		post.CID = *cid
+	}
+	if text != nil {
+		post.Text = *text
+	}
+	if createdAt != nil {
+		post.CreatedAt = time.UnixMicro(*createdAt)
+	}
+	if confidence != nil {
+		post.Confidence = *confidence
+	}
+	post.IndexedAt = time.UnixMicro(indexedAt)
+	return &post, nil
+}
+
+func (d *dbSQLite) DeletePost(ctx context.Context, did, rkey string) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM post WHERE did = ? AND record = ?", did, rkey)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM post_stats WHERE did = ? AND record = ?", did, rkey)
+	if err != nil {
+		return err
+	}
+
+	// the deleted post may have been a reply to or a quote of an indexed post
+	rows, err := tx.QueryContext(ctx, "DELETE FROM post_reference WHERE did = ? AND record = ? RETURNING kind, subject_did, subject_rkey", did, rkey)
+	if err != nil {
+		return err
+	}
+	var refs []Reference
+	for rows.Next() {
+		var ref Reference
+		if err := rows.Scan(&ref.Kind, &ref.SubjectDID, &ref.SubjectRkey); err != nil {
+			rows.Close()
+			return err
+		}
+		refs = append(refs, ref)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if err := incrementSQLiteStat(ctx, tx, referenceCounters[ref.Kind], ref.SubjectDID, ref.SubjectRkey, -1); err != nil {
+			return err
+		}
+	}
+	// engagement on the deleted post and references to it are of no use without the post
+	for _, query := range []string{
+		"DELETE FROM post_velocity WHERE did = ? AND record = ?",
+		"DELETE FROM post_reference WHERE subject_did = ? AND subject_rkey = ?",
+		"DELETE FROM post_like WHERE subject_did = ? AND subject_rkey = ?",
+		"DELETE FROM post_repost WHERE subject_did = ? AND subject_rkey = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, query, did, rkey); err != nil {
+			return err
+		}
+	}
+	// a deleted post waiting for review must not be added to the feed by approving it
+	_, err = tx.ExecContext(ctx, "UPDATE review_queue SET status = ?, decided_at = ? WHERE status = ? AND did = ? AND record = ?",
+		ReviewWithdrawn, time.Now().UnixMicro(), ReviewPending, did, rkey)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *dbSQLite) AddLike(ctx context.Context, like Engagement) (bool, error) {
+	return d.addEngagement(ctx, "post_like", "likes", like)
+}
+
+func (d *dbSQLite) DeleteLike(ctx context.Context, did, rkey string) error {
+	return d.deleteEngagement(ctx, "post_like", "likes", did, rkey)
+}
+
+func (d *dbSQLite) AddRepost(ctx context.Context, repost Engagement) (bool, error) {
+	return d.addEngagement(ctx, "post_repost", "reposts", repost)
+}
+
+func (d *dbSQLite) DeleteRepost(ctx context.Context, did, rkey string) error {
+	return d.deleteEngagement(ctx, "post_repost", "reposts", did, rkey)
+}
+
+// addEngagement stores a like or repost if its subject is an indexed post,
+// and increments the subject's counter in the same transaction
+func (d *dbSQLite) addEngagement(ctx context.Context, table, counter string, e Engagement) (bool, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM post WHERE did = ? AND record = ?)", e.SubjectDID, e.SubjectRkey).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, nil
+	}
+
+	// an account's engagement on a post counts once, however many records it creates
+	result, err := tx.ExecContext(ctx, `
+        INSERT INTO `+table+` (did, record, subject_did, subject_rkey, indexed_at) VALUES (?, ?, ?, ?, ?)
+        ON CONFLICT DO NOTHING`,
+		e.DID, e.Rkey, e.SubjectDID, e.SubjectRkey, time.Now().UnixMicro())
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return true, err
+	}
+	if err := incrementSQLiteStat(ctx, tx, counter, e.SubjectDID, e.SubjectRkey, 1); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// deleteEngagement removes a like or repost and decrements its subject's counter
+func (d *dbSQLite) deleteEngagement(ctx context.Context, table, counter, did, rkey string) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var subjectDID, subjectRkey string
+	err = tx.QueryRowContext(ctx, "DELETE FROM "+table+" WHERE did = ? AND record = ? RETURNING subject_did, subject_rkey", did, rkey).
+		Scan(&subjectDID, &subjectRkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := incrementSQLiteStat(ctx, tx, counter, subjectDID, subjectRkey, -1); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *dbSQLite) AddLikes(ctx context.Context, likes []Engagement) (int64, error) {
+	return d.addEngagements(ctx, "post_like", "likes", likes)
+}
+
+func (d *dbSQLite) DeleteLikes(ctx context.Context, keys []RecordKey) (int64, error) {
+	return d.deleteEngagements(ctx, "post_like", "likes", keys)
+}
+
+func (d *dbSQLite) AddReposts(ctx context.Context, reposts []Engagement) (int64, error) {
+	return d.addEngagements(ctx, "post_repost", "reposts", reposts)
+}
+
+func (d *dbSQLite) DeleteReposts(ctx context.Context, keys []RecordKey) (int64, error) {
+	return d.deleteEngagements(ctx, "post_repost", "reposts", keys)
+}
+
+// addEngagements stores a batch of likes or reposts whose subjects are indexed posts
+// and increments the subjects' counters in one transaction
+func (d *dbSQLite) addEngagements(ctx context.Context, table, counter string, batch []Engagement) (int64, error) {
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.PrepareContext(ctx, `
+        INSERT INTO `+table+` (did, record, subject_did, subject_rkey, indexed_at)
+        SELECT ?1, ?2, ?3, ?4, ?5
+        WHERE EXISTS (SELECT 1 FROM post WHERE did = ?3 AND record = ?4)
+        ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return 0, err
+	}
+	defer insert.Close()
+
+	var added int64
+	now := time.Now().UnixMicro()
+	for _, e := range batch {
+		result, err := insert.ExecContext(ctx, e.DID, e.Rkey, e.SubjectDID, e.SubjectRkey, now)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+		if err := incrementSQLiteStat(ctx, tx, counter, e.SubjectDID, e.SubjectRkey, 1); err != nil {
+			return 0, err
+		}
+		added++
+	}
+
+	return added, tx.Commit()
+}
+
+// deleteEngagements removes a batch of likes or reposts and decrements their subjects' counters in one transaction
+func (d *dbSQLite) deleteEngagements(ctx context.Context, table, counter string, keys []RecordKey) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var deleted int64
+	for _, key := range keys {
+		var subjectDID, subjectRkey string
+		err := tx.QueryRowContext(ctx, "DELETE FROM "+table+" WHERE did = ? AND record = ? RETURNING subject_did, subject_rkey", key.DID, key.Rkey).
+			Scan(&subjectDID, &subjectRkey)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := incrementSQLiteStat(ctx, tx, counter, subjectDID, subjectRkey, -1); err != nil {
+			return 0, err
+		}
+		deleted++
+	}
+
+	return deleted, tx.Commit()
+}
+
+// PostKeys returns the keys of every indexed post
+func (d *dbSQLite) PostKeys(ctx context.Context) ([]RecordKey, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT did, record FROM post")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []RecordKey
+	for rows.Next() {
+		var key RecordKey
+		if err := rows.Scan(&key.DID, &key.Rkey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// incrementSQLiteStat adds delta to a post_stats counter of a post
+func incrementSQLiteStat(ctx context.Context, tx *sql.Tx, counter, did, rkey string, delta int64) error {
+	_, err := tx.ExecContext(ctx, "UPDATE post_stats SET "+counter+" = "+counter+" + ? WHERE did = ? AND record = ?", delta, did, rkey)
+	return err
+}
+
+// AddReference stores a reply or quote if its subject is an indexed post, and
+// increments the subject's counter in the same transaction
+func (d *dbSQLite) AddReference(ctx context.Context, ref Reference) error {
+	counter, ok := referenceCounters[ref.Kind]
+	if !ok {
+		return fmt.Errorf("unknown reference kind: %s", ref.Kind)
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+        INSERT INTO post_reference (did, record, kind, subject_did, subject_rkey, indexed_at)
+        SELECT ?1, ?2, ?3, ?4, ?5, ?6
+        WHERE EXISTS(SELECT 1 FROM post WHERE did = ?4 AND record = ?5)
+        ON CONFLICT DO NOTHING`,
+		ref.DID, ref.Rkey, ref.Kind, ref.SubjectDID, ref.SubjectRkey, time.Now().UnixMicro())
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		return err
+	}
+	if err := incrementSQLiteStat(ctx, tx, counter, ref.SubjectDID, ref.SubjectRkey, 1); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReconcilePostStats recounts the engagement of posts indexed since the given time
+// and repairs counters that drifted, returning the number of repaired posts
+func (d *dbSQLite) ReconcilePostStats(ctx context.Context, since time.Time) (int64, error) {
+	result, err := d.db.ExecContext(ctx, `
+        INSERT INTO post_stats AS s (did, record, likes, reposts, quotes, replies)
+        SELECT p.did, p.record,
+            (SELECT COUNT(*) FROM post_like l WHERE l.subject_did = p.did AND l.subject_rkey = p.record),
+            (SELECT COUNT(*) FROM post_repost r WHERE r.subject_did = p.did AND r.subject_rkey = p.record),
+            (SELECT COUNT(*) FROM post_reference r WHERE r.subject_did = p.did AND r.subject_rkey = p.record AND r.kind = ?2),
+            (SELECT COUNT(*) FROM post_reference r WHERE r.subject_did = p.did AND r.subject_rkey = p.record AND r.kind = ?3)
+        FROM post p
+        WHERE p.indexed_at >= ?1
+        ON CONFLICT (did, record) DO UPDATE
+        SET likes = excluded.likes, reposts = excluded.reposts, quotes = excluded.quotes, replies = excluded.replies
+        WHERE s.likes != excluded.likes OR s.reposts != excluded.reposts
+            OR s.quotes != excluded.quotes OR s.replies != excluded.replies`,
+		since.UnixMicro(), ReferenceQuote, ReferenceReply)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
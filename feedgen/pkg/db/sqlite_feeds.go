@@ -0,0 +1,421 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MostRecentWithCursor returns the most recent posts by key after the cursor, a nil cursor starts at the top
+func (d *dbSQLite) MostRecentWithCursor(ctx context.Context, key TimeKey, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	column, err := key.column()
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`
+        SELECT did, record, %[1]s, 0.0
+        FROM post
+        WHERE ?1 IS NULL OR (%[1]s, did, record) < (?1, ?2, ?3)
+        ORDER BY %[1]s DESC, did DESC, record DESC
+        LIMIT ?4`, column)
+
+	var after *int64
+	var did, rkey string
+	if cursor != nil {
+		micros := cursor.Time.UnixMicro()
+		after, did, rkey = &micros, cursor.DID, cursor.Rkey
+	}
+	return d.queryFeed(ctx, query, after, did, rkey, limit)
+}
+
+// MostPopularWithCursor returns the most liked posts after the cursor, a nil cursor starts at the top
+func (d *dbSQLite) MostPopularWithCursor(ctx context.Context, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	query := `
+        SELECT s.did, s.record, p.indexed_at, CAST(s.likes AS REAL)
+        FROM post_stats s
+        JOIN post p ON p.did = s.did AND p.record = s.record
+        WHERE ?1 IS NULL OR (s.likes, s.did, s.record) < (?1, ?2, ?3)
+        ORDER BY s.likes DESC, s.did DESC, s.record DESC
+        LIMIT ?4`
+
+	var after *int64
+	var did, rkey string
+	if cursor != nil {
+		likes := int64(cursor.Score)
+		after, did, rkey = &likes, cursor.DID, cursor.Rkey
+	}
+	return d.queryFeed(ctx, query, after, did, rkey, limit)
+}
+
+// HotWithCursor returns posts ranked by time decayed engagement after the cursor,
+// a nil cursor starts at the top. See the Postgres implementation for how posts are scored.
+func (d *dbSQLite) HotWithCursor(ctx context.Context, params HotParams, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	query := `
+        SELECT did, record, indexed_at, score
+        FROM (
+            SELECT s.did, s.record, p.indexed_at,
+                ln(?4 * s.likes + ?5 * s.reposts + 1) / ln(2)
+                    + p.indexed_at / 1000000.0 / ?6
+                    + ?7 * COALESCE(v.score, 0) AS score
+            FROM post p
+            JOIN post_stats s ON s.did = p.did AND s.record = p.record
+            LEFT JOIN post_velocity v ON v.did = p.did AND v.record = p.record
+            WHERE p.indexed_at >= ?8
+        ) ranked
+        WHERE ?1 IS NULL OR (score, did, record) < (?1, ?2, ?3)
+        ORDER BY score DESC, did DESC, record DESC
+        LIMIT ?9`
+
+	var after *float64
+	var did, rkey string
+	if cursor != nil {
+		after, did, rkey = &cursor.Score, cursor.DID, cursor.Rkey
+	}
+	halfLife := params.HalfLifeHours * time.Hour.Seconds()
+	maxAge := time.Duration(params.MaxAgeHours * float64(time.Hour))
+	return d.queryFeed(ctx, query, after, did, rkey, params.LikeWeight, params.RepostWeight, halfLife,
+		params.RisingWeight, time.Now().Add(-maxAge).UnixMicro(), limit)
+}
+
+// TopSinceWithCursor returns posts ranked by the likes and reposts they received
+// since the given time, after the cursor. A nil cursor starts at the top.
+func (d *dbSQLite) TopSinceWithCursor(ctx context.Context, since time.Time, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	query := `
+        SELECT did, record, indexed_at, score
+        FROM (
+            SELECT p.did, p.record, p.indexed_at, CAST(COUNT(*) AS REAL) AS score
+            FROM (
+                SELECT subject_did, subject_rkey FROM post_like WHERE indexed_at >= ?4
+                UNION ALL
+                SELECT subject_did, subject_rkey FROM post_repost WHERE indexed_at >= ?4
+            ) e
+            JOIN post p ON p.did = e.subject_did AND p.record = e.subject_rkey
+            GROUP BY p.did, p.record, p.indexed_at
+        ) ranked
+        WHERE ?1 IS NULL OR (score, did, record) < (?1, ?2, ?3)
+        ORDER BY score DESC, did DESC, record DESC
+        LIMIT ?5`
+
+	var after *float64
+	var did, rkey string
+	if cursor != nil {
+		after, did, rkey = &cursor.Score, cursor.DID, cursor.Rkey
+	}
+	return d.queryFeed(ctx, query, after, did, rkey, since.UnixMicro(), limit)
+}
+
+// RisingWithCursor returns posts with accelerating engagement ranked by their
+// velocity score after the cursor, a nil cursor starts at the top
+func (d *dbSQLite) RisingWithCursor(ctx context.Context, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	query := `
+        SELECT v.did, v.record, p.indexed_at, v.score
+        FROM post_velocity v
+        JOIN post p ON p.did = v.did AND p.record = v.record
+        WHERE v.score > 0 AND (?1 IS NULL OR (v.score, v.did, v.record) < (?1, ?2, ?3))
+        ORDER BY v.score DESC, v.did DESC, v.record DESC
+        LIMIT ?4`
+
+	var after *float64
+	var did, rkey string
+	if cursor != nil {
+		after, did, rkey = &cursor.Score, cursor.DID, cursor.Rkey
+	}
+	return d.queryFeed(ctx, query, after, did, rkey, limit)
+}
+
+// queryFeed runs a feed query selecting did, record, indexed_at and score
+func (d *dbSQLite) queryFeed(ctx context.Context, query string, args ...any) ([]FeedPost, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []FeedPost
+	for rows.Next() {
+		var post FeedPost
+		var indexedAt int64
+		if err := rows.Scan(&post.DID, &post.Rkey, &indexedAt, &post.Score); err != nil {
+			return nil, err
+		}
+		post.Time = time.UnixMicro(indexedAt)
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+// ReplaceVelocities stores the velocities of all posts currently tracked,
+// dropping velocities of posts that are no longer tracked
+func (d *dbSQLite) ReplaceVelocities(ctx context.Context, velocities []Velocity) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixMicro()
+	stmt, err := tx.PrepareContext(ctx, `
+        INSERT INTO post_velocity (did, record, recent_rate, baseline_rate, score, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+        ON CONFLICT (did, record) DO UPDATE
+        SET recent_rate = excluded.recent_rate, baseline_rate = excluded.baseline_rate,
+            score = excluded.score, updated_at = excluded.updated_at`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, v := range velocities {
+		if _, err := stmt.ExecContext(ctx, v.DID, v.Rkey, v.RecentRate, v.BaselineRate, v.Score, now); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM post_velocity WHERE updated_at < ?", now)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// sqlitePostJSON selects a post row as a JSON object for archiving, in the shape Postgres' row_to_json produces
+const sqlitePostJSON = `json_object('did', did, 'record', record, 'uri', uri, 'at_uri', at_uri, 'cid', cid,
+    'created_at', strftime('%Y-%m-%dT%H:%M:%fZ', created_at / 1000000.0, 'unixepoch'), 'text', text,
+    'langs', json(langs), 'image_cids', json(image_cids), 'alt_texts', json(alt_texts), 'labels', json(labels),
+    'confidence', confidence, 'is_reply', json(CASE WHEN is_reply THEN 'true' ELSE 'false' END),
+    'is_quote', json(CASE WHEN is_quote THEN 'true' ELSE 'false' END), 'self_labels', json(self_labels),
+    'indexed_at', strftime('%Y-%m-%dT%H:%M:%fZ', indexed_at / 1000000.0, 'unixepoch'))`
+
+// PrunePosts deletes up to limit posts indexed before the given time, along with their
+// counters, references and engagement. Posts that were liked or reposted since protectSince
+// are kept, a zero protectSince protects nothing. It returns the number of pruned posts.
+func (d *dbSQLite) PrunePosts(ctx context.Context, before, protectSince time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	var protect *int64
+	if !protectSince.IsZero() {
+		micros := protectSince.UnixMicro()
+		protect = &micros
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+        DELETE FROM post WHERE rowid IN (
+            SELECT p.rowid FROM post p
+            WHERE p.indexed_at < ?1
+                AND (?2 IS NULL OR (
+                    NOT EXISTS (SELECT 1 FROM post_like l WHERE l.subject_did = p.did AND l.subject_rkey = p.record AND l.indexed_at >= ?2)
+                    AND NOT EXISTS (SELECT 1 FROM post_repost r WHERE r.subject_did = p.did AND r.subject_rkey = p.record AND r.indexed_at >= ?2)))
+            ORDER BY p.indexed_at
+            LIMIT ?3
+        )
+        RETURNING did, record, `+sqlitePostJSON,
+		before.UnixMicro(), protect, limit)
+	if err != nil {
+		return 0, err
+	}
+	var keys [][2]string
+	var archived []json.RawMessage
+	for rows.Next() {
+		var did, rkey, row string
+		if err := rows.Scan(&did, &rkey, &row); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys, archived = append(keys, [2]string{did, rkey}), append(archived, json.RawMessage(row))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	// the engagement and counters of pruned posts are of no use without the post
+	for _, query := range []string{
+		"DELETE FROM post_stats WHERE did = ?1 AND record = ?2",
+		"DELETE FROM post_velocity WHERE did = ?1 AND record = ?2",
+		"DELETE FROM post_reference WHERE (did = ?1 AND record = ?2) OR (subject_did = ?1 AND subject_rkey = ?2)",
+		"DELETE FROM post_like WHERE subject_did = ?1 AND subject_rkey = ?2",
+		"DELETE FROM post_repost WHERE subject_did = ?1 AND subject_rkey = ?2",
+	} {
+		for _, key := range keys {
+			if _, err := tx.ExecContext(ctx, query, key[0], key[1]); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if archive != nil {
+		if err := archive(archived); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(keys)), tx.Commit()
+}
+
+// PruneLikes deletes up to limit likes indexed before the given time, returning the number of pruned likes
+// The like counters of the subjects are kept.
+func (d *dbSQLite) PruneLikes(ctx context.Context, before time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	return d.pruneEngagement(ctx, "post_like", before, limit, archive)
+}
+
+// PruneReposts deletes up to limit reposts indexed before the given time, returning the number of pruned reposts
+// The repost counters of the subjects are kept.
+func (d *dbSQLite) PruneReposts(ctx context.Context, before time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	return d.pruneEngagement(ctx, "post_repost", before, limit, archive)
+}
+
+func (d *dbSQLite) pruneEngagement(ctx context.Context, table string, before time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+        DELETE FROM `+table+` WHERE rowid IN (
+            SELECT rowid FROM `+table+`
+            WHERE indexed_at < ?
+            ORDER BY indexed_at
+            LIMIT ?
+        )
+        RETURNING json_object('did', did, 'record', record, 'subject_did', subject_did, 'subject_rkey', subject_rkey,
+            'indexed_at', strftime('%Y-%m-%dT%H:%M:%fZ', indexed_at / 1000000.0, 'unixepoch'))`,
+		before.UnixMicro(), limit)
+	if err != nil {
+		return 0, err
+	}
+	archived, err := scanJSONRows(rows)
+	if err != nil {
+		return 0, err
+	}
+	if len(archived) == 0 {
+		return 0, nil
+	}
+
+	if archive != nil {
+		if err := archive(archived); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(archived)), tx.Commit()
+}
+
+// sqliteOrphans select up to ? rowids of rows whose post is not indexed, by table
+var sqliteOrphans = []struct{ table, query string }{
+	{"post_like", `SELECT rowid FROM post_like e
+        WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = e.subject_did AND p.record = e.subject_rkey) LIMIT ?`},
+	{"post_repost", `SELECT rowid FROM post_repost e
+        WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = e.subject_did AND p.record = e.subject_rkey) LIMIT ?`},
+	{"post_reference", `SELECT rowid FROM post_reference r
+        WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = r.subject_did AND p.record = r.subject_rkey) LIMIT ?`},
+	{"post_stats", `SELECT rowid FROM post_stats s
+        WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = s.did AND p.record = s.record) LIMIT ?`},
+	{"post_velocity", `SELECT rowid FROM post_velocity v
+        WHERE NOT EXISTS (SELECT 1 FROM post p WHERE p.did = v.did AND p.record = v.record) LIMIT ?`},
+}
+
+// PruneOrphans deletes up to limit rows left behind by posts that are no longer indexed.
+// Their posts are gone, so there are no counters to update.
+func (d *dbSQLite) PruneOrphans(ctx context.Context, limit int64) (int64, error) {
+	var pruned int64
+	for _, orphans := range sqliteOrphans {
+		if pruned >= limit {
+			break
+		}
+		result, err := d.db.ExecContext(ctx, "DELETE FROM "+orphans.table+" WHERE rowid IN ("+orphans.query+")", limit-pruned)
+		if err != nil {
+			return pruned, fmt.Errorf("failed to prune orphaned %s rows: %w", orphans.table, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return pruned, err
+		}
+		pruned += n
+	}
+	return pruned, nil
+}
+
+func scanJSONRows(rows *sql.Rows) ([]json.RawMessage, error) {
+	defer rows.Close()
+	var values []json.RawMessage
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, json.RawMessage(value))
+	}
+	return values, rows.Err()
+}
+
+// SaveFeedSnapshot stores a ranked snapshot of a feed under a version, saving a version twice keeps the first
+func (d *dbSQLite) SaveFeedSnapshot(ctx context.Context, feed string, version int64, posts []FeedPost) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+        INSERT INTO feed_snapshot (feed, version, position, did, record, indexed_at, score)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (feed, version, position) DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, post := range posts {
+		if _, err := stmt.ExecContext(ctx, feed, version, i, post.DID, post.Rkey, post.Time.UnixMicro(), post.Score); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// FeedSnapshot returns the posts of a snapshot version in ranked order
+func (d *dbSQLite) FeedSnapshot(ctx context.Context, feed string, version int64) ([]FeedPost, error) {
+	posts, err := d.queryFeed(ctx, `
+        SELECT did, record, indexed_at, score FROM feed_snapshot
+        WHERE feed = ? AND version = ?
+        ORDER BY position`, feed, version)
+	if err != nil {
+		return nil, err
+	}
+	// a snapshot without posts is never saved, so no rows means the version doesn't exist
+	if len(posts) == 0 {
+		return nil, ErrNotFound
+	}
+	return posts, nil
+}
+
+// LatestFeedSnapshot returns the newest snapshot version of a feed and its posts
+func (d *dbSQLite) LatestFeedSnapshot(ctx context.Context, feed string) (int64, []FeedPost, error) {
+	var version int64
+	err := d.db.QueryRowContext(ctx, "SELECT version FROM feed_snapshot WHERE feed = ? ORDER BY version DESC LIMIT 1", feed).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil, ErrNotFound
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	posts, err := d.FeedSnapshot(ctx, feed, version)
+	return version, posts, err
+}
+
+// PruneFeedSnapshots deletes the snapshots of a feed older than the given version
+func (d *dbSQLite) PruneFeedSnapshots(ctx context.Context, feed string, before int64) (int64, error) {
+	result, err := d.db.ExecContext(ctx, "DELETE FROM feed_snapshot WHERE feed = ? AND version < ?", feed, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
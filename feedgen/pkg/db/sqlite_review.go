@@ -0,0 +1,187 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+func (d *dbSQLite) LogClassification(ctx context.Context, entry ClassificationLog) error {
+	_, err := d.db.ExecContext(ctx, `
+        INSERT INTO classification_log (post_uri, image_cid, label, confidence, model, role, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		entry.PostURI, entry.ImageCID, entry.Label, entry.Confidence, entry.Model, entry.Role, entry.CreatedAt.UnixMicro())
+	return err
+}
+
+func (d *dbSQLite) ClassificationScores(ctx context.Context, label string, since time.Time) ([]ClassificationScore, error) {
+	query := `
+        SELECT post_uri,
+            MAX(CASE WHEN label = ?1 THEN confidence ELSE 0 END) FILTER (WHERE role = ?2),
+            MAX(CASE WHEN label = ?1 THEN confidence ELSE 0 END) FILTER (WHERE role = ?3)
+        FROM classification_log
+        WHERE created_at >= ?4
+        GROUP BY post_uri`
+
+	rows, err := d.db.QueryContext(ctx, query, label, ClassifierPrimary, ClassifierCandidate, since.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var scores []ClassificationScore
+	for rows.Next() {
+		var score ClassificationScore
+		if err := rows.Scan(&score.PostURI, &score.Primary, &score.Candidate); err != nil {
+			return nil, err
+		}
+		scores = append(scores, score)
+	}
+	return scores, rows.Err()
+}
+
+func scanSQLiteReviewItem(row interface{ Scan(dest ...any) error }) (*ReviewItem, error) {
+	var item ReviewItem
+	var createdAt int64
+	var decidedAt *int64
+	var post *string
+	err := row.Scan(&item.ID, &item.PostURI, &item.URI, &item.Rkey, &item.DID, &item.ImageCID, &item.Label,
+		&item.Confidence, &item.Model, &item.Status, &createdAt, &decidedAt, &item.DecidedBy, &post)
+	if err != nil {
+		return nil, err
+	}
+	item.CreatedAt = time.UnixMicro(createdAt)
+	if decidedAt != nil {
+		t := time.UnixMicro(*decidedAt)
+		item.DecidedAt = &t
+	}
+	if post != nil {
+		if err := json.Unmarshal([]byte(*post), &item.Post); err != nil {
+			return nil, err
+		}
+	}
+	return &item, nil
+}
+
+// AddReviewItem queues a post for review, posts that are already queued are ignored
+func (d *dbSQLite) AddReviewItem(ctx context.Context, item ReviewItem) error {
+	var post *string
+	if item.Post != nil {
+		encoded, err := json.Marshal(item.Post)
+		if err != nil {
+			return err
+		}
+		s := string(encoded)
+		post = &s
+	}
+	_, err := d.db.ExecContext(ctx, `
+        INSERT INTO review_queue (post_uri, uri, record, did, image_cid, label, confidence, model, status, created_at, post)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (post_uri) DO NOTHING`,
+		item.PostURI, item.URI, item.Rkey, item.DID, item.ImageCID, item.Label, item.Confidence, item.Model, ReviewPending, time.Now().UnixMicro(), post)
+	return err
+}
+
+// ReviewItems lists review items with the given status, oldest first
+// The cursor is the ID of the last item of the previous page
+func (d *dbSQLite) ReviewItems(ctx context.Context, status string, limit int64, cursor int64) ([]ReviewItem, error) {
+	rows, err := d.db.QueryContext(ctx, `SELECT `+reviewItemColumns+` FROM review_queue WHERE status = ? AND id > ? ORDER BY id LIMIT ?`,
+		status, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []ReviewItem
+	for rows.Next() {
+		item, err := scanSQLiteReviewItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *item)
+	}
+	return items, rows.Err()
+}
+
+// DecideReviewItem approves or rejects a pending review item and logs the decision
+// Approved posts are added to the feed. ErrNotFound is returned if there is no pending item with the ID.
+func (d *dbSQLite) DecideReviewItem(ctx context.Context, id int64, decision, reviewer string) (*ReviewItem, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	item, err := scanSQLiteReviewItem(tx.QueryRowContext(ctx, `
+        UPDATE review_queue SET status = ?, decided_at = ?, decided_by = ?
+        WHERE id = ? AND status = ?
+        RETURNING `+reviewItemColumns,
+		decision, now.UnixMicro(), reviewer, id, ReviewPending))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO review_decision (review_id, image_cid, label, confidence, model, decision, decided_by, decided_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		item.ID, item.ImageCID, item.Label, item.Confidence, item.Model, decision, reviewer, now.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+
+	if decision == ReviewApproved {
+		post := Post{
+			DID:   item.DID,
+			Rkey:  item.Rkey,
+			URI:   item.URI,
+			ATURI: item.PostURI,
+		}
+		if item.Post != nil {
+			post = *item.Post
+		}
+		// the reviewer's decision replaces the classifier result
+		post.Labels = []string{item.Label}
+		post.Confidence = 1
+		if err := insertSQLitePost(ctx, tx, post, now); err != nil {
+			return nil, err
+		}
+	}
+
+	return item, tx.Commit()
+}
+
+// ImageDecision returns the most recent review decision for an image, or an empty string
+// if the image has never been reviewed
+func (d *dbSQLite) ImageDecision(ctx context.Context, imageCID string) (string, error) {
+	var decision string
+	err := d.db.QueryRowContext(ctx, "SELECT decision FROM review_decision WHERE image_cid = ? ORDER BY decided_at DESC LIMIT 1", imageCID).Scan(&decision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return decision, err
+}
+
+// GetSetting returns the JSON value of a runtime setting, or ErrNotFound if it was never set
+func (d *dbSQLite) GetSetting(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := d.db.QueryRowContext(ctx, "SELECT value FROM setting WHERE key = ?", key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+// PutSetting stores the JSON value of a runtime setting
+func (d *dbSQLite) PutSetting(ctx context.Context, key string, value []byte) error {
+	_, err := d.db.ExecContext(ctx, `
+        INSERT INTO setting (key, value, updated_at) VALUES (?, ?, ?)
+        ON CONFLICT (key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		key, string(value), time.Now().UnixMicro())
+	return err
+}
@@ -0,0 +1,21 @@
+package db_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db/dbtest"
+)
+
+func TestSQLite(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) db.DB {
+		t.Setenv("DATABASE_URL", "sqlite://"+filepath.Join(t.TempDir(), "feedgen.db"))
+		d, err := db.NewDB(context.Background())
+		if err != nil {
+			t.Fatalf("NewDB: %v", err)
+		}
+		return d
+	})
+}
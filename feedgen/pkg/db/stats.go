@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Kinds of references between posts that are counted in post_stats
+const (
+	ReferenceReply = "reply"
+	ReferenceQuote = "quote"
+)
+
+// Reference is a post replying to or quoting another post
+type Reference struct {
+	DID         string
+	Rkey        string
+	Kind        string
+	SubjectDID  string
+	SubjectRkey string
+}
+
+// referenceCounters maps reference kinds to their post_stats column
+var referenceCounters = map[string]string{
+	ReferenceReply: "replies",
+	ReferenceQuote: "quotes",
+}
+
+// incrementStat adds delta to a post_stats counter of a post
+func incrementStat(ctx context.Context, db execer, counter, did, rkey string, delta int64) error {
+	_, err := db.Exec(ctx, "UPDATE post_stats SET "+counter+" = "+counter+" + $1 WHERE did = $2 AND record = $3", delta, did, rkey)
+	return err
+}
+
+// AddReference stores a reply or quote if its subject is an indexed post, and
+// increments the subject's counter in the same transaction
+func (d *dbPostgres) AddReference(ctx context.Context, ref Reference) error {
+	counter, ok := referenceCounters[ref.Kind]
+	if !ok {
+		return fmt.Errorf("unknown reference kind: %s", ref.Kind)
+	}
+
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `
+        INSERT INTO post_reference (did, record, kind, subject_did, subject_rkey, indexed_at)
+        SELECT $1, $2, $3, $4, $5, $6
+        WHERE EXISTS(SELECT 1 FROM post WHERE did = $4 AND record = $5)
+        ON CONFLICT DO NOTHING`,
+		ref.DID, ref.Rkey, ref.Kind, ref.SubjectDID, ref.SubjectRkey, time.Now())
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+	if err := incrementStat(ctx, tx, counter, ref.SubjectDID, ref.SubjectRkey, 1); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ReconcilePostStats recounts the engagement of posts indexed since the given time
+// and repairs counters that drifted, returning the number of repaired posts
+func (d *dbPostgres) ReconcilePostStats(ctx context.Context, since time.Time) (int64, error) {
+	tag, err := d.db.Exec(ctx, `
+        INSERT INTO post_stats AS s (did, record, likes, reposts, quotes, replies)
+        SELECT p.did, p.record,
+            (SELECT COUNT(*) FROM post_like l WHERE l.subject_did = p.did AND l.subject_rkey = p.record),
+            (SELECT COUNT(*) FROM post_repost r WHERE r.subject_did = p.did AND r.subject_rkey = p.record),
+            (SELECT COUNT(*) FROM post_reference r WHERE r.subject_did = p.did AND r.subject_rkey = p.record AND r.kind = $2),
+            (SELECT COUNT(*) FROM post_reference r WHERE r.subject_did = p.did AND r.subject_rkey = p.record AND r.kind = $3)
+        FROM post p
+        WHERE p.indexed_at >= $1
+        ON CONFLICT (did, record) DO UPDATE
+        SET likes = EXCLUDED.likes, reposts = EXCLUDED.reposts, quotes = EXCLUDED.quotes, replies = EXCLUDED.replies
+        WHERE (s.likes, s.reposts, s.quotes, s.replies) IS DISTINCT FROM
+            (EXCLUDED.likes, EXCLUDED.reposts, EXCLUDED.quotes, EXCLUDED.replies)`,
+		since, ReferenceQuote, ReferenceReply)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
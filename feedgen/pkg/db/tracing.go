@@ -0,0 +1,341 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "feedgen_db_query_duration_seconds",
+	Help:    "Duration of DB calls by method",
+	Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+}, []string{"method"})
+
+var queryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_db_query_errors_total",
+	Help: "Number of DB calls that returned an error, by method",
+}, []string{"method"})
+
+// queryTracer traces every Postgres query as a child span of the DB call that ran it
+type queryTracer struct{}
+
+func (queryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	ctx, _ = otel.Tracer("db").Start(ctx, "DB:Query", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.statement", data.SQL),
+	))
+	return ctx
+}
+
+func (queryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	span := trace.SpanFromContext(ctx)
+	if data.Err != nil {
+		span.RecordError(data.Err)
+		span.SetStatus(codes.Error, data.Err.Error())
+	} else {
+		span.SetAttributes(attribute.Int64("db.rows_affected", data.CommandTag.RowsAffected()))
+	}
+	span.End()
+}
+
+// instrumented wraps a DB, tracing every call and recording its duration
+type instrumented struct {
+	db DB
+}
+
+// Instrument wraps a DB so every call starts a span under the caller's context
+// and is recorded in feedgen_db_query_duration_seconds
+func Instrument(d DB) DB {
+	if _, ok := d.(*instrumented); ok {
+		return d
+	}
+	return &instrumented{db: d}
+}
+
+func (i *instrumented) start(ctx context.Context, method string) (context.Context, func(error)) {
+	ctx, span := otel.Tracer("db").Start(ctx, "DB:"+method)
+	start := time.Now()
+	return ctx, func(err error) {
+		queryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		if err != nil {
+			queryErrors.WithLabelValues(method).Inc()
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func (i *instrumented) Ping(ctx context.Context) error {
+	ctx, done := i.start(ctx, "Ping")
+	err := i.db.Ping(ctx)
+	done(err)
+	return err
+}
+
+func (i *instrumented) SchemaStatus(ctx context.Context) (SchemaStatus, error) {
+	ctx, done := i.start(ctx, "SchemaStatus")
+	status, err := i.db.SchemaStatus(ctx)
+	done(err)
+	return status, err
+}
+
+func (i *instrumented) AddPost(ctx context.Context, post Post) error {
+	ctx, done := i.start(ctx, "AddPost")
+	err := i.db.AddPost(ctx, post)
+	done(err)
+	return err
+}
+
+func (i *instrumented) GetPost(ctx context.Context, did, rkey string) (*Post, error) {
+	ctx, done := i.start(ctx, "GetPost")
+	result, err := i.db.GetPost(ctx, did, rkey)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) DeletePost(ctx context.Context, did, rkey string) error {
+	ctx, done := i.start(ctx, "DeletePost")
+	err := i.db.DeletePost(ctx, did, rkey)
+	done(err)
+	return err
+}
+
+func (i *instrumented) AddLike(ctx context.Context, like Engagement) (bool, error) {
+	ctx, done := i.start(ctx, "AddLike")
+	result, err := i.db.AddLike(ctx, like)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) DeleteLike(ctx context.Context, did, rkey string) error {
+	ctx, done := i.start(ctx, "DeleteLike")
+	err := i.db.DeleteLike(ctx, did, rkey)
+	done(err)
+	return err
+}
+
+func (i *instrumented) AddRepost(ctx context.Context, repost Engagement) (bool, error) {
+	ctx, done := i.start(ctx, "AddRepost")
+	result, err := i.db.AddRepost(ctx, repost)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) DeleteRepost(ctx context.Context, did, rkey string) error {
+	ctx, done := i.start(ctx, "DeleteRepost")
+	err := i.db.DeleteRepost(ctx, did, rkey)
+	done(err)
+	return err
+}
+
+func (i *instrumented) AddLikes(ctx context.Context, likes []Engagement) (int64, error) {
+	ctx, done := i.start(ctx, "AddLikes")
+	result, err := i.db.AddLikes(ctx, likes)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) DeleteLikes(ctx context.Context, keys []RecordKey) (int64, error) {
+	ctx, done := i.start(ctx, "DeleteLikes")
+	result, err := i.db.DeleteLikes(ctx, keys)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) AddReposts(ctx context.Context, reposts []Engagement) (int64, error) {
+	ctx, done := i.start(ctx, "AddReposts")
+	result, err := i.db.AddReposts(ctx, reposts)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) DeleteReposts(ctx context.Context, keys []RecordKey) (int64, error) {
+	ctx, done := i.start(ctx, "DeleteReposts")
+	result, err := i.db.DeleteReposts(ctx, keys)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) PostKeys(ctx context.Context) ([]RecordKey, error) {
+	ctx, done := i.start(ctx, "PostKeys")
+	result, err := i.db.PostKeys(ctx)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) AddReference(ctx context.Context, ref Reference) error {
+	ctx, done := i.start(ctx, "AddReference")
+	err := i.db.AddReference(ctx, ref)
+	done(err)
+	return err
+}
+
+func (i *instrumented) ReconcilePostStats(ctx context.Context, since time.Time) (int64, error) {
+	ctx, done := i.start(ctx, "ReconcilePostStats")
+	result, err := i.db.ReconcilePostStats(ctx, since)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) PrunePosts(ctx context.Context, before, protectSince time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	ctx, done := i.start(ctx, "PrunePosts")
+	result, err := i.db.PrunePosts(ctx, before, protectSince, limit, archive)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) PruneLikes(ctx context.Context, before time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	ctx, done := i.start(ctx, "PruneLikes")
+	result, err := i.db.PruneLikes(ctx, before, limit, archive)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) PruneReposts(ctx context.Context, before time.Time, limit int64, archive ArchiveFunc) (int64, error) {
+	ctx, done := i.start(ctx, "PruneReposts")
+	result, err := i.db.PruneReposts(ctx, before, limit, archive)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) PruneOrphans(ctx context.Context, limit int64) (int64, error) {
+	ctx, done := i.start(ctx, "PruneOrphans")
+	result, err := i.db.PruneOrphans(ctx, limit)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) MostRecentWithCursor(ctx context.Context, key TimeKey, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	ctx, done := i.start(ctx, "MostRecentWithCursor")
+	result, err := i.db.MostRecentWithCursor(ctx, key, limit, cursor)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) MostPopularWithCursor(ctx context.Context, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	ctx, done := i.start(ctx, "MostPopularWithCursor")
+	result, err := i.db.MostPopularWithCursor(ctx, limit, cursor)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) HotWithCursor(ctx context.Context, params HotParams, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	ctx, done := i.start(ctx, "HotWithCursor")
+	result, err := i.db.HotWithCursor(ctx, params, limit, cursor)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) TopSinceWithCursor(ctx context.Context, since time.Time, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	ctx, done := i.start(ctx, "TopSinceWithCursor")
+	result, err := i.db.TopSinceWithCursor(ctx, since, limit, cursor)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) RisingWithCursor(ctx context.Context, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	ctx, done := i.start(ctx, "RisingWithCursor")
+	result, err := i.db.RisingWithCursor(ctx, limit, cursor)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) ReplaceVelocities(ctx context.Context, velocities []Velocity) error {
+	ctx, done := i.start(ctx, "ReplaceVelocities")
+	err := i.db.ReplaceVelocities(ctx, velocities)
+	done(err)
+	return err
+}
+
+func (i *instrumented) SaveFeedSnapshot(ctx context.Context, feed string, version int64, posts []FeedPost) error {
+	ctx, done := i.start(ctx, "SaveFeedSnapshot")
+	err := i.db.SaveFeedSnapshot(ctx, feed, version, posts)
+	done(err)
+	return err
+}
+
+func (i *instrumented) FeedSnapshot(ctx context.Context, feed string, version int64) ([]FeedPost, error) {
+	ctx, done := i.start(ctx, "FeedSnapshot")
+	result, err := i.db.FeedSnapshot(ctx, feed, version)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) LatestFeedSnapshot(ctx context.Context, feed string) (int64, []FeedPost, error) {
+	ctx, done := i.start(ctx, "LatestFeedSnapshot")
+	version, result, err := i.db.LatestFeedSnapshot(ctx, feed)
+	done(err)
+	return version, result, err
+}
+
+func (i *instrumented) PruneFeedSnapshots(ctx context.Context, feed string, before int64) (int64, error) {
+	ctx, done := i.start(ctx, "PruneFeedSnapshots")
+	result, err := i.db.PruneFeedSnapshots(ctx, feed, before)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) LogClassification(ctx context.Context, entry ClassificationLog) error {
+	ctx, done := i.start(ctx, "LogClassification")
+	err := i.db.LogClassification(ctx, entry)
+	done(err)
+	return err
+}
+
+func (i *instrumented) ClassificationScores(ctx context.Context, label string, since time.Time) ([]ClassificationScore, error) {
+	ctx, done := i.start(ctx, "ClassificationScores")
+	result, err := i.db.ClassificationScores(ctx, label, since)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) AddReviewItem(ctx context.Context, item ReviewItem) error {
+	ctx, done := i.start(ctx, "AddReviewItem")
+	err := i.db.AddReviewItem(ctx, item)
+	done(err)
+	return err
+}
+
+func (i *instrumented) ReviewItems(ctx context.Context, status string, limit int64, cursor int64) ([]ReviewItem, error) {
+	ctx, done := i.start(ctx, "ReviewItems")
+	result, err := i.db.ReviewItems(ctx, status, limit, cursor)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) DecideReviewItem(ctx context.Context, id int64, decision, reviewer string) (*ReviewItem, error) {
+	ctx, done := i.start(ctx, "DecideReviewItem")
+	result, err := i.db.DecideReviewItem(ctx, id, decision, reviewer)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) ImageDecision(ctx context.Context, imageCID string) (string, error) {
+	ctx, done := i.start(ctx, "ImageDecision")
+	result, err := i.db.ImageDecision(ctx, imageCID)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) GetSetting(ctx context.Context, key string) ([]byte, error) {
+	ctx, done := i.start(ctx, "GetSetting")
+	result, err := i.db.GetSetting(ctx, key)
+	done(err)
+	return result, err
+}
+
+func (i *instrumented) PutSetting(ctx context.Context, key string, value []byte) error {
+	ctx, done := i.start(ctx, "PutSetting")
+	err := i.db.PutSetting(ctx, key, value)
+	done(err)
+	return err
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Velocity is how fast a post is gaining likes and reposts, in engagements per hour
+type Velocity struct {
+	DID          string
+	Rkey         string
+	RecentRate   float64
+	BaselineRate float64
+	Score        float64
+}
+
+// ReplaceVelocities stores the velocities of all posts currently tracked,
+// dropping velocities of posts that are no longer tracked
+func (d *dbPostgres) ReplaceVelocities(ctx context.Context, velocities []Velocity) error {
+	dids := make([]string, len(velocities))
+	rkeys := make([]string, len(velocities))
+	recentRates := make([]float64, len(velocities))
+	baselineRates := make([]float64, len(velocities))
+	scores := make([]float64, len(velocities))
+	for i, v := range velocities {
+		dids[i], rkeys[i] = v.DID, v.Rkey
+		recentRates[i], baselineRates[i], scores[i] = v.RecentRate, v.BaselineRate, v.Score
+	}
+
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	_, err = tx.Exec(ctx, `
+        INSERT INTO post_velocity (did, record, recent_rate, baseline_rate, score, updated_at)
+        SELECT v.did, v.record, v.recent_rate, v.baseline_rate, v.score, $6
+        FROM unnest($1::varchar[], $2::varchar[], $3::float8[], $4::float8[], $5::float8[])
+            AS v(did, record, recent_rate, baseline_rate, score)
+        ON CONFLICT (did, record) DO UPDATE
+        SET recent_rate = EXCLUDED.recent_rate, baseline_rate = EXCLUDED.baseline_rate,
+            score = EXCLUDED.score, updated_at = EXCLUDED.updated_at`,
+		dids, rkeys, recentRates, baselineRates, scores, now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "DELETE FROM post_velocity WHERE updated_at < $1", now)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// RisingWithCursor returns posts with accelerating engagement ranked by their
+// velocity score after the cursor, a nil cursor starts at the top
+func (d *dbPostgres) RisingWithCursor(ctx context.Context, limit int64, cursor *Cursor) ([]FeedPost, error) {
+	query := `
+        SELECT v.did, v.record, p.indexed_at, v.score
+        FROM post_velocity v
+        JOIN post p ON p.did = v.did AND p.record = v.record
+        WHERE v.score > 0 AND ($1::float8 IS NULL OR (v.score, v.did, v.record) < ($1, $2, $3))
+        ORDER BY v.score DESC, v.did DESC, v.record DESC
+        LIMIT $4`
+
+	var after *float64
+	var did, rkey string
+	if cursor != nil {
+		after, did, rkey = &cursor.Score, cursor.DID, cursor.Rkey
+	}
+	return d.queryFeed(ctx, query, after, did, rkey, limit)
+}
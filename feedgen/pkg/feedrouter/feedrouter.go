@@ -4,6 +4,7 @@ package feedrouter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
@@ -29,6 +30,10 @@ type NotFoundError struct {
 	error
 }
 
+// ErrInvalidCursor is wrapped by the errors feeds return for cursors they can't parse,
+// which are the client's fault
+var ErrInvalidCursor = errors.New("invalid cursor")
+
 // NewFeedRouter returns a new FeedRouter
 func NewFeedRouter(
 	ctx context.Context,
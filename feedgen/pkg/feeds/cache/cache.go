@@ -0,0 +1,120 @@
+// Package cache caches feed pages for a short time and coalesces concurrent requests
+// for the same page, so bursts of identical requests cost a single DB query.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feedrouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+var pageHits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_feed_cache_hits_total",
+	Help: "The total number of feed pages served from the cache",
+}, []string{"feed"})
+
+var pageMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_feed_cache_misses_total",
+	Help: "The total number of feed pages that were not cached",
+}, []string{"feed"})
+
+var pageCoalesced = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_feed_cache_coalesced_total",
+	Help: "The total number of cache misses answered by a fetch shared with identical concurrent requests",
+}, []string{"feed"})
+
+// fetchTimeout bounds a coalesced fetch, which keeps running when the request that started it is cancelled
+const fetchTimeout = 10 * time.Second
+
+type page struct {
+	posts  []*appbsky.FeedDefs_SkeletonFeedPost
+	cursor *string
+}
+
+// Cache holds pages of the feeds it wraps, keyed by feed, limit and cursor
+type Cache struct {
+	pages *expirable.LRU[string, page]
+	group singleflight.Group
+	// generation is part of every key, so pages fetched before an invalidation are never served after it
+	generation atomic.Uint64
+}
+
+// New returns a Cache holding up to size pages for ttl
+func New(size int, ttl time.Duration) (*Cache, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("feed cache size must be positive")
+	}
+	return &Cache{
+		pages: expirable.NewLRU[string, page](size, nil, ttl),
+	}, nil
+}
+
+// Invalidate drops every cached page, called when the subscriber in this process adds posts to the feeds.
+// Pages cached by other processes are only dropped when they expire.
+func (c *Cache) Invalidate() {
+	c.generation.Add(1)
+	c.pages.Purge()
+}
+
+// Wrap returns a feed serving pages of feed through the cache. Pages are shared
+// between users, so only feeds that aren't personalized may be wrapped.
+func (c *Cache) Wrap(feed feedrouter.Feed) feedrouter.Feed {
+	return &cachedFeed{Feed: feed, cache: c}
+}
+
+type cachedFeed struct {
+	feedrouter.Feed
+	cache *Cache
+}
+
+func (cf *cachedFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	span := trace.SpanFromContext(ctx)
+	key := fmt.Sprintf("%d|%s|%d|%s", cf.cache.generation.Load(), feed, limit, cursor)
+	if cached, ok := cf.cache.pages.Get(key); ok {
+		pageHits.WithLabelValues(feed).Inc()
+		span.SetAttributes(attribute.String("feed.cache", "hit"))
+		return cached.posts, cached.cursor, nil
+	}
+	pageMisses.WithLabelValues(feed).Inc()
+
+	// the fetch is shared by every request for the page, so it must not be cancelled with the first one
+	fetchCtx := context.WithoutCancel(ctx)
+	results := cf.cache.group.DoChan(key, func() (any, error) {
+		fetchCtx, cancel := context.WithTimeout(fetchCtx, fetchTimeout)
+		defer cancel()
+		posts, newCursor, err := cf.Feed.GetPage(fetchCtx, feed, userDID, limit, cursor)
+		if err != nil {
+			return nil, err
+		}
+		fetched := page{posts: posts, cursor: newCursor}
+		cf.cache.pages.Add(key, fetched)
+		return fetched, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case result := <-results:
+		if result.Shared {
+			pageCoalesced.WithLabelValues(feed).Inc()
+			span.SetAttributes(attribute.String("feed.cache", "coalesced"))
+		} else {
+			span.SetAttributes(attribute.String("feed.cache", "miss"))
+		}
+		if result.Err != nil {
+			return nil, nil, result.Err
+		}
+		fetched := result.Val.(page)
+		return fetched.posts, fetched.cursor, nil
+	}
+}
@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeFeed counts fetches and, when release is set, blocks every fetch until it is closed
+type fakeFeed struct {
+	calls   atomic.Int64
+	release chan struct{}
+}
+
+func (f *fakeFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	call := f.calls.Add(1)
+	if f.release != nil {
+		<-f.release
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	posts := []*appbsky.FeedDefs_SkeletonFeedPost{{Post: "at://post"}}
+	next := "next"
+	if call > 1 {
+		next = "refetched"
+	}
+	return posts, &next, nil
+}
+
+func (f *fakeFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	return nil, nil
+}
+
+func newCache(t *testing.T) *Cache {
+	t.Helper()
+	c, err := New(10, time.Minute)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return c
+}
+
+// waitForMisses waits until n more requests for a feed than before missed the cache and are about
+// to share a fetch. The metrics are global, so tests compare them with their value before the test.
+func waitForMisses(t *testing.T, feed string, before, n float64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(pageMisses.WithLabelValues(feed))-before < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v requests for %s didn't miss the cache", n, feed)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// let the last request join the fetch after counting its miss
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestConcurrentRequestsShareAFetch(t *testing.T) {
+	const feed, requests = "coalesced", 20
+	backend := &fakeFeed{release: make(chan struct{})}
+	cached := newCache(t).Wrap(backend)
+	misses := testutil.ToFloat64(pageMisses.WithLabelValues(feed))
+	coalesced := testutil.ToFloat64(pageCoalesced.WithLabelValues(feed))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			posts, cursor, err := cached.GetPage(context.Background(), feed, "did:plc:user", 30, "")
+			if err == nil && (len(posts) != 1 || cursor == nil || *cursor != "next") {
+				err = errors.New("unexpected page")
+			}
+			errs <- err
+		}()
+	}
+	waitForMisses(t, feed, misses, requests)
+	close(backend.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("GetPage: %v", err)
+		}
+	}
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Errorf("%d identical concurrent requests made %d fetches, want 1", requests, calls)
+	}
+	if coalesced := testutil.ToFloat64(pageCoalesced.WithLabelValues(feed)) - coalesced; coalesced != requests {
+		t.Errorf("coalesced requests = %v, want %d", coalesced, requests)
+	}
+
+	// the page is cached for the next request
+	if _, _, err := cached.GetPage(context.Background(), feed, "did:plc:other", 30, ""); err != nil {
+		t.Fatalf("GetPage: %v", err)
+	}
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Errorf("a cached page was fetched again, %d fetches", calls)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	const feed = "invalidated"
+	c := newCache(t)
+	backend := &fakeFeed{}
+	cached := c.Wrap(backend)
+	getPage := func() string {
+		t.Helper()
+		_, cursor, err := cached.GetPage(context.Background(), feed, "did:plc:user", 30, "")
+		if err != nil {
+			t.Fatalf("GetPage: %v", err)
+		}
+		return *cursor
+	}
+
+	getPage()
+	getPage()
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Fatalf("%d fetches before invalidating, want 1", calls)
+	}
+	c.Invalidate()
+	if cursor := getPage(); cursor != "refetched" || backend.calls.Load() != 2 {
+		t.Errorf("page after invalidating = %q after %d fetches, want a second fetch", cursor, backend.calls.Load())
+	}
+}
+
+func TestInvalidateDuringFetch(t *testing.T) {
+	const feed = "invalidated-during-fetch"
+	c := newCache(t)
+	backend := &fakeFeed{release: make(chan struct{})}
+	cached := c.Wrap(backend)
+	misses := testutil.ToFloat64(pageMisses.WithLabelValues(feed))
+
+	done := make(chan error)
+	go func() {
+		_, _, err := cached.GetPage(context.Background(), feed, "did:plc:user", 30, "")
+		done <- err
+	}()
+	waitForMisses(t, feed, misses, 1)
+	// the page being fetched may already miss the post added now, so it must not be served after
+	c.Invalidate()
+	close(backend.release)
+	if err := <-done; err != nil {
+		t.Fatalf("GetPage: %v", err)
+	}
+
+	_, cursor, err := cached.GetPage(context.Background(), feed, "did:plc:user", 30, "")
+	if err != nil {
+		t.Fatalf("GetPage: %v", err)
+	}
+	if *cursor != "refetched" || backend.calls.Load() != 2 {
+		t.Errorf("page fetched before invalidating was served after it, %d fetches", backend.calls.Load())
+	}
+}
+
+func TestCancelledRequestDoesNotFailOthers(t *testing.T) {
+	const feed = "cancelled"
+	backend := &fakeFeed{release: make(chan struct{})}
+	cached := newCache(t).Wrap(backend)
+	misses := testutil.ToFloat64(pageMisses.WithLabelValues(feed))
+
+	// the first request starts the fetch and gives up on it
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, _, err := cached.GetPage(cancelledCtx, feed, "did:plc:impatient", 30, "")
+		cancelled <- err
+	}()
+	waitForMisses(t, feed, misses, 1)
+	waiting := make(chan error)
+	go func() {
+		_, cursor, err := cached.GetPage(context.Background(), feed, "did:plc:patient", 30, "")
+		if err == nil && *cursor != "next" {
+			err = errors.New("unexpected page")
+		}
+		waiting <- err
+	}()
+	waitForMisses(t, feed, misses, 2)
+
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled request = %v, want context.Canceled", err)
+	}
+	close(backend.release)
+	if err := <-waiting; err != nil {
+		t.Errorf("request sharing the fetch of a cancelled request = %v, want the page", err)
+	}
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Errorf("%d fetches, want 1", calls)
+	}
+}
@@ -1,13 +1,13 @@
 package dynamic
 
 import (
-	"fmt"
-	"strconv"
 	"context"
+	"fmt"
 	"log/slog"
 
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
 	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feedrouter"
 )
 
 type DynamicFeed struct {
@@ -16,10 +16,11 @@ type DynamicFeed struct {
 	log          *slog.Logger
 	FeedActorDID string
 	FeedName     string
-	dbFunc       func(int64, int64) ([]string, error)
+	dbFunc       func(context.Context, int64, *db.Cursor) ([]db.FeedPost, error)
 }
 
-func NewDynamicFeed(ctx context.Context, feedActorDID, feedName string, dbFunc func(limit, cursor int64) ([]string, error), log *slog.Logger) (*DynamicFeed, []string) {
+// NewDynamicFeed returns a feed paging through dbFunc, which is called with the request context
+func NewDynamicFeed(ctx context.Context, feedActorDID, feedName string, dbFunc func(ctx context.Context, limit int64, cursor *db.Cursor) ([]db.FeedPost, error), log *slog.Logger) (*DynamicFeed, []string) {
 	return &DynamicFeed{
 		ctx:          ctx,
 		log:          log,
@@ -32,47 +33,49 @@ func NewDynamicFeed(ctx context.Context, feedActorDID, feedName string, dbFunc f
 // GetPage returns a list of FeedDefs_SkeletonFeedPost, a new cursor, and an error
 // It takes a feed name, a user DID, a limit, and a cursor
 // The feed name can be used to produce different feeds from the same feed generator
+// Cursors are opaque keyset cursors, no cursor is returned once the end of the feed is reached
 func (df *DynamicFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
-	df.log.Info(fmt.Sprintf("Getting %d most recent posts at cursor %s", limit, cursor))
+	df.log.Info(fmt.Sprintf("Getting %d %s posts at cursor %s", limit, df.FeedName, cursor))
 	if limit > 30 {
 		limit = 30
 	}
+	if limit < 1 {
+		limit = 1
+	}
 
-	cursorAsInt := int64(0)
-	var err error
-
+	var after *db.Cursor
 	if cursor != "" {
-		cursorAsInt, err = strconv.ParseInt(cursor, 10, 64)
+		var err error
+		after, err = db.DecodeCursor(cursor)
 		if err != nil {
-			df.log.Warn(fmt.Sprintf("cursor is not an integer: %v", err))
-			return nil, nil, fmt.Errorf("cursor is not an integer: %w", err)
+			df.log.Warn(fmt.Sprintf("invalid cursor: %v", err))
+			return nil, nil, fmt.Errorf("%w: %w", feedrouter.ErrInvalidCursor, err)
 		}
 	}
 
-	tmr, err := df.dbFunc(limit, cursorAsInt)
+	// fetch one more post than requested to know whether there is a next page
+	tmr, err := df.dbFunc(ctx, limit+1, after)
 	if err != nil {
-		df.log.Warn(fmt.Sprintf("error getting %d most recent posts: %v", limit, err))
-		return nil, nil, fmt.Errorf("error getting %d most recent posts: %w", limit, err)
+		df.log.Warn(fmt.Sprintf("error getting %d %s posts: %v", limit, df.FeedName, err))
+		return nil, nil, fmt.Errorf("error getting %d %s posts: %w", limit, df.FeedName, err)
 	}
-	df.log.Info(fmt.Sprintf("Got %d most recent posts:\n%v", len(tmr), tmr))
+	df.log.Info(fmt.Sprintf("Got %d %s posts", len(tmr), df.FeedName))
 
 	var posts []*appbsky.FeedDefs_SkeletonFeedPost
-	for _, postURI := range tmr {
+	for _, post := range tmr {
 		if int64(len(posts)) >= limit {
 			break
 		}
 		posts = append(posts, &appbsky.FeedDefs_SkeletonFeedPost{
-			Post: postURI,
+			Post: post.URI(),
 		})
 	}
 
-	cursorAsInt += int64(len(posts))
-
 	var newCursor *string
 
-	if cursorAsInt < int64(210) {
+	if int64(len(tmr)) > limit {
 		newCursor = new(string)
-		*newCursor = strconv.FormatInt(cursorAsInt, 10)
+		*newCursor = tmr[limit-1].Cursor().Encode()
 	}
 
 	df.log.Info(fmt.Sprintf("Returning %d posts:\n%#v", len(posts), posts))
@@ -0,0 +1,298 @@
+// Package snapshot serves ranking feeds from precomputed snapshots. A background job ranks
+// the candidates of a feed every interval, requests only slice the snapshot in memory.
+package snapshot
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feedrouter"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/jobs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var snapshotPosts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "feedgen_feed_snapshot_posts",
+	Help: "The number of posts in the current snapshot of a feed",
+}, []string{"feed"})
+
+var snapshotRefreshDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "feedgen_feed_snapshot_refresh_duration_seconds",
+	Help:    "Time taken to rank the candidates of a feed into a snapshot",
+	Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+}, []string{"feed"})
+
+var snapshotExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_feed_snapshot_expired_total",
+	Help: "The total number of cursors pinned to a snapshot that was no longer kept, served from the current snapshot",
+}, []string{"feed"})
+
+// cursorPrefix versions the snapshot cursor layout, like db.Cursor does for keyset cursors
+const cursorPrefix = "s1"
+
+// rankBatchSize is how many posts are ranked per query while computing a snapshot
+const rankBatchSize = 500
+
+// RankFunc pages through the candidates of a feed in ranked order, like the db feed queries
+type RankFunc func(ctx context.Context, limit int64, cursor *db.Cursor) ([]db.FeedPost, error)
+
+// Config configures how snapshots are computed and kept
+type Config struct {
+	// Size is the number of posts ranked into a snapshot, the feed ends after them
+	Size int64
+	// Retention is how long a snapshot is kept after it was superseded, so clients
+	// paging through it keep getting consistent pages
+	Retention time.Duration
+	// Store persists snapshots so restarted or other instances can serve them, nil keeps them in memory only
+	Store db.DB
+}
+
+type snapshot struct {
+	// version is the time the snapshot was computed at, in unix microseconds
+	version int64
+	posts   []db.FeedPost
+}
+
+// SnapshotFeed serves pages of the latest snapshot of a ranking. Cursors pin the snapshot
+// they were taken from, so a client paging through the feed doesn't see posts move between pages.
+type SnapshotFeed struct {
+	FeedActorDID string
+	FeedName     string
+	rank         RankFunc
+	config       Config
+	log          *slog.Logger
+
+	mu sync.RWMutex
+	// snapshots are ordered oldest first, the last one is served to new requests
+	snapshots []*snapshot
+}
+
+// NewSnapshotFeed returns a feed serving snapshots of rank, call Start to compute them
+func NewSnapshotFeed(feedActorDID, feedName string, rank RankFunc, config Config, log *slog.Logger) (*SnapshotFeed, []string, error) {
+	if config.Size <= 0 {
+		return nil, nil, fmt.Errorf("snapshot size must be positive")
+	}
+	if config.Retention < 0 {
+		return nil, nil, fmt.Errorf("snapshot retention must not be negative")
+	}
+	return &SnapshotFeed{
+		FeedActorDID: feedActorDID,
+		FeedName:     feedName,
+		rank:         rank,
+		config:       config,
+		log:          log,
+	}, []string{feedName}, nil
+}
+
+// Start serves the latest persisted snapshot, or computes one if there is none younger than interval,
+// then refreshes the snapshot every interval in the background until the context is cancelled
+func (sf *SnapshotFeed) Start(ctx context.Context, interval time.Duration) {
+	if !sf.loadPersisted(ctx, interval) {
+		if err := sf.Refresh(ctx); err != nil {
+			sf.log.Warn(fmt.Sprintf("failed to compute %s snapshot: %s", sf.FeedName, err.Error()))
+		}
+	}
+	go jobs.Run(ctx, sf.log, "refresh-snapshot-"+sf.FeedName, interval, sf.Refresh)
+}
+
+// loadPersisted serves the latest persisted snapshot if it is younger than maxAge and reports whether it did
+func (sf *SnapshotFeed) loadPersisted(ctx context.Context, maxAge time.Duration) bool {
+	if sf.config.Store == nil {
+		return false
+	}
+	version, posts, err := sf.config.Store.LatestFeedSnapshot(ctx, sf.FeedName)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			sf.log.Warn(fmt.Sprintf("failed to load %s snapshot: %s", sf.FeedName, err.Error()))
+		}
+		return false
+	}
+	if time.Since(time.UnixMicro(version)) > maxAge {
+		return false
+	}
+	sf.publish(&snapshot{version: version, posts: posts})
+	return true
+}
+
+// Refresh ranks the candidates of the feed into a new snapshot and serves it to new requests
+func (sf *SnapshotFeed) Refresh(ctx context.Context) error {
+	start := time.Now()
+	var posts []db.FeedPost
+	var cursor *db.Cursor
+	for remaining := sf.config.Size; remaining > 0; {
+		batch, err := sf.rank(ctx, min(remaining, rankBatchSize), cursor)
+		if err != nil {
+			return fmt.Errorf("failed to rank %s posts: %w", sf.FeedName, err)
+		}
+		posts = append(posts, batch...)
+		if int64(len(batch)) < min(remaining, rankBatchSize) {
+			break
+		}
+		remaining -= int64(len(batch))
+		cursor = batch[len(batch)-1].Cursor()
+	}
+	snapshotRefreshDuration.WithLabelValues(sf.FeedName).Observe(time.Since(start).Seconds())
+
+	s := &snapshot{version: start.UnixMicro(), posts: posts}
+	oldest := sf.publish(s)
+	if sf.config.Store == nil {
+		return nil
+	}
+	// empty snapshots aren't persisted, the feed is served from memory until there are posts
+	if len(posts) > 0 {
+		if err := sf.config.Store.SaveFeedSnapshot(ctx, sf.FeedName, s.version, posts); err != nil {
+			return fmt.Errorf("failed to persist %s snapshot: %w", sf.FeedName, err)
+		}
+	}
+	if _, err := sf.config.Store.PruneFeedSnapshots(ctx, sf.FeedName, oldest); err != nil {
+		return fmt.Errorf("failed to prune %s snapshots: %w", sf.FeedName, err)
+	}
+	return nil
+}
+
+// publish makes s the current snapshot and drops the snapshots superseded longer than
+// the retention ago. It returns the version of the oldest snapshot that is kept.
+func (sf *SnapshotFeed) publish(s *snapshot) int64 {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	// versions must grow for cursors to pin the right snapshot, even if the clock doesn't
+	if n := len(sf.snapshots); n > 0 && s.version <= sf.snapshots[n-1].version {
+		s.version = sf.snapshots[n-1].version + 1
+	}
+	sf.snapshots = append(sf.snapshots, s)
+
+	cutoff := time.Now().Add(-sf.config.Retention).UnixMicro()
+	kept := 0
+	for kept < len(sf.snapshots)-1 && sf.snapshots[kept+1].version < cutoff {
+		kept++
+	}
+	sf.snapshots = sf.snapshots[kept:]
+	snapshotPosts.WithLabelValues(sf.FeedName).Set(float64(len(s.posts)))
+	return sf.snapshots[0].version
+}
+
+// current returns the snapshot served to new requests, nil until the first one is computed
+func (sf *SnapshotFeed) current() *snapshot {
+	sf.mu.RLock()
+	defer sf.mu.RUnlock()
+	if len(sf.snapshots) == 0 {
+		return nil
+	}
+	return sf.snapshots[len(sf.snapshots)-1]
+}
+
+// find returns the snapshot of a version, looking in the store for versions computed elsewhere.
+// A version that is no longer kept is answered with the current snapshot.
+func (sf *SnapshotFeed) find(ctx context.Context, version int64) (*snapshot, error) {
+	sf.mu.RLock()
+	for _, s := range sf.snapshots {
+		if s.version == version {
+			sf.mu.RUnlock()
+			return s, nil
+		}
+	}
+	sf.mu.RUnlock()
+
+	if sf.config.Store != nil {
+		posts, err := sf.config.Store.FeedSnapshot(ctx, sf.FeedName, version)
+		if err == nil {
+			return &snapshot{version: version, posts: posts}, nil
+		}
+		if !errors.Is(err, db.ErrNotFound) {
+			return nil, err
+		}
+	}
+	snapshotExpired.WithLabelValues(sf.FeedName).Inc()
+	return sf.current(), nil
+}
+
+// GetPage returns a list of FeedDefs_SkeletonFeedPost, a new cursor, and an error
+// Pages are sliced from the current snapshot, a cursor continues in the snapshot it was taken from
+func (sf *SnapshotFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	if limit > 30 {
+		limit = 30
+	}
+	if limit < 1 {
+		limit = 1
+	}
+
+	s := sf.current()
+	var offset int64
+	if cursor != "" {
+		version, after, err := decodeCursor(cursor)
+		if err != nil {
+			sf.log.Warn(fmt.Sprintf("invalid cursor: %v", err))
+			return nil, nil, fmt.Errorf("%w: %w", feedrouter.ErrInvalidCursor, err)
+		}
+		s, err = sf.find(ctx, version)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting %s snapshot: %w", sf.FeedName, err)
+		}
+		offset = after
+	}
+	if s == nil {
+		return nil, nil, fmt.Errorf("%s has no snapshot yet", sf.FeedName)
+	}
+
+	var posts []*appbsky.FeedDefs_SkeletonFeedPost
+	end := min(offset+limit, int64(len(s.posts)))
+	for i := offset; i < end; i++ {
+		posts = append(posts, &appbsky.FeedDefs_SkeletonFeedPost{
+			Post: s.posts[i].URI(),
+		})
+	}
+
+	var newCursor *string
+	if end < int64(len(s.posts)) {
+		newCursor = new(string)
+		*newCursor = encodeCursor(s.version, end)
+	}
+	sf.log.Debug(fmt.Sprintf("Returning %d %s posts from snapshot %d at offset %d", len(posts), sf.FeedName, s.version, offset))
+	return posts, newCursor, nil
+}
+
+// Describe returns a FeedDescribeFeedGenerator_Feed for the feed
+func (sf *SnapshotFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	return []appbsky.FeedDescribeFeedGenerator_Feed{
+		{
+			Uri: "at://" + sf.FeedActorDID + "/app.bsky.feed.generator/" + sf.FeedName,
+		},
+	}, nil
+}
+
+// encodeCursor returns an opaque cursor continuing a snapshot at an offset
+func encodeCursor(version, offset int64) string {
+	raw := strings.Join([]string{cursorPrefix, strconv.FormatInt(version, 10), strconv.FormatInt(offset, 10)}, "|")
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor parses a cursor produced by encodeCursor
+func decodeCursor(encoded string) (version, offset int64, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed cursor: %w", err)
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 || parts[0] != cursorPrefix {
+		return 0, 0, fmt.Errorf("unsupported cursor")
+	}
+	version, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed cursor version: %w", err)
+	}
+	offset, err = strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, fmt.Errorf("malformed cursor offset: %q", parts[2])
+	}
+	return version, offset, nil
+}
@@ -0,0 +1,215 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feedrouter"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const author = "did:plc:author"
+
+var ctx = context.Background()
+
+// ranking is a fixed ranked set of candidates, paged like the db feed queries
+type ranking struct {
+	posts []db.FeedPost
+	// limits are the limits of the rank calls
+	limits []int64
+	// delay is how long every rank call takes
+	delay time.Duration
+}
+
+func newRanking(rkeys ...string) *ranking {
+	r := &ranking{}
+	for i, rkey := range rkeys {
+		r.posts = append(r.posts, db.FeedPost{DID: author, Rkey: rkey, Score: float64(len(rkeys) - i)})
+	}
+	return r
+}
+
+func numbered(n int) []string {
+	rkeys := make([]string, n)
+	for i := range rkeys {
+		rkeys[i] = fmt.Sprintf("post%d", i)
+	}
+	return rkeys
+}
+
+func (r *ranking) rank(ctx context.Context, limit int64, cursor *db.Cursor) ([]db.FeedPost, error) {
+	r.limits = append(r.limits, limit)
+	time.Sleep(r.delay)
+	start := 0
+	if cursor != nil {
+		for i, post := range r.posts {
+			if post.Rkey == cursor.Rkey {
+				start = i + 1
+			}
+		}
+	}
+	end := min(start+int(limit), len(r.posts))
+	return r.posts[start:end], nil
+}
+
+func newFeed(t *testing.T, r *ranking, config Config) *SnapshotFeed {
+	t.Helper()
+	feed, _, err := NewSnapshotFeed(author, "Ranked", func(ctx context.Context, limit int64, cursor *db.Cursor) ([]db.FeedPost, error) {
+		return r.rank(ctx, limit, cursor)
+	}, config, slog.Default())
+	if err != nil {
+		t.Fatalf("NewSnapshotFeed: %v", err)
+	}
+	if err := feed.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	return feed
+}
+
+// page returns the rkeys of a page and the cursor of the next page, empty at the end of the feed
+func page(t *testing.T, feed *SnapshotFeed, limit int64, cursor string) ([]string, string) {
+	t.Helper()
+	posts, next, err := feed.GetPage(ctx, feed.FeedName, "did:plc:user", limit, cursor)
+	if err != nil {
+		t.Fatalf("GetPage: %v", err)
+	}
+	var rkeys []string
+	for _, post := range posts {
+		rkeys = append(rkeys, strings.TrimPrefix(post.Post, "at://"+author+"/app.bsky.feed.post/"))
+	}
+	if next == nil {
+		return rkeys, ""
+	}
+	return rkeys, *next
+}
+
+func TestRefreshRanksInBatchesUpToSize(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		candidates int
+		size       int64
+		wantLimits []int64
+		wantPosts  int
+	}{
+		{name: "more candidates than the size", candidates: 1300, size: 1200, wantLimits: []int64{500, 500, 200}, wantPosts: 1200},
+		{name: "fewer candidates than the size", candidates: 700, size: 1200, wantLimits: []int64{500, 500}, wantPosts: 700},
+		{name: "candidates filling whole batches", candidates: 1000, size: 1200, wantLimits: []int64{500, 500, 200}, wantPosts: 1000},
+		{name: "size smaller than a batch", candidates: 1300, size: 30, wantLimits: []int64{30}, wantPosts: 30},
+		{name: "no candidates", candidates: 0, size: 1200, wantLimits: []int64{500}, wantPosts: 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRanking(numbered(tt.candidates)...)
+			feed := newFeed(t, r, Config{Size: tt.size})
+			if fmt.Sprint(r.limits) != fmt.Sprint(tt.wantLimits) {
+				t.Errorf("rank limits = %v, want %v", r.limits, tt.wantLimits)
+			}
+			posts := feed.current().posts
+			if len(posts) != tt.wantPosts {
+				t.Fatalf("snapshot has %d posts, want %d", len(posts), tt.wantPosts)
+			}
+			for i, post := range posts {
+				if post.Rkey != r.posts[i].Rkey {
+					t.Fatalf("post %d of the snapshot = %s, want %s in ranked order", i, post.Rkey, r.posts[i].Rkey)
+				}
+			}
+		})
+	}
+}
+
+func TestCursorPinsItsSnapshot(t *testing.T) {
+	r := newRanking("post0", "post1", "post2", "post3", "post4", "post5", "post6", "post7", "post8", "post9")
+	feed := newFeed(t, r, Config{Size: 100, Retention: time.Minute})
+
+	first, cursor := page(t, feed, 4, "")
+	if fmt.Sprint(first) != "[post0 post1 post2 post3]" {
+		t.Fatalf("first page = %v", first)
+	}
+
+	// the ranking changes and a new post tops it before the client asks for the next page
+	r.posts = newRanking("postX", "post9", "post8", "post7", "post6", "post5", "post4", "post3", "post2", "post1", "post0").posts
+	if err := feed.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	seen := map[string]bool{}
+	for _, rkey := range first {
+		seen[rkey] = true
+	}
+	var rest []string
+	for cursor != "" {
+		var rkeys []string
+		rkeys, cursor = page(t, feed, 4, cursor)
+		for _, rkey := range rkeys {
+			if seen[rkey] {
+				t.Errorf("%s is served twice", rkey)
+			}
+			seen[rkey] = true
+		}
+		rest = append(rest, rkeys...)
+	}
+	if fmt.Sprint(rest) != "[post4 post5 post6 post7 post8 post9]" {
+		t.Errorf("pages after the first = %v, want the rest of the first snapshot", rest)
+	}
+
+	// new requests are served from the new snapshot
+	if latest, _ := page(t, feed, 2, ""); fmt.Sprint(latest) != "[postX post9]" {
+		t.Errorf("first page of the new snapshot = %v", latest)
+	}
+}
+
+func TestExpiredCursorContinuesInTheCurrentSnapshot(t *testing.T) {
+	r := newRanking("post0", "post1", "post2", "post3", "post4", "post5")
+	feed := newFeed(t, r, Config{Size: 100})
+	_, cursor := page(t, feed, 2, "")
+
+	// without retention the first snapshot is dropped once it is superseded
+	r.posts = newRanking("post5", "post4", "post3", "post2", "post1", "post0").posts
+	r.delay = time.Millisecond
+	if err := feed.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if n := len(feed.snapshots); n != 1 {
+		t.Fatalf("%d snapshots are kept, want only the current one", n)
+	}
+
+	expired := testutil.ToFloat64(snapshotExpired.WithLabelValues(feed.FeedName))
+	rkeys, next := page(t, feed, 2, cursor)
+	if fmt.Sprint(rkeys) != "[post3 post2]" {
+		t.Errorf("page of an expired cursor = %v, want the same offset in the current snapshot", rkeys)
+	}
+	if testutil.ToFloat64(snapshotExpired.WithLabelValues(feed.FeedName)) != expired+1 {
+		t.Error("the expired cursor is not counted")
+	}
+	// the next cursor belongs to the current snapshot
+	if rkeys, _ := page(t, feed, 2, next); fmt.Sprint(rkeys) != "[post1 post0]" {
+		t.Errorf("page after an expired cursor = %v", rkeys)
+	}
+}
+
+func TestMalformedCursor(t *testing.T) {
+	feed := newFeed(t, newRanking("post0", "post1"), Config{Size: 100})
+	encode := func(raw string) string { return base64.RawURLEncoding.EncodeToString([]byte(raw)) }
+	for name, cursor := range map[string]string{
+		"not base64":        "not a cursor!",
+		"other version":     encode("s0|1|2"),
+		"keyset cursor":     (&db.Cursor{DID: author, Rkey: "post0"}).Encode(),
+		"missing offset":    encode("s1|1"),
+		"malformed version": encode("s1|x|2"),
+		"malformed offset":  encode("s1|1|x"),
+		"negative offset":   encode("s1|1|-1"),
+		"too many fields":   encode("s1|1|2|3"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := feed.GetPage(ctx, feed.FeedName, "did:plc:user", 2, cursor); !errors.Is(err, feedrouter.ErrInvalidCursor) {
+				t.Errorf("GetPage = %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+}
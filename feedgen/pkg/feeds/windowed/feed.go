@@ -0,0 +1,101 @@
+package windowed
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feedrouter"
+)
+
+// Window is a feed alias and the period of engagement it ranks posts by
+type Window struct {
+	Name     string
+	Duration time.Duration
+}
+
+// WindowedFeed serves "top of the period" feeds, one alias per window, where
+// only engagement within the window counts
+type WindowedFeed struct {
+	windows []Window
+	feeds   map[string]feedrouter.Feed
+}
+
+// NewWindowedFeed returns a new WindowedFeed and its aliases, one per window
+// newFeed returns the feed serving a window, ranking posts by engagement within it
+func NewWindowedFeed(windows []Window, newFeed func(window Window) (feedrouter.Feed, []string, error)) (*WindowedFeed, []string, error) {
+	wf := &WindowedFeed{
+		windows: windows,
+		feeds:   map[string]feedrouter.Feed{},
+	}
+	var aliases []string
+	for _, window := range windows {
+		// newFeed may start background work, so duplicates are rejected before it is called
+		if _, ok := wf.feeds[window.Name]; ok {
+			return nil, nil, fmt.Errorf("duplicate window %s", window.Name)
+		}
+		feed, feedAliases, err := newFeed(window)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create %s feed: %w", window.Name, err)
+		}
+		wf.feeds[window.Name] = feed
+		aliases = append(aliases, feedAliases...)
+	}
+	return wf, aliases, nil
+}
+
+// Since returns the function ranking posts by engagement within the last duration, for the feed of a window
+func Since(duration time.Duration, dbFunc func(ctx context.Context, since time.Time, limit int64, cursor *db.Cursor) ([]db.FeedPost, error)) func(ctx context.Context, limit int64, cursor *db.Cursor) ([]db.FeedPost, error) {
+	return func(ctx context.Context, limit int64, cursor *db.Cursor) ([]db.FeedPost, error) {
+		return dbFunc(ctx, time.Now().Add(-duration), limit, cursor)
+	}
+}
+
+// ParseWindows parses a comma separated list of name=duration pairs,
+// e.g. "TopBirdsToday=24h,TopBirdsThisWeek=168h"
+func ParseWindows(spec string) ([]Window, error) {
+	var windows []Window
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(spec, ",") {
+		name, rawDuration, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("window must be name=duration: %q", pair)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate window %s", name)
+		}
+		seen[name] = true
+		duration, err := time.ParseDuration(rawDuration)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("window %s must have a positive duration: %q", name, rawDuration)
+		}
+		windows = append(windows, Window{Name: name, Duration: duration})
+	}
+	return windows, nil
+}
+
+// GetPage returns a list of FeedDefs_SkeletonFeedPost, a new cursor, and an error
+// The feed name selects the window posts are ranked by
+func (wf *WindowedFeed) GetPage(ctx context.Context, feed string, userDID string, limit int64, cursor string) ([]*appbsky.FeedDefs_SkeletonFeedPost, *string, error) {
+	windowFeed, ok := wf.feeds[feed]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown window: %s", feed)
+	}
+	return windowFeed.GetPage(ctx, feed, userDID, limit, cursor)
+}
+
+// Describe returns a FeedDescribeFeedGenerator_Feed for every window
+func (wf *WindowedFeed) Describe(ctx context.Context) ([]appbsky.FeedDescribeFeedGenerator_Feed, error) {
+	var descriptions []appbsky.FeedDescribeFeedGenerator_Feed
+	for _, window := range wf.windows {
+		windowDescriptions, err := wf.feeds[window.Name].Describe(ctx)
+		if err != nil {
+			return nil, err
+		}
+		descriptions = append(descriptions, windowDescriptions...)
+	}
+	return descriptions, nil
+}
@@ -0,0 +1,199 @@
+package gin
+
+import (
+	_ "embed"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/ranking"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/shadow"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/stream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var defaultReportThresholds = []float64{0.5, 0.6, 0.7, 0.75, 0.8, 0.85, 0.9, 0.95}
+
+type AdminEndpoints struct {
+	DB      db.DB
+	Ranking *ranking.Config
+}
+
+func NewAdminEndpoints(db db.DB, rankingConfig *ranking.Config) *AdminEndpoints {
+	return &AdminEndpoints{
+		DB:      db,
+		Ranking: rankingConfig,
+	}
+}
+
+// ClassificationReport compares classifier results from the classification log
+// It takes an optional "since" duration (default 24h) and a comma separated list of "thresholds"
+func (ep *AdminEndpoints) ClassificationReport(c *gin.Context) {
+	tracer := otel.Tracer("admin")
+	ctx, span := tracer.Start(c.Request.Context(), "Admin:ClassificationReport")
+	defer span.End()
+
+	window := 24 * time.Hour
+	if sinceQuery := c.Query("since"); sinceQuery != "" {
+		parsed, err := time.ParseDuration(sinceQuery)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be a positive duration"})
+			return
+		}
+		window = parsed
+	}
+
+	thresholds := defaultReportThresholds
+	if thresholdsQuery := c.Query("thresholds"); thresholdsQuery != "" {
+		thresholds = nil
+		for _, raw := range strings.Split(thresholdsQuery, ",") {
+			threshold, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+			if err != nil || threshold < 0 || threshold > 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "thresholds must be numbers between 0 and 1"})
+				return
+			}
+			thresholds = append(thresholds, threshold)
+		}
+	}
+
+	since := time.Now().Add(-window)
+	scores, err := ep.DB.ClassificationScores(ctx, stream.BirdLabel, since)
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	span.SetAttributes(attribute.Int("report.posts", len(scores)))
+
+	c.JSON(http.StatusOK, shadow.NewReport(stream.BirdLabel, since, scores, stream.BirdConfidenceThreshold, thresholds))
+}
+
+//go:embed templates/review.html
+var reviewPage []byte
+
+// ReviewPage serves a minimal HTML page for working through the review queue
+func (ep *AdminEndpoints) ReviewPage(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", reviewPage)
+}
+
+// ListReviewItems returns a page of review items
+// It takes an optional "status" (default pending), "limit" (default 50, maximum of 250) and "cursor"
+func (ep *AdminEndpoints) ListReviewItems(c *gin.Context) {
+	tracer := otel.Tracer("admin")
+	ctx, span := tracer.Start(c.Request.Context(), "Admin:ListReviewItems")
+	defer span.End()
+
+	status := c.DefaultQuery("status", db.ReviewPending)
+	if status != db.ReviewPending && status != db.ReviewApproved && status != db.ReviewRejected && status != db.ReviewWithdrawn {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be one of pending, approved, rejected or withdrawn"})
+		return
+	}
+
+	limit := int64(50)
+	if limitQuery := c.Query("limit"); limitQuery != "" {
+		parsedLimit, err := strconv.ParseInt(limitQuery, 10, 64)
+		if err != nil || parsedLimit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+		limit = min(parsedLimit, 250)
+	}
+
+	cursor := int64(0)
+	if cursorQuery := c.Query("cursor"); cursorQuery != "" {
+		parsedCursor, err := strconv.ParseInt(cursorQuery, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cursor is not an integer"})
+			return
+		}
+		cursor = parsedCursor
+	}
+
+	items, err := ep.DB.ReviewItems(ctx, status, limit, cursor)
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	span.SetAttributes(attribute.Int("review.items.length", len(items)))
+
+	var newCursor *string
+	if int64(len(items)) == limit {
+		newCursor = new(string)
+		*newCursor = strconv.FormatInt(items[len(items)-1].ID, 10)
+	}
+	if items == nil {
+		items = []db.ReviewItem{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": items, "cursor": newCursor})
+}
+
+func (ep *AdminEndpoints) ApproveReviewItem(c *gin.Context) {
+	ep.decideReviewItem(c, db.ReviewApproved)
+}
+
+func (ep *AdminEndpoints) RejectReviewItem(c *gin.Context) {
+	ep.decideReviewItem(c, db.ReviewRejected)
+}
+
+func (ep *AdminEndpoints) decideReviewItem(c *gin.Context, decision string) {
+	tracer := otel.Tracer("admin")
+	ctx, span := tracer.Start(c.Request.Context(), "Admin:DecideReviewItem")
+	defer span.End()
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id is not an integer"})
+		return
+	}
+	span.SetAttributes(attribute.Int64("review.id", id), attribute.String("review.decision", decision))
+
+	item, err := ep.DB.DecideReviewItem(ctx, id, decision, c.GetString("admin_user"))
+	if errors.Is(err, db.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no pending review item with this id"})
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+// GetHotRanking returns the current hot ranking parameters
+func (ep *AdminEndpoints) GetHotRanking(c *gin.Context) {
+	c.JSON(http.StatusOK, ep.Ranking.Hot())
+}
+
+// PutHotRanking replaces the hot ranking parameters, taking effect on every
+// replica within one refresh interval
+func (ep *AdminEndpoints) PutHotRanking(c *gin.Context) {
+	tracer := otel.Tracer("admin")
+	ctx, span := tracer.Start(c.Request.Context(), "Admin:PutHotRanking")
+	defer span.End()
+
+	var params db.HotParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ranking.ValidateHot(params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ep.Ranking.SetHot(ctx, params); err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, params)
+}
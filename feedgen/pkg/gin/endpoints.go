@@ -1,6 +1,7 @@
 package gin
 
 import (
+	"errors"
 	"fmt"
 	"github.com/medhir/bsky-feed-generator/feedgen/pkg/feedrouter"
 	"net/http"
@@ -158,6 +159,10 @@ func (ep *Endpoints) GetFeedSkeleton(c *gin.Context) {
 
 	// Get the feed items
 	feedItems, newCursor, err := feed.GetPage(ctx, feedName, userDID, limit, cursor)
+	if errors.Is(err, feedrouter.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		span.RecordError(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to get feed items: %s", err.Error())})
@@ -0,0 +1,32 @@
+package gin
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/health"
+)
+
+// HealthEndpoints serve the liveness and readiness probes
+type HealthEndpoints struct {
+	checker *health.Checker
+}
+
+func NewHealthEndpoints(checker *health.Checker) *HealthEndpoints {
+	return &HealthEndpoints{checker: checker}
+}
+
+// Healthz reports that the process is up and serving requests, it checks no dependencies
+func (ep *HealthEndpoints) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": health.StatusOK})
+}
+
+// Readyz runs the readiness checks and answers 503 with the failed checks if any of them fails
+func (ep *HealthEndpoints) Readyz(c *gin.Context) {
+	report := ep.checker.Run(c.Request.Context())
+	status := http.StatusOK
+	if !report.OK() {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
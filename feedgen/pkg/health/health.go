@@ -0,0 +1,108 @@
+// Package health runs the readiness checks of the feed generator and the services it depends on.
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Check reports whether a dependency is ready, along with optional details shown in the report
+type Check func(ctx context.Context) (any, error)
+
+// Result is the outcome of a single check
+type Result struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	Details    any     `json:"details,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// Report is the outcome of every check, its status is ok only if every check passed
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// OK reports whether every check passed
+func (r Report) OK() bool {
+	return r.Status == StatusOK
+}
+
+// Checker runs a set of named checks, checks can be added while it is serving
+type Checker struct {
+	timeout time.Duration
+
+	mu     sync.Mutex
+	checks map[string]Check
+}
+
+// NewChecker returns a Checker that fails checks taking longer than timeout
+func NewChecker(timeout time.Duration) (*Checker, error) {
+	if timeout <= 0 {
+		return nil, fmt.Errorf("check timeout must be positive")
+	}
+	return &Checker{timeout: timeout, checks: map[string]Check{}}, nil
+}
+
+// Add registers a check, replacing the check registered under the same name
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// Run runs every check in parallel and reports their outcome
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.Lock()
+	checks := make(map[string]Check, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(map[string]chan Result, len(checks))
+	for name, check := range checks {
+		// buffered so checks that ignore the context don't block forever once they time out
+		done[name] = make(chan Result, 1)
+		go func(results chan<- Result) {
+			result := Result{Status: StatusOK}
+			details, err := check(ctx)
+			if err != nil {
+				result.Status, result.Error = StatusFail, err.Error()
+			}
+			result.Details = details
+			result.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+			results <- result
+		}(done[name])
+	}
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+	for name, results := range done {
+		var result Result
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			// checks that finished while waiting on a slower one still count
+			select {
+			case result = <-results:
+			default:
+				result = Result{Status: StatusFail, Error: fmt.Sprintf("timed out after %s", c.timeout), DurationMS: float64(c.timeout.Microseconds()) / 1000}
+			}
+		}
+		if result.Status != StatusOK {
+			report.Status = StatusFail
+		}
+		report.Checks[name] = result
+	}
+	return report
+}
@@ -0,0 +1,394 @@
+// Package ingest buffers engagement from the firehose and writes it to the DB in batches.
+// Engagement on posts that are being classified is held in memory for a short time, in case the
+// post is indexed, engagement on other posts is discarded without a DB round trip.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var droppedWrites = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "feedgen_ingest_dropped_writes_total",
+	Help: "The total number of buffered engagement writes dropped because the DB was not keeping up",
+})
+
+// maxPendingBatches is how many batches may pile up while the DB is failing,
+// engagement beyond that is dropped instead of growing the buffer without bound
+const maxPendingBatches = 10
+
+// finalFlushTimeout bounds the flush of the remaining engagement once the buffer is stopped
+const finalFlushTimeout = 10 * time.Second
+
+// ErrDropped is returned by Flush when it drops writes because the DB isn't keeping up
+var ErrDropped = errors.New("buffered engagement writes were dropped")
+
+// Config configures a Buffer
+type Config struct {
+	// BatchSize is the number of pending writes that triggers a flush
+	BatchSize int
+	// HoldFor is how long engagement on a post that is being classified is kept in case the post is indexed
+	HoldFor time.Duration
+	// MaxHeld caps the number of likes and reposts held, the oldest are dropped first. Zero holds none.
+	MaxHeld int
+}
+
+// Buffer accumulates likes, reposts and their deletions and flushes them in batches.
+// It keeps the set of indexed posts in memory to drop engagement on other posts up front.
+type Buffer struct {
+	db        db.DB
+	log       *slog.Logger
+	batchSize int
+
+	mu      sync.Mutex
+	tracked map[db.RecordKey]struct{}
+	// trackedDuringLoad collects posts tracked while Load is reading the indexed posts,
+	// so they aren't lost when the loaded set replaces the current one
+	trackedDuringLoad map[db.RecordKey]struct{}
+	// classifying are the posts being classified, only engagement on them is held
+	classifying map[db.RecordKey]struct{}
+	pending     batch
+	held        *pending
+	// queued counts the writes queued, written is the count up to which every write is stored
+	// or dropped, and droppedUpTo the count up to which writes may have been dropped
+	queued      uint64
+	written     uint64
+	droppedUpTo uint64
+
+	full chan struct{}
+}
+
+type batch struct {
+	likes          []db.Engagement
+	reposts        []db.Engagement
+	deletedLikes   []db.RecordKey
+	deletedReposts []db.RecordKey
+}
+
+func (b *batch) size() int {
+	return len(b.likes) + len(b.reposts) + len(b.deletedLikes) + len(b.deletedReposts)
+}
+
+// NewBuffer returns an empty Buffer, call Load to track the indexed posts
+func NewBuffer(d db.DB, config Config, log *slog.Logger) (*Buffer, error) {
+	if config.BatchSize <= 0 {
+		return nil, fmt.Errorf("ingest batch size must be positive")
+	}
+	if config.HoldFor < 0 || config.MaxHeld < 0 {
+		return nil, fmt.Errorf("held engagement limits must not be negative")
+	}
+	return &Buffer{
+		db:          d,
+		log:         log,
+		batchSize:   config.BatchSize,
+		tracked:     map[db.RecordKey]struct{}{},
+		classifying: map[db.RecordKey]struct{}{},
+		held:        newPending(config.HoldFor, config.MaxHeld),
+		full:        make(chan struct{}, 1),
+	}, nil
+}
+
+// Load replaces the tracked posts with the posts indexed in the DB. It is called at startup
+// and periodically, to pick up posts indexed or removed outside of the firehose (reviews, retention).
+func (b *Buffer) Load(ctx context.Context) error {
+	b.mu.Lock()
+	b.trackedDuringLoad = map[db.RecordKey]struct{}{}
+	b.mu.Unlock()
+
+	keys, err := b.db.PostKeys(ctx)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	duringLoad := b.trackedDuringLoad
+	b.trackedDuringLoad = nil
+	if err != nil {
+		return err
+	}
+	tracked := make(map[db.RecordKey]struct{}, len(keys)+len(duringLoad))
+	for _, key := range keys {
+		tracked[key] = struct{}{}
+	}
+	for key := range duringLoad {
+		tracked[key] = struct{}{}
+	}
+	b.tracked = tracked
+	return nil
+}
+
+// Classifying holds engagement on a post until it is indexed with Track or rejected with Discard,
+// call it before the post is classified
+func (b *Buffer) Classifying(did, rkey string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.classifying[db.RecordKey{DID: did, Rkey: rkey}] = struct{}{}
+}
+
+// Discard drops the engagement held for a post that was classified but not indexed
+func (b *Buffer) Discard(did, rkey string) {
+	key := db.RecordKey{DID: did, Rkey: rkey}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.classifying, key)
+	b.held.drop(key)
+}
+
+// Track marks a post as indexed, call it once the post is stored. Likes and reposts held
+// for the post are queued, Track returns when each of them was received.
+func (b *Buffer) Track(did, rkey string) []time.Time {
+	key := db.RecordKey{DID: did, Rkey: rkey}
+	b.mu.Lock()
+	b.tracked[key] = struct{}{}
+	delete(b.classifying, key)
+	if b.trackedDuringLoad != nil {
+		b.trackedDuringLoad[key] = struct{}{}
+	}
+	released := b.held.release(key)
+	if len(released) == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	receivedAt := make([]time.Time, len(released))
+	for i, h := range released {
+		if h.repost {
+			b.pending.reposts = append(b.pending.reposts, h.engagement)
+		} else {
+			b.pending.likes = append(b.pending.likes, h.engagement)
+		}
+		receivedAt[i] = h.receivedAt
+	}
+	b.queued += uint64(len(released))
+	full := b.pending.size() >= b.batchSize
+	b.mu.Unlock()
+	replayedEngagement.Add(float64(len(released)))
+	if full {
+		b.notifyFull()
+	}
+	return receivedAt
+}
+
+// Untrack marks a post as no longer indexed
+func (b *Buffer) Untrack(did, rkey string) {
+	key := db.RecordKey{DID: did, Rkey: rkey}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.tracked, key)
+	if b.trackedDuringLoad != nil {
+		delete(b.trackedDuringLoad, key)
+	}
+}
+
+// IsTracked reports whether a post is indexed
+func (b *Buffer) IsTracked(did, rkey string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.tracked[db.RecordKey{DID: did, Rkey: rkey}]
+	return ok
+}
+
+// Tracked returns the number of tracked posts
+func (b *Buffer) Tracked() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.tracked)
+}
+
+// AddLike queues a like and reports whether its subject is a tracked post. Likes on posts
+// being classified are held until the post is tracked or they expire, others are discarded.
+func (b *Buffer) AddLike(like db.Engagement) bool {
+	return b.add(like, false, func(p *batch) { p.likes = append(p.likes, like) })
+}
+
+// AddRepost queues a repost and reports whether its subject is a tracked post, see AddLike
+func (b *Buffer) AddRepost(repost db.Engagement) bool {
+	return b.add(repost, true, func(p *batch) { p.reposts = append(p.reposts, repost) })
+}
+
+// DeleteLike queues the deletion of a like. The subject of a deleted like is unknown,
+// so every deletion is queued and deletions of likes that were never stored are no-ops.
+// A like that is still held or pending is dropped, so it is never written.
+func (b *Buffer) DeleteLike(did, rkey string) {
+	key := db.RecordKey{DID: did, Rkey: rkey}
+	b.queue(func(p *batch) {
+		b.held.forget(did, rkey, false)
+		p.likes = withoutRecords(p.likes, map[db.RecordKey]struct{}{key: {}})
+		p.deletedLikes = append(p.deletedLikes, key)
+	})
+}
+
+// DeleteRepost queues the deletion of a repost, see DeleteLike
+func (b *Buffer) DeleteRepost(did, rkey string) {
+	key := db.RecordKey{DID: did, Rkey: rkey}
+	b.queue(func(p *batch) {
+		b.held.forget(did, rkey, true)
+		p.reposts = withoutRecords(p.reposts, map[db.RecordKey]struct{}{key: {}})
+		p.deletedReposts = append(p.deletedReposts, key)
+	})
+}
+
+// withoutRecords drops the engagement whose own record is in deleted
+func withoutRecords(engagement []db.Engagement, deleted map[db.RecordKey]struct{}) []db.Engagement {
+	if len(deleted) == 0 {
+		return engagement
+	}
+	kept := engagement[:0]
+	for _, e := range engagement {
+		if _, ok := deleted[db.RecordKey{DID: e.DID, Rkey: e.Rkey}]; !ok {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+func recordSet(keys []db.RecordKey) map[db.RecordKey]struct{} {
+	set := make(map[db.RecordKey]struct{}, len(keys))
+	for _, key := range keys {
+		set[key] = struct{}{}
+	}
+	return set
+}
+
+func (b *Buffer) add(e db.Engagement, repost bool, appendTo func(p *batch)) bool {
+	subject := db.RecordKey{DID: e.SubjectDID, Rkey: e.SubjectRkey}
+	b.mu.Lock()
+	_, ok := b.tracked[subject]
+	if _, classifying := b.classifying[subject]; !ok && classifying {
+		b.held.hold(e, repost, time.Now())
+	}
+	b.mu.Unlock()
+	if !ok {
+		return false
+	}
+	b.queue(appendTo)
+	return true
+}
+
+func (b *Buffer) queue(appendTo func(p *batch)) {
+	b.mu.Lock()
+	appendTo(&b.pending)
+	b.queued++
+	full := b.pending.size() >= b.batchSize
+	b.mu.Unlock()
+	if full {
+		b.notifyFull()
+	}
+}
+
+// notifyFull wakes Run to flush a full batch
+func (b *Buffer) notifyFull() {
+	select {
+	case b.full <- struct{}{}:
+	default:
+	}
+}
+
+// Queued returns the position of the latest write queued, pass it to Written to learn when it is stored
+func (b *Buffer) Queued() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.queued
+}
+
+// Written reports whether every write queued up to a position returned by Queued is stored.
+// Positions up to dropped writes are never reported as written.
+func (b *Buffer) Written(position uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return position <= b.written && position > b.droppedUpTo
+}
+
+// Flush writes the pending engagement to the DB. Deletions are written before likes and
+// reposts, since an account may unlike a post and like it again with a new record, which is
+// only stored once the old record is gone. Engagement deleted before it was written is
+// dropped from the batch by DeleteLike and DeleteRepost instead.
+// Writes are idempotent, so a failed batch is kept and retried by the next flush, unless
+// too many writes are pending and the failed batch is dropped, then Flush returns ErrDropped.
+func (b *Buffer) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	p := b.pending
+	b.pending = batch{}
+	upTo := b.queued
+	b.mu.Unlock()
+	if p.size() > 0 {
+		if err := b.write(ctx, p, upTo); err != nil {
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.written = max(b.written, upTo)
+	return nil
+}
+
+// write writes a batch, requeueing what wasn't written if it fails
+func (b *Buffer) write(ctx context.Context, p batch, upTo uint64) error {
+	if _, err := b.db.DeleteLikes(ctx, p.deletedLikes); err != nil {
+		return b.requeue(p, upTo, fmt.Errorf("failed to delete likes: %w", err))
+	}
+	p.deletedLikes = nil
+	if _, err := b.db.DeleteReposts(ctx, p.deletedReposts); err != nil {
+		return b.requeue(p, upTo, fmt.Errorf("failed to delete reposts: %w", err))
+	}
+	p.deletedReposts = nil
+	if _, err := b.db.AddLikes(ctx, p.likes); err != nil {
+		return b.requeue(p, upTo, fmt.Errorf("failed to add likes: %w", err))
+	}
+	p.likes = nil
+	if _, err := b.db.AddReposts(ctx, p.reposts); err != nil {
+		return b.requeue(p, upTo, fmt.Errorf("failed to add reposts: %w", err))
+	}
+	return nil
+}
+
+// requeue puts the unwritten part of a failed batch in front of the engagement queued since.
+// Engagement deleted since the batch was taken is dropped, as DeleteLike and DeleteRepost
+// couldn't drop it from the batch while it was being written. It returns the error of the
+// failed batch, joined with ErrDropped when the batch is dropped.
+func (b *Buffer) requeue(failed batch, upTo uint64, err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if failed.size()+b.pending.size() > maxPendingBatches*b.batchSize {
+		droppedWrites.Add(float64(failed.size()))
+		// the positions of the batch are never reported as written, later ones are once they are
+		b.droppedUpTo = max(b.droppedUpTo, upTo)
+		return errors.Join(err, fmt.Errorf("%w: %d writes", ErrDropped, failed.size()))
+	}
+	b.pending = batch{
+		likes:          append(withoutRecords(failed.likes, recordSet(b.pending.deletedLikes)), b.pending.likes...),
+		reposts:        append(withoutRecords(failed.reposts, recordSet(b.pending.deletedReposts)), b.pending.reposts...),
+		deletedLikes:   append(failed.deletedLikes, b.pending.deletedLikes...),
+		deletedReposts: append(failed.deletedReposts, b.pending.deletedReposts...),
+	}
+	return err
+}
+
+// Run flushes the buffer every interval, or sooner once a batch is full, until the context
+// is cancelled. What is left in the buffer is flushed before Run returns.
+func (b *Buffer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), finalFlushTimeout)
+			defer cancel()
+			if err := b.Flush(flushCtx); err != nil {
+				b.log.Warn(fmt.Sprintf("failed to flush engagement buffer: %s", err.Error()))
+			}
+			return
+		case <-ticker.C:
+		case <-b.full:
+		}
+		if err := b.Flush(ctx); err != nil {
+			b.log.Warn(fmt.Sprintf("failed to flush engagement buffer: %s", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+)
+
+const author = "did:plc:author"
+
+var ctx = context.Background()
+
+// hookedDB lets a test replace single methods of the memory backend
+type hookedDB struct {
+	db.DB
+	postKeys func(ctx context.Context) ([]db.RecordKey, error)
+	addLikes func(ctx context.Context, likes []db.Engagement) (int64, error)
+}
+
+func (d *hookedDB) PostKeys(ctx context.Context) ([]db.RecordKey, error) {
+	if d.postKeys != nil {
+		return d.postKeys(ctx)
+	}
+	return d.DB.PostKeys(ctx)
+}
+
+func (d *hookedDB) AddLikes(ctx context.Context, likes []db.Engagement) (int64, error) {
+	if d.addLikes != nil {
+		return d.addLikes(ctx, likes)
+	}
+	return d.DB.AddLikes(ctx, likes)
+}
+
+func newDB(t *testing.T) *hookedDB {
+	t.Helper()
+	t.Setenv("DATABASE_URL", "memory://")
+	d, err := db.NewDB(ctx)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	return &hookedDB{DB: d}
+}
+
+func newBuffer(t *testing.T, d db.DB, config Config) *Buffer {
+	t.Helper()
+	if config.BatchSize == 0 {
+		config.BatchSize = 100
+	}
+	b, err := NewBuffer(d, config, slog.Default())
+	if err != nil {
+		t.Fatalf("NewBuffer: %v", err)
+	}
+	return b
+}
+
+func addPosts(t *testing.T, d db.DB, rkeys ...string) {
+	t.Helper()
+	for _, rkey := range rkeys {
+		post := db.Post{
+			DID:   author,
+			Rkey:  rkey,
+			URI:   fmt.Sprintf("https://bsky.app/profile/%s/post/%s", author, rkey),
+			ATURI: fmt.Sprintf("at://%s/app.bsky.feed.post/%s", author, rkey),
+		}
+		if err := d.AddPost(ctx, post); err != nil {
+			t.Fatalf("AddPost(%s): %v", rkey, err)
+		}
+	}
+}
+
+func engagement(fan, rkey, subject string) db.Engagement {
+	return db.Engagement{DID: fan, Rkey: rkey, SubjectDID: author, SubjectRkey: subject}
+}
+
+func flush(t *testing.T, b *Buffer) {
+	t.Helper()
+	if err := b.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+}
+
+func assertLikes(t *testing.T, d db.DB, rkey string, want float64) {
+	t.Helper()
+	posts, err := d.MostPopularWithCursor(ctx, 100, nil)
+	if err != nil {
+		t.Fatalf("MostPopularWithCursor: %v", err)
+	}
+	for _, post := range posts {
+		if post.Rkey == rkey {
+			if post.Score != want {
+				t.Fatalf("post %s has %v likes, want %v", rkey, post.Score, want)
+			}
+			return
+		}
+	}
+	t.Fatalf("post %s is not indexed", rkey)
+}
+
+// assertStored checks which reposts are stored, by deleting them
+func assertStored(t *testing.T, d db.DB, want, notWant db.RecordKey) {
+	t.Helper()
+	if deleted, err := d.DeleteReposts(ctx, []db.RecordKey{notWant}); err != nil || deleted != 0 {
+		t.Errorf("repost %s is stored (%d, %v), want it deleted", notWant.Rkey, deleted, err)
+	}
+	if deleted, err := d.DeleteReposts(ctx, []db.RecordKey{want}); err != nil || deleted != 1 {
+		t.Errorf("repost %s is not stored (%d, %v)", want.Rkey, deleted, err)
+	}
+}
+
+func TestEngagementOnUntrackedPostsIsNotWritten(t *testing.T) {
+	d := newDB(t)
+	addPosts(t, d, "a", "b")
+	b := newBuffer(t, d, Config{})
+	if err := b.Load(ctx); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !b.AddLike(engagement("did:plc:fan", "1", "a")) {
+		t.Error("like on an indexed post is not tracked")
+	}
+	b.Untrack(author, "b")
+	if b.AddLike(engagement("did:plc:fan", "2", "b")) {
+		t.Error("like on an untracked post is tracked")
+	}
+	flush(t, b)
+	assertLikes(t, d, "a", 1)
+	assertLikes(t, d, "b", 0)
+}
+
+func TestUnlikeAndLikeAgainWithinOneBatch(t *testing.T) {
+	d := newDB(t)
+	addPosts(t, d, "a")
+	b := newBuffer(t, d, Config{})
+	if err := b.Load(ctx); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	// the account counts once per post, the second like is only stored once the first is gone
+	b.AddLike(engagement("did:plc:fan", "1", "a"))
+	b.DeleteLike("did:plc:fan", "1")
+	b.AddLike(engagement("did:plc:fan", "2", "a"))
+	b.AddRepost(engagement("did:plc:fan", "3", "a"))
+	b.DeleteRepost("did:plc:fan", "3")
+	b.AddRepost(engagement("did:plc:fan", "4", "a"))
+	flush(t, b)
+	assertLikes(t, d, "a", 1)
+	assertStored(t, d, db.RecordKey{DID: "did:plc:fan", Rkey: "4"}, db.RecordKey{DID: "did:plc:fan", Rkey: "3"})
+}
+
+func TestUnlikeAndLikeAgainAcrossBatches(t *testing.T) {
+	d := newDB(t)
+	addPosts(t, d, "a")
+	b := newBuffer(t, d, Config{})
+	if err := b.Load(ctx); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	b.AddLike(engagement("did:plc:fan", "1", "a"))
+	b.AddRepost(engagement("did:plc:fan", "3", "a"))
+	flush(t, b)
+	b.DeleteLike("did:plc:fan", "1")
+	b.AddLike(engagement("did:plc:fan", "2", "a"))
+	b.DeleteRepost("did:plc:fan", "3")
+	b.AddRepost(engagement("did:plc:fan", "4", "a"))
+	flush(t, b)
+	assertLikes(t, d, "a", 1)
+	assertStored(t, d, db.RecordKey{DID: "did:plc:fan", Rkey: "4"}, db.RecordKey{DID: "did:plc:fan", Rkey: "3"})
+}
+
+func TestLoadKeepsPostsTrackedDuringLoad(t *testing.T) {
+	d := newDB(t)
+	addPosts(t, d, "loaded")
+	loading, release := make(chan struct{}), make(chan struct{})
+	d.postKeys = func(ctx context.Context) ([]db.RecordKey, error) {
+		keys, err := d.DB.PostKeys(ctx)
+		close(loading)
+		<-release
+		return keys, err
+	}
+	b := newBuffer(t, d, Config{})
+	loaded := make(chan error)
+	go func() { loaded <- b.Load(ctx) }()
+	<-loading
+	// indexed after the keys were read, so only Track knows about it
+	addPosts(t, d, "indexed")
+	b.Track(author, "indexed")
+	close(release)
+	if err := <-loaded; err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for _, rkey := range []string{"loaded", "indexed"} {
+		if !b.IsTracked(author, rkey) {
+			t.Errorf("post %s is not tracked after Load", rkey)
+		}
+	}
+	if b.Tracked() != 2 {
+		t.Errorf("Tracked() = %d, want 2", b.Tracked())
+	}
+}
+
+func TestTrackReleasesHeldEngagement(t *testing.T) {
+	d := newDB(t)
+	b := newBuffer(t, d, Config{HoldFor: time.Minute, MaxHeld: 10})
+	b.Classifying(author, "a")
+	if b.AddLike(engagement("did:plc:fan", "1", "a")) {
+		t.Fatal("like on a post that isn't indexed yet is tracked")
+	}
+	b.AddRepost(engagement("did:plc:fan", "2", "a"))
+	b.AddLike(engagement("did:plc:other", "3", "a"))
+	b.DeleteLike("did:plc:other", "3")
+	flush(t, b)
+
+	addPosts(t, d, "a")
+	if receivedAt := b.Track(author, "a"); len(receivedAt) != 2 {
+		t.Fatalf("Track released %d likes and reposts, want 2", len(receivedAt))
+	}
+	flush(t, b)
+	assertLikes(t, d, "a", 1)
+	assertStored(t, d, db.RecordKey{DID: "did:plc:fan", Rkey: "2"}, db.RecordKey{DID: "did:plc:other", Rkey: "3"})
+	// released engagement is only written once
+	if receivedAt := b.Track(author, "a"); len(receivedAt) != 0 {
+		t.Errorf("second Track released %d likes and reposts, want none", len(receivedAt))
+	}
+}
+
+func TestOnlyEngagementOnPostsBeingClassifiedIsHeld(t *testing.T) {
+	d := newDB(t)
+	b := newBuffer(t, d, Config{HoldFor: time.Minute, MaxHeld: 10})
+	b.Classifying(author, "rejected")
+	b.AddLike(engagement("did:plc:fan", "1", "rejected"))
+	b.AddLike(engagement("did:plc:fan", "2", "unknown"))
+	b.Discard(author, "rejected")
+	// engagement after the post was rejected isn't held either
+	b.AddLike(engagement("did:plc:fan", "3", "rejected"))
+	if len(b.held.byRecord) != 0 {
+		t.Errorf("%d likes are held, want none", len(b.held.byRecord))
+	}
+
+	// a post indexed later, e.g. approved in review, only counts engagement from then on
+	addPosts(t, d, "rejected", "unknown")
+	for _, rkey := range []string{"rejected", "unknown"} {
+		if receivedAt := b.Track(author, rkey); len(receivedAt) != 0 {
+			t.Errorf("Track(%s) released %d likes, want none", rkey, len(receivedAt))
+		}
+	}
+	flush(t, b)
+	assertLikes(t, d, "rejected", 0)
+	assertLikes(t, d, "unknown", 0)
+}
+
+func TestPendingExpiresAndEvicts(t *testing.T) {
+	now := time.Now()
+	p := newPending(time.Minute, 2)
+	p.hold(engagement("did:plc:fan", "1", "a"), false, now)
+	p.hold(engagement("did:plc:fan", "1", "a"), false, now)
+	p.hold(engagement("did:plc:fan", "2", "b"), false, now.Add(30*time.Second))
+	if len(p.byRecord) != 2 {
+		t.Fatalf("holding a like twice kept %d likes, want 2", len(p.byRecord))
+	}
+	// the first like is more than a minute old by now
+	p.hold(engagement("did:plc:fan", "3", "c"), false, now.Add(90*time.Second))
+	if released := p.release(db.RecordKey{DID: author, Rkey: "a"}); len(released) != 0 {
+		t.Errorf("expired like was released")
+	}
+	// the oldest like is evicted beyond the maximum
+	p.hold(engagement("did:plc:fan", "4", "d"), false, now.Add(100*time.Second))
+	if released := p.release(db.RecordKey{DID: author, Rkey: "b"}); len(released) != 0 {
+		t.Errorf("evicted like was released")
+	}
+	for _, subject := range []string{"c", "d"} {
+		if released := p.release(db.RecordKey{DID: author, Rkey: subject}); len(released) != 1 {
+			t.Errorf("released %d likes on %s, want 1", len(released), subject)
+		}
+	}
+	if len(p.byRecord) != 0 || len(p.bySubject) != 0 {
+		t.Errorf("pending still holds %d likes after releasing all of them", len(p.byRecord))
+	}
+}
+
+func TestFailedFlushIsRetried(t *testing.T) {
+	d := newDB(t)
+	addPosts(t, d, "a")
+	b := newBuffer(t, d, Config{})
+	if err := b.Load(ctx); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	b.AddLike(engagement("did:plc:fan", "1", "a"))
+	b.AddLike(engagement("did:plc:fan", "2", "a"))
+	queued := b.Queued()
+	d.addLikes = func(ctx context.Context, likes []db.Engagement) (int64, error) {
+		// engagement arriving while the batch is written is queued behind it
+		b.AddLike(engagement("did:plc:other", "3", "a"))
+		b.DeleteLike("did:plc:fan", "2")
+		return 0, errors.New("db is down")
+	}
+	if err := b.Flush(ctx); err == nil {
+		t.Fatal("Flush succeeded while the DB is down")
+	}
+	var rkeys []string
+	for _, like := range b.pending.likes {
+		rkeys = append(rkeys, like.Rkey)
+	}
+	// the like deleted while the batch was written is dropped
+	if fmt.Sprint(rkeys) != "[1 3]" {
+		t.Errorf("pending likes after a failed flush = %v, want [1 3]", rkeys)
+	}
+	if b.Written(queued) {
+		t.Error("writes of a failed flush are reported as written")
+	}
+	d.addLikes = nil
+	flush(t, b)
+	assertLikes(t, d, "a", 2)
+	if !b.Written(b.Queued()) {
+		t.Error("writes of a retried flush are not reported as written")
+	}
+}
+
+func TestFailedFlushDropsBeyondLimit(t *testing.T) {
+	d := newDB(t)
+	addPosts(t, d, "a")
+	b := newBuffer(t, d, Config{BatchSize: 1})
+	if err := b.Load(ctx); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for i := 0; i <= maxPendingBatches; i++ {
+		b.AddLike(engagement(fmt.Sprintf("did:plc:fan%d", i), "1", "a"))
+	}
+	d.addLikes = func(ctx context.Context, likes []db.Engagement) (int64, error) {
+		return 0, errors.New("db is down")
+	}
+	dropped := b.Queued()
+	if err := b.Flush(ctx); !errors.Is(err, ErrDropped) {
+		t.Fatalf("Flush while the DB is down beyond the limit = %v, want ErrDropped", err)
+	}
+	if size := b.pending.size(); size != 0 {
+		t.Errorf("%d writes are pending beyond the limit of %d batches, want them dropped", size, maxPendingBatches)
+	}
+
+	// once the DB recovers, writes queued after the dropped ones are written and reported as such
+	d.addLikes = nil
+	b.AddLike(engagement("did:plc:late", "1", "a"))
+	if err := b.Flush(ctx); err != nil {
+		t.Fatalf("Flush after the DB recovered: %v", err)
+	}
+	assertLikes(t, d, "a", 1)
+	if !b.Written(b.Queued()) {
+		t.Error("writes queued after dropped writes are not reported as written once they are")
+	}
+	for position := uint64(1); position <= dropped; position++ {
+		if b.Written(position) {
+			t.Errorf("position %d of a dropped write is reported as written", position)
+		}
+	}
+}
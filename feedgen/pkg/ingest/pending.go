@@ -0,0 +1,148 @@
+package ingest
+
+import (
+	"time"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var heldEngagement = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "feedgen_ingest_held_engagement",
+	Help: "The number of likes and reposts held back while their post is classified",
+})
+
+var replayedEngagement = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "feedgen_ingest_replayed_engagement_total",
+	Help: "The total number of held likes and reposts written once their post was indexed",
+})
+
+var droppedEngagement = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_ingest_dropped_engagement_total",
+	Help: "The total number of held likes and reposts dropped before their post was indexed",
+}, []string{"reason"})
+
+// held is a like or repost on a post that is being classified
+type held struct {
+	engagement db.Engagement
+	repost     bool
+	receivedAt time.Time
+	// released is set once the engagement is replayed or deleted, it stays in the queue until it expires
+	released bool
+}
+
+// heldKey identifies a held like or repost by its own record
+type heldKey struct {
+	db.RecordKey
+	repost bool
+}
+
+// pending holds engagement whose subject is still being classified when its first likes
+// arrive. It keeps up to max entries for ttl.
+type pending struct {
+	ttl time.Duration
+	max int
+
+	bySubject map[db.RecordKey][]*held
+	byRecord  map[heldKey]*held
+	// queue is in arrival order, expired and evicted entries are dropped from its front
+	queue []*held
+}
+
+func newPending(ttl time.Duration, max int) *pending {
+	return &pending{
+		ttl:       ttl,
+		max:       max,
+		bySubject: map[db.RecordKey][]*held{},
+		byRecord:  map[heldKey]*held{},
+	}
+}
+
+// hold keeps engagement until its subject is released or it expires
+func (p *pending) hold(e db.Engagement, repost bool, now time.Time) {
+	if p.max <= 0 {
+		return
+	}
+	key := heldKey{db.RecordKey{DID: e.DID, Rkey: e.Rkey}, repost}
+	if _, ok := p.byRecord[key]; ok {
+		return
+	}
+	h := &held{engagement: e, repost: repost, receivedAt: now}
+	subject := db.RecordKey{DID: e.SubjectDID, Rkey: e.SubjectRkey}
+	p.bySubject[subject] = append(p.bySubject[subject], h)
+	p.byRecord[key] = h
+	p.queue = append(p.queue, h)
+	p.expire(now)
+}
+
+// release removes and returns the engagement held for a subject
+func (p *pending) release(subject db.RecordKey) []*held {
+	released := p.bySubject[subject]
+	delete(p.bySubject, subject)
+	for _, h := range released {
+		h.released = true
+		delete(p.byRecord, heldKey{db.RecordKey{DID: h.engagement.DID, Rkey: h.engagement.Rkey}, h.repost})
+	}
+	heldEngagement.Set(float64(len(p.byRecord)))
+	return released
+}
+
+// drop discards the engagement held for a subject that wasn't indexed
+func (p *pending) drop(subject db.RecordKey) {
+	dropped := p.release(subject)
+	if len(dropped) > 0 {
+		droppedEngagement.WithLabelValues("rejected").Add(float64(len(dropped)))
+	}
+}
+
+// forget drops a held like or repost that was deleted before its subject was indexed
+func (p *pending) forget(did, rkey string, repost bool) {
+	key := heldKey{db.RecordKey{DID: did, Rkey: rkey}, repost}
+	h, ok := p.byRecord[key]
+	if !ok {
+		return
+	}
+	p.remove(h)
+	droppedEngagement.WithLabelValues("deleted").Inc()
+}
+
+// expire drops entries older than the ttl and the oldest entries beyond the maximum
+func (p *pending) expire(now time.Time) {
+	for len(p.queue) > 0 {
+		h := p.queue[0]
+		switch {
+		case h.released:
+		case now.Sub(h.receivedAt) > p.ttl:
+			p.remove(h)
+			droppedEngagement.WithLabelValues("expired").Inc()
+		case len(p.byRecord) > p.max:
+			p.remove(h)
+			droppedEngagement.WithLabelValues("evicted").Inc()
+		default:
+			heldEngagement.Set(float64(len(p.byRecord)))
+			return
+		}
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+	}
+	heldEngagement.Set(float64(len(p.byRecord)))
+}
+
+// remove drops a held entry from the indexes, it is dropped from the queue once it reaches the front
+func (p *pending) remove(h *held) {
+	h.released = true
+	delete(p.byRecord, heldKey{db.RecordKey{DID: h.engagement.DID, Rkey: h.engagement.Rkey}, h.repost})
+	subject := db.RecordKey{DID: h.engagement.SubjectDID, Rkey: h.engagement.SubjectRkey}
+	remaining := p.bySubject[subject][:0]
+	for _, other := range p.bySubject[subject] {
+		if other != h {
+			remaining = append(remaining, other)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(p.bySubject, subject)
+	} else {
+		p.bySubject[subject] = remaining
+	}
+}
@@ -0,0 +1,29 @@
+// Package jobs runs periodic background maintenance tasks.
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Run calls fn every interval until the context is cancelled
+// Errors are logged and the job keeps running on its schedule
+func Run(ctx context.Context, log *slog.Logger, name string, interval time.Duration, fn func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			if err := fn(ctx); err != nil {
+				log.Warn(fmt.Sprintf("job %s failed: %s", name, err.Error()))
+				continue
+			}
+			log.Debug(fmt.Sprintf("job %s finished in %s", name, time.Since(start)))
+		}
+	}
+}
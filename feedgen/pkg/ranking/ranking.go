@@ -0,0 +1,106 @@
+// Package ranking holds ranking parameters that can be tuned at runtime.
+// Parameters are persisted as settings in the DB so every replica picks them up
+// without redeploying.
+package ranking
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+)
+
+// HotSettingKey is the setting the hot ranking parameters are stored under
+const HotSettingKey = "ranking.hot"
+
+// DefaultHotParams are used until parameters are stored in the DB
+var DefaultHotParams = db.HotParams{
+	LikeWeight:    1,
+	RepostWeight:  2,
+	HalfLifeHours: 6,
+	MaxAgeHours:   7 * 24,
+}
+
+type Config struct {
+	db  db.DB
+	log *slog.Logger
+	hot atomic.Pointer[db.HotParams]
+}
+
+// NewConfig returns a Config with the default parameters, call Refresh to load stored parameters
+func NewConfig(db db.DB, log *slog.Logger) *Config {
+	c := &Config{
+		db:  db,
+		log: log,
+	}
+	hot := DefaultHotParams
+	c.hot.Store(&hot)
+	return c
+}
+
+// Hot returns the current hot ranking parameters
+func (c *Config) Hot() db.HotParams {
+	return *c.hot.Load()
+}
+
+// SetHot validates and stores new hot ranking parameters
+func (c *Config) SetHot(ctx context.Context, params db.HotParams) error {
+	if err := ValidateHot(params); err != nil {
+		return err
+	}
+	value, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	if err := c.db.PutSetting(ctx, HotSettingKey, value); err != nil {
+		return err
+	}
+	c.hot.Store(&params)
+	return nil
+}
+
+// Refresh loads the parameters stored in the DB, keeping the current ones if none are stored
+func (c *Config) Refresh(ctx context.Context) error {
+	value, err := c.db.GetSetting(ctx, HotSettingKey)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var params db.HotParams
+	if err := json.Unmarshal(value, &params); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", HotSettingKey, err)
+	}
+	if err := ValidateHot(params); err != nil {
+		return fmt.Errorf("invalid %s: %w", HotSettingKey, err)
+	}
+	if params != c.Hot() {
+		c.log.Info(fmt.Sprintf("updated hot ranking parameters: %+v", params))
+	}
+	c.hot.Store(&params)
+	return nil
+}
+
+// ValidateHot checks that hot ranking parameters produce a well defined score
+func ValidateHot(params db.HotParams) error {
+	if params.LikeWeight < 0 || params.RepostWeight < 0 || params.RisingWeight < 0 {
+		return fmt.Errorf("weights must not be negative")
+	}
+	if params.HalfLifeHours <= 0 {
+		return fmt.Errorf("half_life_hours must be positive")
+	}
+	if params.MaxAgeHours <= 0 {
+		return fmt.Errorf("max_age_hours must be positive")
+	}
+	return nil
+}
+
+// HotFeed returns a feed query ranking posts with the current hot ranking parameters
+func (c *Config) HotFeed(ctx context.Context, limit int64, cursor *db.Cursor) ([]db.FeedPost, error) {
+	return c.db.HotWithCursor(ctx, c.Hot(), limit, cursor)
+}
@@ -0,0 +1,214 @@
+// Package retention prunes old posts and engagement in small batches, optionally
+// archiving the pruned rows to gzipped JSON lines files.
+package retention
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var rowsPruned = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_retention_rows_pruned_total",
+	Help: "The total number of rows removed by the retention job",
+}, []string{"table"})
+
+var rowsArchived = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_retention_rows_archived_total",
+	Help: "The total number of pruned rows written to the archive",
+}, []string{"table"})
+
+// Policy configures how long rows are kept, a zero TTL keeps rows forever
+type Policy struct {
+	PostTTL   time.Duration
+	LikeTTL   time.Duration
+	RepostTTL time.Duration
+	// ProtectWindow keeps posts that were liked or reposted within the window,
+	// so posts still ranked by the top feeds aren't pruned
+	ProtectWindow time.Duration
+	// BatchSize is the number of rows deleted per transaction, and BatchPause the
+	// time waited between batches so that ingestion isn't starved of locks
+	BatchSize  int64
+	BatchPause time.Duration
+	// ArchiveDir is where pruned rows are written to, nothing is archived when it is empty
+	ArchiveDir string
+}
+
+// Enabled reports whether the policy prunes anything
+func (p Policy) Enabled() bool {
+	return p.PostTTL > 0 || p.LikeTTL > 0 || p.RepostTTL > 0
+}
+
+// EngagementTTL returns the shortest time likes and reposts are kept for, or zero if they are kept forever
+func (p Policy) EngagementTTL() time.Duration {
+	if p.LikeTTL == 0 || (p.RepostTTL > 0 && p.RepostTTL < p.LikeTTL) {
+		return p.RepostTTL
+	}
+	return p.LikeTTL
+}
+
+type Pruner struct {
+	db     db.DB
+	policy Policy
+	log    *slog.Logger
+}
+
+func NewPruner(db db.DB, policy Policy, log *slog.Logger) (*Pruner, error) {
+	if policy.BatchSize <= 0 {
+		return nil, fmt.Errorf("retention batch size must be positive")
+	}
+	if policy.ArchiveDir != "" {
+		if err := os.MkdirAll(policy.ArchiveDir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create archive directory: %w", err)
+		}
+	}
+	return &Pruner{
+		db:     db,
+		policy: policy,
+		log:    log,
+	}, nil
+}
+
+// Prune runs one retention pass over every table with a TTL
+func (p *Pruner) Prune(ctx context.Context) error {
+	now := time.Now()
+	if p.policy.LikeTTL > 0 {
+		err := p.pruneTable(ctx, "post_like", func(limit int64, archive db.ArchiveFunc) (int64, error) {
+			return p.db.PruneLikes(ctx, now.Add(-p.policy.LikeTTL), limit, archive)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if p.policy.RepostTTL > 0 {
+		err := p.pruneTable(ctx, "post_repost", func(limit int64, archive db.ArchiveFunc) (int64, error) {
+			return p.db.PruneReposts(ctx, now.Add(-p.policy.RepostTTL), limit, archive)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if p.policy.PostTTL > 0 {
+		var protectSince time.Time
+		if p.policy.ProtectWindow > 0 {
+			protectSince = now.Add(-p.policy.ProtectWindow)
+		}
+		err := p.pruneTable(ctx, "post", func(limit int64, archive db.ArchiveFunc) (int64, error) {
+			return p.db.PrunePosts(ctx, now.Add(-p.policy.PostTTL), protectSince, limit, archive)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneOrphans deletes engagement, references and counters left behind by posts that are no longer
+// indexed, e.g. likes written while their post was being deleted. Orphans are never archived.
+func (p *Pruner) PruneOrphans(ctx context.Context) error {
+	return p.pruneTable(ctx, "orphans", func(limit int64, _ db.ArchiveFunc) (int64, error) {
+		return p.db.PruneOrphans(ctx, limit)
+	})
+}
+
+// pruneTable deletes batches until a batch comes back short, pausing between batches
+func (p *Pruner) pruneTable(ctx context.Context, table string, prune func(limit int64, archive db.ArchiveFunc) (int64, error)) error {
+	var archive *archiveFile
+	if p.policy.ArchiveDir != "" {
+		archive = newArchiveFile(p.policy.ArchiveDir, table)
+		defer func() {
+			if err := archive.Close(); err != nil {
+				p.log.Warn(fmt.Sprintf("failed to close %s archive: %s", table, err.Error()))
+			}
+		}()
+	}
+
+	var total int64
+	for {
+		var archiveFunc db.ArchiveFunc
+		if archive != nil {
+			archiveFunc = func(rows []json.RawMessage) error {
+				if err := archive.Write(rows); err != nil {
+					return err
+				}
+				rowsArchived.WithLabelValues(table).Add(float64(len(rows)))
+				return nil
+			}
+		}
+		pruned, err := prune(p.policy.BatchSize, archiveFunc)
+		if err != nil {
+			return fmt.Errorf("failed to prune %s: %w", table, err)
+		}
+		rowsPruned.WithLabelValues(table).Add(float64(pruned))
+		total += pruned
+		if pruned < p.policy.BatchSize {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.policy.BatchPause):
+		}
+	}
+	if total > 0 {
+		p.log.Info(fmt.Sprintf("pruned %d rows from %s", total, table))
+	}
+	return nil
+}
+
+// archiveFile is a gzipped JSON lines file that is only created once the first rows are written
+type archiveFile struct {
+	path string
+	file *os.File
+	gz   *gzip.Writer
+}
+
+func newArchiveFile(dir, table string) *archiveFile {
+	name := fmt.Sprintf("%s-%s.jsonl.gz", table, time.Now().UTC().Format("20060102T150405Z"))
+	return &archiveFile{path: filepath.Join(dir, name)}
+}
+
+// Write appends rows to the archive and flushes them, so rows of committed batches are never lost
+func (a *archiveFile) Write(rows []json.RawMessage) error {
+	if a.file == nil {
+		file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		a.file = file
+		a.gz = gzip.NewWriter(file)
+	}
+	for _, row := range rows {
+		if _, err := a.gz.Write(row); err != nil {
+			return err
+		}
+		if _, err := a.gz.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	if err := a.gz.Flush(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *archiveFile) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	if err := a.gz.Close(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
@@ -0,0 +1,130 @@
+// Package shadow compares classifier results recorded in shadow mode, so that
+// thresholds and candidate models can be evaluated against the live feed.
+package shadow
+
+import (
+	"sort"
+	"time"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+)
+
+// ThresholdReport describes which posts would qualify for the feed at a given threshold
+type ThresholdReport struct {
+	Threshold float64 `json:"threshold"`
+	// Posts qualifying under the primary and candidate classifiers
+	Primary   int `json:"primary"`
+	Candidate int `json:"candidate"`
+	// Posts classified by both classifiers, how many of them the classifiers
+	// agree on, and how many qualify under both
+	Compared int `json:"compared"`
+	Agree    int `json:"agree"`
+	Both     int `json:"both"`
+	// Candidate results measured against the primary classifier as ground truth,
+	// only computed over posts classified by both
+	CandidatePrecision *float64 `json:"candidate_precision,omitempty"`
+	CandidateRecall    *float64 `json:"candidate_recall,omitempty"`
+	// Feed delta against the primary classifier at the current threshold
+	PrimaryAdded     int `json:"primary_added"`
+	PrimaryRemoved   int `json:"primary_removed"`
+	CandidateAdded   int `json:"candidate_added"`
+	CandidateRemoved int `json:"candidate_removed"`
+}
+
+// Report summarizes the classification log for a time window
+type Report struct {
+	Label            string            `json:"label"`
+	Since            time.Time         `json:"since"`
+	Posts            int               `json:"posts"`
+	CurrentThreshold float64           `json:"current_threshold"`
+	CurrentFeed      int               `json:"current_feed"`
+	Thresholds       []ThresholdReport `json:"thresholds"`
+}
+
+// NewReport builds a report from per post classification scores.
+// currentThreshold is the threshold the feed is served with today and is the
+// baseline every feed delta is computed against.
+func NewReport(label string, since time.Time, scores []db.ClassificationScore, currentThreshold float64, thresholds []float64) *Report {
+	sorted := append([]float64(nil), thresholds...)
+	sort.Float64s(sorted)
+
+	report := &Report{
+		Label:            label,
+		Since:            since,
+		Posts:            len(scores),
+		CurrentThreshold: currentThreshold,
+		Thresholds:       make([]ThresholdReport, 0, len(sorted)),
+	}
+	for _, score := range scores {
+		if qualifies(score.Primary, currentThreshold) {
+			report.CurrentFeed++
+		}
+	}
+
+	for _, threshold := range sorted {
+		tr := ThresholdReport{Threshold: threshold}
+		comparedPrimary, comparedCandidate := 0, 0
+		for _, score := range scores {
+			inFeed := qualifies(score.Primary, currentThreshold)
+			primary := qualifies(score.Primary, threshold)
+			candidate := qualifies(score.Candidate, threshold)
+
+			if primary {
+				tr.Primary++
+			}
+			if primary && !inFeed {
+				tr.PrimaryAdded++
+			}
+			if !primary && inFeed {
+				tr.PrimaryRemoved++
+			}
+
+			if score.Candidate == nil {
+				continue
+			}
+			if candidate {
+				tr.Candidate++
+			}
+			if candidate && !inFeed {
+				tr.CandidateAdded++
+			}
+			if !candidate && inFeed {
+				tr.CandidateRemoved++
+			}
+
+			if score.Primary == nil {
+				continue
+			}
+			tr.Compared++
+			if primary == candidate {
+				tr.Agree++
+			}
+			if primary {
+				comparedPrimary++
+			}
+			if candidate {
+				comparedCandidate++
+			}
+			if primary && candidate {
+				tr.Both++
+			}
+		}
+		tr.CandidatePrecision = ratio(tr.Both, comparedCandidate)
+		tr.CandidateRecall = ratio(tr.Both, comparedPrimary)
+
+		report.Thresholds = append(report.Thresholds, tr)
+	}
+	return report
+}
+
+func qualifies(score *float64, threshold float64) bool {
+	return score != nil && *score > threshold
+}
+
+func ratio(n, d int) *float64 {
+	if d == 0 {
+		return nil
+	}
+	r := float64(n) / float64(d)
+	return &r
+}
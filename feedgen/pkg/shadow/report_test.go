@@ -0,0 +1,92 @@
+package shadow
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+)
+
+func score(uri string, primary, candidate *float64) db.ClassificationScore {
+	return db.ClassificationScore{PostURI: uri, Primary: primary, Candidate: candidate}
+}
+
+func f(v float64) *float64 {
+	return &v
+}
+
+// format prints a threshold report with its ratios dereferenced, so reports can be compared by value
+func format(tr ThresholdReport) string {
+	ratio := func(r *float64) string {
+		if r == nil {
+			return "nil"
+		}
+		return fmt.Sprintf("%.3f", *r)
+	}
+	precision, recall := tr.CandidatePrecision, tr.CandidateRecall
+	tr.CandidatePrecision, tr.CandidateRecall = nil, nil
+	return fmt.Sprintf("%+v precision=%s recall=%s", tr, ratio(precision), ratio(recall))
+}
+
+func TestNewReport(t *testing.T) {
+	// the feed is served at 0.5, so a, b and e are in the feed today
+	scores := []db.ClassificationScore{
+		score("a", f(0.9), f(0.8)),
+		score("b", f(0.9), f(0.3)),
+		score("c", f(0.2), f(0.6)),
+		score("d", f(0.1), f(0.1)),
+		// classified by one classifier only, not compared
+		score("e", f(0.6), nil),
+		score("f", nil, f(0.9)),
+	}
+	report := NewReport("bird", time.Time{}, scores, 0.5, []float64{0.95, 0.5, 0.7})
+	if report.Posts != 6 || report.CurrentFeed != 3 {
+		t.Errorf("posts = %d, current feed = %d, want 6 and 3", report.Posts, report.CurrentFeed)
+	}
+
+	want := []ThresholdReport{
+		{
+			// compared a, b, c, d: both qualify a, primary a and b, candidate a and c
+			Threshold: 0.5, Primary: 3, Candidate: 3, Compared: 4, Agree: 2, Both: 1,
+			CandidatePrecision: f(0.5), CandidateRecall: f(0.5),
+			PrimaryAdded: 0, PrimaryRemoved: 0, CandidateAdded: 2, CandidateRemoved: 1,
+		},
+		{
+			// e drops out of the primary feed, c out of the candidate
+			Threshold: 0.7, Primary: 2, Candidate: 2, Compared: 4, Agree: 3, Both: 1,
+			CandidatePrecision: f(1), CandidateRecall: f(0.5),
+			PrimaryAdded: 0, PrimaryRemoved: 1, CandidateAdded: 1, CandidateRemoved: 1,
+		},
+		{
+			// nothing qualifies, so precision and recall are undefined
+			Threshold: 0.95, Primary: 0, Candidate: 0, Compared: 4, Agree: 4, Both: 0,
+			PrimaryAdded: 0, PrimaryRemoved: 3, CandidateAdded: 0, CandidateRemoved: 2,
+		},
+	}
+	if len(report.Thresholds) != len(want) {
+		t.Fatalf("got %d thresholds, want %d", len(report.Thresholds), len(want))
+	}
+	for i, tr := range report.Thresholds {
+		if got, want := format(tr), format(want[i]); got != want {
+			t.Errorf("threshold %d:\n got %s\nwant %s", i, got, want)
+		}
+	}
+}
+
+func TestNewReportWithoutComparedPosts(t *testing.T) {
+	for name, scores := range map[string][]db.ClassificationScore{
+		"no posts":          nil,
+		"primary only":      {score("a", f(0.9), nil)},
+		"candidate only":    {score("a", nil, f(0.9))},
+		"different classes": {score("a", f(0.9), nil), score("b", nil, f(0.9))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			report := NewReport("bird", time.Time{}, scores, 0.5, []float64{0.5})
+			tr := report.Thresholds[0]
+			if tr.Compared != 0 || tr.CandidatePrecision != nil || tr.CandidateRecall != nil {
+				t.Errorf("got %s, want nothing compared and no precision or recall", format(tr))
+			}
+		})
+	}
+}
@@ -2,13 +2,29 @@ package stream
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/bluesky-social/indigo/api/atproto"
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"net/http"
+	"time"
 )
 
+var classifierDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "feedgen_classifier_request_duration_seconds",
+	Help:    "Time taken by classifier requests by classifier role and outcome",
+	Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+}, []string{"role", "outcome"})
+
+var classifierResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_classifier_results_total",
+	Help: "The total number of images classified by classifier role and label",
+}, []string{"role", "label"})
+
 type followCounts struct {
 	followers int64
 	follows   int64
@@ -49,9 +65,20 @@ func (s *subscriber) getPostLabels(did, rkey string) (*[]string, error) {
 type classifyResponse struct {
 	Confidence float64 `json:"confidence"`
 	Label      string  `json:"label"`
+	Model      string  `json:"model"`
 }
 
-func (s *subscriber) classify(did string, img *appbsky.EmbedImages_Image) (classifyResponse, error) {
+// classify sends an image to the classifier at classifierURL, role is the classifier's role in the metrics
+func (s *subscriber) classify(ctx context.Context, role, classifierURL, did string, img *appbsky.EmbedImages_Image) (response classifyResponse, err error) {
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			classifierDuration.WithLabelValues(role, "error").Observe(time.Since(start).Seconds())
+			return
+		}
+		classifierDuration.WithLabelValues(role, "ok").Observe(time.Since(start).Seconds())
+		classifierResults.WithLabelValues(role, response.Label).Inc()
+	}()
 	type classifyRequest struct {
 		ImageURL string `json:"image_url"`
 	}
@@ -62,7 +89,7 @@ func (s *subscriber) classify(did string, img *appbsky.EmbedImages_Image) (class
 		s.log.Warn(fmt.Sprintf("failed to marshal classify request: %s", err.Error()))
 		return classifyResponse{}, err
 	}
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/classify", s.classifierURL), bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/classify", classifierURL), bytes.NewBuffer(jsonBody))
 	if err != nil {
 		s.log.Warn(fmt.Sprintf("failed to create classify request: %s", err.Error()))
 		return classifyResponse{}, err
@@ -73,9 +100,10 @@ func (s *subscriber) classify(did string, img *appbsky.EmbedImages_Image) (class
 	if err != nil {
 		return classifyResponse{}, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		s.log.Warn(fmt.Sprintf("classify request failed with status code: %d", resp.StatusCode))
-		return classifyResponse{}, err
+		return classifyResponse{}, fmt.Errorf("classify request failed with status code: %d", resp.StatusCode)
 	}
 
 	var classifyResp classifyResponse
@@ -83,10 +111,45 @@ func (s *subscriber) classify(did string, img *appbsky.EmbedImages_Image) (class
 		s.log.Warn(fmt.Sprintf("failed to decode response body: %s", err.Error()))
 		return classifyResponse{}, err
 	}
-	err = resp.Body.Close()
-	if err != nil {
-		s.log.Warn(fmt.Sprintf("failed to close response body: %s", err.Error()))
-		return classifyResponse{}, err
+	// classifiers that don't report a model id are identified by their endpoint
+	if classifyResp.Model == "" {
+		classifyResp.Model = classifierURL
 	}
 	return classifyResp, nil
 }
+
+// reviewModel identifies results that come from a human review decision instead of a classifier
+const reviewModel = "review"
+
+// reviewedResponse returns a classification result for images a reviewer has
+// approved or rejected before, so they don't need to be classified again
+func (s *subscriber) reviewedResponse(ctx context.Context, img *appbsky.EmbedImages_Image) (classifyResponse, bool) {
+	decision, err := s.db.ImageDecision(ctx, img.Image.Ref.String())
+	if err != nil {
+		s.log.Warn(fmt.Sprintf("failed to get review decision: %s", err.Error()))
+		return classifyResponse{}, false
+	}
+	switch decision {
+	case db.ReviewApproved:
+		return classifyResponse{Label: BirdLabel, Confidence: 1, Model: reviewModel}, true
+	case db.ReviewRejected:
+		return classifyResponse{Label: "not_" + BirdLabel, Confidence: 1, Model: reviewModel}, true
+	}
+	return classifyResponse{}, false
+}
+
+// logClassification records a classifier result in the classification log, used in shadow mode
+func (s *subscriber) logClassification(ctx context.Context, postURI string, img *appbsky.EmbedImages_Image, role string, response classifyResponse) {
+	err := s.db.LogClassification(ctx, db.ClassificationLog{
+		PostURI:    postURI,
+		ImageCID:   img.Image.Ref.String(),
+		Label:      response.Label,
+		Confidence: response.Confidence,
+		Model:      response.Model,
+		Role:       role,
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		s.log.Warn(fmt.Sprintf("failed to log classification: %s", err.Error()))
+	}
+}
@@ -0,0 +1,179 @@
+package stream
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/jetstream/pkg/client/schedulers/parallel"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+)
+
+// CursorSettingKey is the setting the firehose cursor checkpoint is stored under
+const CursorSettingKey = "stream.cursor"
+
+// cursorRewind is how far before the checkpoint the subscriber resumes. The relay only roughly
+// orders events by time, so events just before the checkpoint may have been read after it.
+// Handling an event twice is harmless.
+const cursorRewind = 15 * time.Second
+
+// timeHeap is a min-heap of event times
+type timeHeap []int64
+
+func (h timeHeap) Len() int           { return len(h) }
+func (h timeHeap) Less(i, j int) bool { return h[i] < h[j] }
+func (h timeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *timeHeap) Push(x any)        { *h = append(*h, x.(int64)) }
+func (h *timeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// watermark tracks the events read from the firehose that aren't handled yet. The scheduler
+// handles the events of one account in order on a single worker, so an account whose events are
+// slow to handle holds back its own events while other workers move on. The checkpoint stays
+// below the oldest of them, so they are replayed after a restart.
+type watermark struct {
+	mu sync.Mutex
+	// pending are the times of the events read but not handled, a time is removed
+	// from the heap lazily once its count drops to zero
+	pending timeHeap
+	counts  map[int64]int
+	// handledUS is the time of the latest event handled
+	handledUS int64
+}
+
+// reset forgets the events of the previous connection, keeping the checkpoint below them
+// as the connection resumes from it
+func (w *watermark) reset() {
+	checkpoint := w.checkpoint()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = nil
+	w.counts = map[int64]int{}
+	w.handledUS = checkpoint
+}
+
+// read registers an event before it is queued for a handler
+func (w *watermark) read(timeUS int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.counts == nil {
+		w.counts = map[int64]int{}
+	}
+	if w.counts[timeUS] == 0 {
+		heap.Push(&w.pending, timeUS)
+	}
+	w.counts[timeUS]++
+}
+
+// handled removes an event whose handling finished. Events whose handlers were
+// cancelled are never removed, so the checkpoint doesn't move past them.
+func (w *watermark) handled(timeUS int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.counts[timeUS] > 0 {
+		w.counts[timeUS]--
+	}
+	w.handledUS = max(w.handledUS, timeUS)
+}
+
+// checkpoint returns the time of the latest event up to which every event read has been handled
+func (w *watermark) checkpoint() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.pending) > 0 && w.counts[w.pending[0]] == 0 {
+		delete(w.counts, heap.Pop(&w.pending).(int64))
+	}
+	if len(w.pending) > 0 {
+		return min(w.handledUS, w.pending[0]-1)
+	}
+	return w.handledUS
+}
+
+// trackingScheduler registers every event the client reads with the watermark before queueing it
+type trackingScheduler struct {
+	*parallel.Scheduler
+	watermark *watermark
+}
+
+func (t trackingScheduler) AddWork(ctx context.Context, repo string, event *models.Event) error {
+	if event.TimeUS > 0 {
+		t.watermark.read(event.TimeUS)
+	}
+	return t.Scheduler.AddWork(ctx, repo, event)
+}
+
+// pendingCheckpoint is a relay time up to which every event is handled, along with
+// the position in the buffer of the writes of those events
+type pendingCheckpoint struct {
+	timeUS int64
+	queued uint64
+}
+
+// SaveCursor stores the relay time up to which every event is handled and its engagement written,
+// so the subscriber resumes from it after a restart. Checkpoints are taken on every call and
+// stored once the buffer has written their engagement, while the buffer fails to write they
+// are kept, so the stored cursor doesn't move past engagement that could still be lost.
+func (s *subscriber) SaveCursor(ctx context.Context) error {
+	s.checkpointsMu.Lock()
+	defer s.checkpointsMu.Unlock()
+	// the time is taken first, so the writes of every event handled before it are queued
+	timeUS := s.watermark.checkpoint()
+	if timeUS > 0 && (len(s.checkpoints) == 0 || s.checkpoints[len(s.checkpoints)-1].timeUS != timeUS) {
+		s.checkpoints = append(s.checkpoints, pendingCheckpoint{timeUS: timeUS, queued: s.buffer.Queued()})
+	}
+	written := -1
+	for i, c := range s.checkpoints {
+		if s.buffer.Written(c.queued) {
+			written = i
+		}
+	}
+	if written < 0 {
+		return nil
+	}
+	// the stored checkpoint is kept until a later one is written, so it is stored again if storing it fails
+	s.checkpoints = s.checkpoints[written:]
+	timeUS = s.checkpoints[0].timeUS
+	value, err := json.Marshal(timeUS)
+	if err != nil {
+		return err
+	}
+	if err := s.db.PutSetting(ctx, CursorSettingKey, value); err != nil {
+		return err
+	}
+	s.checkpointedUS.Store(timeUS)
+	return nil
+}
+
+// loadCursor returns the cursor to resume the firehose from, nil to start at the live tip
+func (s *subscriber) loadCursor(ctx context.Context) (*int64, error) {
+	// after a reconnect the subscriber continues where it stopped handling events
+	checkpoint := s.watermark.checkpoint()
+	if checkpoint <= 0 {
+		value, err := s.db.GetSetting(ctx, CursorSettingKey)
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(value, &checkpoint); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", CursorSettingKey, err)
+		}
+	}
+	if age := time.Since(time.UnixMicro(checkpoint)); age > s.maxReplay {
+		s.log.Warn(fmt.Sprintf("firehose cursor is %s old, more than FIREHOSE_MAX_REPLAY, starting at the live tip", age.Round(time.Second)))
+		return nil, nil
+	}
+	cursor := checkpoint - cursorRewind.Microseconds()
+	s.log.Info(fmt.Sprintf("resuming the firehose at %s", time.UnixMicro(cursor).UTC().Format(time.RFC3339)))
+	return &cursor, nil
+}
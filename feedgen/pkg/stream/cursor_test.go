@@ -0,0 +1,223 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/ingest"
+)
+
+var ctx = context.Background()
+
+func TestWatermarkCheckpoint(t *testing.T) {
+	type step struct {
+		op     string
+		timeUS int64
+		want   int64
+	}
+	for _, tt := range []struct {
+		name  string
+		steps []step
+	}{
+		{name: "nothing read", steps: []step{{op: "checkpoint", want: 0}}},
+		{name: "in order", steps: []step{
+			{op: "read", timeUS: 10, want: 0},
+			{op: "read", timeUS: 20, want: 0},
+			{op: "read", timeUS: 30, want: 0},
+			{op: "handled", timeUS: 10, want: 10},
+			// 20 is still being handled
+			{op: "handled", timeUS: 30, want: 19},
+			{op: "handled", timeUS: 20, want: 30},
+		}},
+		{name: "out of order", steps: []step{
+			{op: "read", timeUS: 30, want: 0},
+			{op: "read", timeUS: 10, want: 0},
+			{op: "read", timeUS: 20, want: 0},
+			{op: "handled", timeUS: 30, want: 9},
+			{op: "handled", timeUS: 10, want: 19},
+			{op: "handled", timeUS: 20, want: 30},
+		}},
+		{name: "duplicate timestamps", steps: []step{
+			{op: "read", timeUS: 10, want: 0},
+			{op: "read", timeUS: 10, want: 0},
+			{op: "read", timeUS: 20, want: 0},
+			// one of the events at 10 is still being handled
+			{op: "handled", timeUS: 10, want: 9},
+			{op: "handled", timeUS: 20, want: 9},
+			{op: "handled", timeUS: 10, want: 20},
+		}},
+		{name: "cancelled handler", steps: []step{
+			{op: "read", timeUS: 10, want: 0},
+			{op: "read", timeUS: 20, want: 0},
+			{op: "read", timeUS: 30, want: 0},
+			{op: "handled", timeUS: 10, want: 10},
+			// the handler of 20 is cancelled while draining, so it is never handled
+			{op: "handled", timeUS: 30, want: 19},
+			// the next connection resumes before 20 and reads it again
+			{op: "reset", want: 19},
+			{op: "read", timeUS: 20, want: 19},
+			{op: "read", timeUS: 30, want: 19},
+			{op: "handled", timeUS: 20, want: 20},
+			{op: "handled", timeUS: 30, want: 30},
+		}},
+		{name: "reset keeps the checkpoint", steps: []step{
+			{op: "read", timeUS: 10, want: 0},
+			{op: "handled", timeUS: 10, want: 10},
+			{op: "reset", want: 10},
+			// an event read again after resuming before the checkpoint doesn't move it back
+			{op: "read", timeUS: 5, want: 4},
+			{op: "handled", timeUS: 5, want: 10},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var w watermark
+			for i, s := range tt.steps {
+				switch s.op {
+				case "read":
+					w.read(s.timeUS)
+				case "handled":
+					w.handled(s.timeUS)
+				case "reset":
+					w.reset()
+				}
+				if got := w.checkpoint(); got != s.want {
+					t.Fatalf("step %d (%s %d): checkpoint = %d, want %d", i, s.op, s.timeUS, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+// failingDB fails to add likes while failing is set
+type failingDB struct {
+	db.DB
+	failing bool
+}
+
+func (d *failingDB) AddLikes(ctx context.Context, likes []db.Engagement) (int64, error) {
+	if d.failing {
+		return 0, errors.New("db is down")
+	}
+	return d.DB.AddLikes(ctx, likes)
+}
+
+func newSubscriber(t *testing.T) (*subscriber, *failingDB) {
+	t.Helper()
+	d := &failingDB{DB: db.NewMemoryDB()}
+	buffer, err := ingest.NewBuffer(d, ingest.Config{BatchSize: 100}, slog.Default())
+	if err != nil {
+		t.Fatalf("NewBuffer: %v", err)
+	}
+	return &subscriber{db: d, log: slog.Default(), buffer: buffer, maxReplay: time.Hour}, d
+}
+
+func storedCursor(t *testing.T, d db.DB) int64 {
+	t.Helper()
+	value, err := d.GetSetting(ctx, CursorSettingKey)
+	if errors.Is(err, db.ErrNotFound) {
+		return 0
+	}
+	if err != nil {
+		t.Fatalf("GetSetting: %v", err)
+	}
+	var timeUS int64
+	if err := json.Unmarshal(value, &timeUS); err != nil {
+		t.Fatalf("stored cursor %s: %v", value, err)
+	}
+	return timeUS
+}
+
+func TestSaveCursorWaitsForWrites(t *testing.T) {
+	s, d := newSubscriber(t)
+	s.buffer.Track("did:plc:author", "post")
+	handle := func(timeUS int64, like bool) {
+		s.watermark.read(timeUS)
+		if like {
+			s.buffer.AddLike(db.Engagement{DID: "did:plc:fan", Rkey: "like", SubjectDID: "did:plc:author", SubjectRkey: "post"})
+		}
+		s.watermark.handled(timeUS)
+	}
+	save := func(want int64) {
+		t.Helper()
+		if err := s.SaveCursor(ctx); err != nil {
+			t.Fatalf("SaveCursor: %v", err)
+		}
+		if got := storedCursor(t, d); got != want {
+			t.Errorf("stored cursor = %d, want %d", got, want)
+		}
+	}
+
+	// the like of the event isn't written yet
+	handle(100, true)
+	save(0)
+	d.failing = true
+	if err := s.buffer.Flush(ctx); err == nil {
+		t.Fatal("Flush succeeded while the DB is down")
+	}
+	save(0)
+	// a later event without engagement still depends on the like before it
+	handle(200, false)
+	save(0)
+
+	d.failing = false
+	if err := s.buffer.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	save(200)
+	if checkpointed := s.checkpointedUS.Load(); checkpointed != 200 {
+		t.Errorf("checkpoint lag is measured from %d, want the stored checkpoint", checkpointed)
+	}
+}
+
+func TestLoadCursor(t *testing.T) {
+	now := time.Now()
+	rewound := func(checkpoint time.Time) *int64 {
+		cursor := checkpoint.UnixMicro() - cursorRewind.Microseconds()
+		return &cursor
+	}
+	for _, tt := range []struct {
+		name string
+		// stored is the checkpoint in the settings, handled the event handled on a previous connection
+		stored  time.Time
+		handled time.Time
+		want    *int64
+	}{
+		{name: "nothing stored", want: nil},
+		{name: "stored checkpoint", stored: now.Add(-time.Minute), want: rewound(now.Add(-time.Minute))},
+		{name: "checkpoint older than the max replay", stored: now.Add(-2 * time.Hour), want: nil},
+		{name: "reconnect", stored: now.Add(-time.Minute), handled: now.Add(-time.Second), want: rewound(now.Add(-time.Second))},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, d := newSubscriber(t)
+			if !tt.stored.IsZero() {
+				value, _ := json.Marshal(tt.stored.UnixMicro())
+				if err := d.PutSetting(ctx, CursorSettingKey, value); err != nil {
+					t.Fatalf("PutSetting: %v", err)
+				}
+			}
+			if !tt.handled.IsZero() {
+				s.watermark.read(tt.handled.UnixMicro())
+				s.watermark.handled(tt.handled.UnixMicro())
+			}
+			got, err := s.loadCursor(ctx)
+			if err != nil {
+				t.Fatalf("loadCursor: %v", err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("loadCursor = %v, want %v", deref(got), deref(tt.want))
+			}
+		})
+	}
+}
+
+func deref(cursor *int64) any {
+	if cursor == nil {
+		return nil
+	}
+	return *cursor
+}
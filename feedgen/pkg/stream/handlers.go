@@ -1,103 +1,305 @@
 package stream
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/bluesky-social/indigo/api/atproto"
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/jetstream/pkg/models"
-	"strings"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
 )
 
-func (s *subscriber) handleCreatePost(event *models.Event) error {
+var postLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "feedgen_stream_post_latency_seconds",
+	Help:    "Time from the createdAt of a post to it being added to the feeds",
+	Buckets: []float64{.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 900},
+})
+
+const (
+	// BirdLabel is the classifier label posts are collected for
+	BirdLabel = "bird"
+	// BirdConfidenceThreshold is the confidence above which a post is added to the feed
+	BirdConfidenceThreshold = 0.85
+	// ReviewConfidenceThreshold is the confidence above which posts that don't make it
+	// into the feed are queued for human review
+	ReviewConfidenceThreshold = 0.6
+)
+
+func (s *subscriber) handleCreatePost(ctx context.Context, event *models.Event) error {
 	var post appbsky.FeedPost
 	if err := json.Unmarshal(event.Commit.Record, &post); err != nil {
 		s.log.Warn(fmt.Sprintf("failed to parse app.bsky.feed.post record: %s", err.Error()))
 		return err
 	}
+	// references are counted independently of classification, errors are reported once the post is handled
+	refErr := s.handleReferences(ctx, event, &post)
 	// if post is a parent post and contains an image, classify it
 	isParent := post.Reply == nil
 	if isParent && post.Embed != nil && post.Embed.EmbedImages != nil {
+		did := event.Did
+		rkey := event.Commit.RKey
+		postURL := fmt.Sprintf("https://bsky.app/profile/%s/post/%s", did, rkey)
+		dbPost := s.newPost(event, &post, postURL)
+		postURI := dbPost.ATURI
+		added := false
+		// early likes and reposts are held while the post is classified, and dropped unless it is added
+		s.buffer.Classifying(did, rkey)
+		defer func() {
+			if !added {
+				s.buffer.Discard(did, rkey)
+			}
+		}()
+		var borderline *db.ReviewItem
 		for _, img := range post.Embed.EmbedImages.Images {
-			response, err := s.classify(event.Did, img)
-			if err != nil {
-				s.log.Warn(fmt.Sprintf("failed to classify image: %s", err.Error()))
-				continue
+			// images a reviewer has already decided on skip the classifier
+			response, reviewed := s.reviewedResponse(ctx, img)
+			if !reviewed {
+				var err error
+				response, err = s.classify(ctx, db.ClassifierPrimary, s.classifierURL, did, img)
+				if err != nil {
+					s.log.Warn(fmt.Sprintf("failed to classify image: %s", err.Error()))
+					continue
+				}
+				if s.shadowMode {
+					s.logClassification(ctx, postURI, img, db.ClassifierPrimary, response)
+					if s.candidateClassifierURL != "" {
+						candidate, err := s.classify(ctx, db.ClassifierCandidate, s.candidateClassifierURL, did, img)
+						if err != nil {
+							s.log.Warn(fmt.Sprintf("failed to classify image with candidate classifier: %s", err.Error()))
+						} else {
+							s.logClassification(ctx, postURI, img, db.ClassifierCandidate, candidate)
+						}
+					}
+				}
+			}
+			// keep the most confident borderline image in case no image qualifies
+			if response.Label == BirdLabel && response.Confidence > ReviewConfidenceThreshold &&
+				response.Confidence <= BirdConfidenceThreshold && (borderline == nil || response.Confidence > borderline.Confidence) {
+				borderline = &db.ReviewItem{
+					PostURI:    postURI,
+					URI:        postURL,
+					DID:        did,
+					Rkey:       rkey,
+					ImageCID:   img.Image.Ref.String(),
+					Label:      response.Label,
+					Confidence: response.Confidence,
+					Model:      response.Model,
+					Post:       &dbPost,
+				}
 			}
 			// if post contains picture with high confidence, add to DB
-			if response.Label == "bird" && response.Confidence > 0.85 {
-				did := event.Did
-				rkey := event.Commit.RKey
-				postURL := fmt.Sprintf("https://bsky.app/profile/%s/post/%s", did, rkey)
+			if !added && response.Label == BirdLabel && response.Confidence > BirdConfidenceThreshold {
 				s.log.Info("Bird Identified")
 				s.log.Info(fmt.Sprintf("Post URL: %s", postURL))
 				s.log.Info(fmt.Sprintf("Confidence: %f", response.Confidence))
-				err := s.db.AddPost(did, rkey, postURL)
+				dbPost.Labels = []string{response.Label}
+				dbPost.Confidence = response.Confidence
+				err := s.db.AddPost(ctx, dbPost)
 				if err != nil {
 					s.log.Warn(fmt.Sprintf("failed to add post to DB: %s", err.Error()))
 					continue
 				}
 				s.log.Info(fmt.Sprintf("Added post to DB: %s", rkey))
-				// only add one record per post, skip other images
-				break
+				postLatency.Observe(time.Since(dbPost.CreatedAt).Seconds())
+				// likes and reposts that arrived while the post was classified count from when they were received
+				for _, receivedAt := range s.buffer.Track(did, rkey) {
+					s.velocity.Record(did, rkey, receivedAt)
+				}
+				for _, fn := range s.postAdded {
+					fn(dbPost)
+				}
+				added = true
+				// only add one record per post, skip other images unless
+				// every image needs to be recorded in the classification log
+				if !s.shadowMode {
+					break
+				}
 			}
 		}
+		if !added && borderline != nil {
+			if err := s.db.AddReviewItem(ctx, *borderline); err != nil {
+				s.log.Warn(fmt.Sprintf("failed to queue post for review: %s", err.Error()))
+				return err
+			}
+			s.log.Info(fmt.Sprintf("Queued post for review: %s", rkey))
+		}
 	}
-	return nil
+	return refErr
 }
 
-func (s *subscriber) handleDeletePost(event *models.Event) error {
-	rkey := event.Commit.RKey
-	if err := s.db.DeletePost(rkey); err != nil {
+// newPost collects the metadata of a post record that is stored when the post is indexed
+func (s *subscriber) newPost(event *models.Event, post *appbsky.FeedPost, postURL string) db.Post {
+	dbPost := db.Post{
+		DID:     event.Did,
+		Rkey:    event.Commit.RKey,
+		URI:     postURL,
+		ATURI:   fmt.Sprintf("at://%s/%s/%s", event.Did, CollectionKindFeedPost, event.Commit.RKey),
+		CID:     event.Commit.CID,
+		Text:    post.Text,
+		Langs:   post.Langs,
+		IsReply: post.Reply != nil,
+	}
+	// the createdAt is chosen by the client, posts can't claim to be from the future or from long
+	// before they reached the relay. The event time keeps the order stable when the stream is replayed.
+	receivedAt := time.Now()
+	if event.TimeUS > 0 {
+		receivedAt = time.UnixMicro(event.TimeUS)
+	}
+	dbPost.CreatedAt = receivedAt
+	if createdAt, err := syntax.ParseDatetimeLenient(post.CreatedAt); err != nil {
+		s.log.Warn(fmt.Sprintf("failed to parse post createdAt: %s", err.Error()))
+	} else if t := createdAt.Time(); !t.After(receivedAt) && receivedAt.Sub(t) <= s.maxBackdate {
+		dbPost.CreatedAt = t
+	}
+	if post.Embed != nil {
+		dbPost.IsQuote = post.Embed.EmbedRecord != nil || post.Embed.EmbedRecordWithMedia != nil
+		if post.Embed.EmbedImages != nil {
+			for _, img := range post.Embed.EmbedImages.Images {
+				dbPost.ImageCIDs = append(dbPost.ImageCIDs, img.Image.Ref.String())
+				dbPost.AltTexts = append(dbPost.AltTexts, img.Alt)
+			}
+		}
+	}
+	if post.Labels != nil && post.Labels.LabelDefs_SelfLabels != nil {
+		for _, label := range post.Labels.LabelDefs_SelfLabels.Values {
+			dbPost.SelfLabels = append(dbPost.SelfLabels, label.Val)
+		}
+	}
+	return dbPost
+}
+
+func (s *subscriber) handleDeletePost(ctx context.Context, event *models.Event) error {
+	if err := s.db.DeletePost(ctx, event.Did, event.Commit.RKey); err != nil {
 		s.log.Warn(fmt.Sprintf("failed to delete post from DB: %s", err.Error()))
 		return err
 	}
+	s.buffer.Untrack(event.Did, event.Commit.RKey)
+	return nil
+}
+
+// parseSubject returns the author and record key of a referenced post
+// isPost is false for references to records other than posts (e.g. feed generators)
+func parseSubject(subject *atproto.RepoStrongRef) (did, rkey string, isPost bool, err error) {
+	if subject == nil {
+		return "", "", false, fmt.Errorf("missing subject")
+	}
+	uri, err := syntax.ParseATURI(subject.Uri)
+	if err != nil {
+		return "", "", false, err
+	}
+	if uri.Collection().String() != CollectionKindFeedPost {
+		return "", "", false, nil
+	}
+	return uri.Authority().String(), uri.RecordKey().String(), true, nil
+}
+
+// newEngagement keys a like or repost by its author and record key, and its subject
+// by the subject's author and record key parsed from the subject AT-URI
+// Engagement on records other than posts is returned as nil
+func newEngagement(event *models.Event, subject *atproto.RepoStrongRef) (*db.Engagement, error) {
+	subjectDID, subjectRkey, isPost, err := parseSubject(subject)
+	if err != nil || !isPost {
+		return nil, err
+	}
+	return &db.Engagement{
+		DID:         event.Did,
+		Rkey:        event.Commit.RKey,
+		SubjectDID:  subjectDID,
+		SubjectRkey: subjectRkey,
+	}, nil
+}
+
+// handleReferences counts a post that replies to or quotes an indexed post
+func (s *subscriber) handleReferences(ctx context.Context, event *models.Event, post *appbsky.FeedPost) error {
+	subjects := map[string]*atproto.RepoStrongRef{}
+	if post.Reply != nil {
+		subjects[db.ReferenceReply] = post.Reply.Parent
+	}
+	if post.Embed != nil && post.Embed.EmbedRecord != nil {
+		subjects[db.ReferenceQuote] = post.Embed.EmbedRecord.Record
+	}
+	if post.Embed != nil && post.Embed.EmbedRecordWithMedia != nil && post.Embed.EmbedRecordWithMedia.Record != nil {
+		subjects[db.ReferenceQuote] = post.Embed.EmbedRecordWithMedia.Record.Record
+	}
+
+	for kind, subject := range subjects {
+		subjectDID, subjectRkey, isPost, err := parseSubject(subject)
+		if err != nil {
+			s.log.Warn(fmt.Sprintf("failed to parse %s subject: %s", kind, err.Error()))
+			return err
+		}
+		// replies and quotes of posts that aren't indexed are skipped without a DB round trip
+		if !isPost || !s.buffer.IsTracked(subjectDID, subjectRkey) {
+			continue
+		}
+		err = s.db.AddReference(ctx, db.Reference{
+			DID:         event.Did,
+			Rkey:        event.Commit.RKey,
+			Kind:        kind,
+			SubjectDID:  subjectDID,
+			SubjectRkey: subjectRkey,
+		})
+		if err != nil {
+			s.log.Warn(fmt.Sprintf("failed to increment %s: %s", kind, err.Error()))
+			return err
+		}
+	}
 	return nil
 }
 
-func (s *subscriber) handleCreateLike(event *models.Event) error {
+func (s *subscriber) handleCreateLike(ctx context.Context, event *models.Event) error {
 	var like appbsky.FeedLike
 	if err := json.Unmarshal(event.Commit.Record, &like); err != nil {
 		s.log.Warn(fmt.Sprintf("failed to parse app.bsky.feed.like record: %s", err.Error()))
 		return err
 	}
-	postRkey := strings.Split(like.Subject.Uri, "/")[4]
-	err := s.db.AddLike(event.Did, event.Commit.RKey, postRkey)
+	engagement, err := newEngagement(event, like.Subject)
 	if err != nil {
-		s.log.Warn(fmt.Sprintf("failed to increment like: %s", err.Error()))
+		s.log.Warn(fmt.Sprintf("failed to parse like subject: %s", err.Error()))
 		return err
 	}
+	if engagement == nil {
+		return nil
+	}
+	// engagement on posts that aren't indexed is held by the buffer until they are
+	if s.buffer.AddLike(*engagement) {
+		s.velocity.Record(engagement.SubjectDID, engagement.SubjectRkey, time.Now())
+	}
 	return nil
 }
 
-func (s *subscriber) handleDeleteLike(event *models.Event) error {
-	rkey := event.Commit.RKey
-	if err := s.db.DeleteLike(rkey); err != nil {
-		s.log.Warn(fmt.Sprintf("failed to delete like from DB: %s", err.Error()))
-		return err
-	}
+func (s *subscriber) handleDeleteLike(ctx context.Context, event *models.Event) error {
+	s.buffer.DeleteLike(event.Did, event.Commit.RKey)
 	return nil
 }
 
-func (s *subscriber) handleCreateRepost(event *models.Event) error {
+func (s *subscriber) handleCreateRepost(ctx context.Context, event *models.Event) error {
 	var repost appbsky.FeedRepost
 	if err := json.Unmarshal(event.Commit.Record, &repost); err != nil {
 		s.log.Warn(fmt.Sprintf("failed to parse app.bsky.feed.repost record: %s", err.Error()))
 		return err
 	}
-	postRkey := strings.Split(repost.Subject.Uri, "/")[4]
-	err := s.db.AddRepost(event.Did, event.Commit.RKey, postRkey)
+	engagement, err := newEngagement(event, repost.Subject)
 	if err != nil {
-		s.log.Warn(fmt.Sprintf("failed to increment repost: %s", err.Error()))
+		s.log.Warn(fmt.Sprintf("failed to parse repost subject: %s", err.Error()))
 		return err
 	}
+	if engagement == nil {
+		return nil
+	}
+	// engagement on posts that aren't indexed is held by the buffer until they are
+	if s.buffer.AddRepost(*engagement) {
+		s.velocity.Record(engagement.SubjectDID, engagement.SubjectRkey, time.Now())
+	}
 	return nil
 }
 
-func (s *subscriber) handleDeleteRepost(event *models.Event) error {
-	rkey := event.Commit.RKey
-	if err := s.db.DeleteRepost(rkey); err != nil {
-		s.log.Warn(fmt.Sprintf("failed to delete repost from DB: %s", err.Error()))
-		return err
-	}
+func (s *subscriber) handleDeleteRepost(ctx context.Context, event *models.Event) error {
+	s.buffer.DeleteRepost(event.Did, event.Commit.RKey)
 	return nil
 }
@@ -6,35 +6,89 @@ import (
 	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/bluesky-social/jetstream/pkg/models"
 	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/ingest"
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/velocity"
 	"log/slog"
+	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/jetstream/pkg/client"
 	"github.com/bluesky-social/jetstream/pkg/client/schedulers/parallel"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+var eventLag = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "feedgen_stream_event_lag_seconds",
+	Help: "How long before being handled the last firehose event was emitted by the relay",
+})
+
+var eventsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_stream_events_total",
+	Help: "The total number of firehose commits handled by collection and operation",
+}, []string{"collection", "operation"})
+
+var handlerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feedgen_stream_handler_errors_total",
+	Help: "The total number of firehose commits that failed to be handled by collection and operation",
+}, []string{"collection", "operation"})
+
 const (
 	jetstreamUri  = "wss://jetstream.atproto.tools/subscribe"
 	bskySocialUri = "https://bsky.social"
+	// defaultMaxBackdate is how far before reaching the relay a post may claim to be created by default
+	defaultMaxBackdate = 15 * time.Minute
+	// defaultMaxReplay is how old a cursor checkpoint may be to resume from by default
+	defaultMaxReplay = time.Hour
 )
 
 type Subscriber interface {
 	Run(ctx context.Context) error
 }
 
+// drainTimeout bounds how long events already read from the firehose are handled once reading stops,
+// handlers still running after it are cancelled
+const drainTimeout = 20 * time.Second
+
 type subscriber struct {
 	ctx           context.Context
 	db            db.DB
-	sched         *parallel.Scheduler
 	log           *slog.Logger
 	xrpcClient    *xrpc.Client
 	actorDID      string
 	classifierURL string
+	// in shadow mode every classification result is written to the classification log,
+	// optionally alongside the results of a candidate classifier
+	shadowMode             bool
+	candidateClassifierURL string
+	// maxBackdate is how far before the event a post may claim to be created, older posts count as created at the event
+	maxBackdate time.Duration
+	// velocity counts engagement on indexed posts for the rising feed
+	velocity *velocity.Tracker
+	// engagement is written through a buffer that batches writes and tracks the indexed posts
+	buffer *ingest.Buffer
+	// postAdded is called with every post added to the feeds
+	postAdded []func(post db.Post)
+	// connected is set while the subscriber reads from the firehose
+	connected atomic.Bool
+	// lastEventUS is the relay time of the last event handled, in unix microseconds
+	lastEventUS atomic.Int64
+	// watermark tracks the events read but not handled yet, the cursor checkpoint stays below them
+	watermark watermark
+	// checkpoints are taken by SaveCursor and stored once their engagement is written
+	checkpointsMu sync.Mutex
+	checkpoints   []pendingCheckpoint
+	// checkpointedUS is the relay time of the last checkpoint stored, or when the subscriber was created
+	checkpointedUS atomic.Int64
+	// maxReplay is how old a cursor checkpoint may be to resume from, older checkpoints start at the live tip
+	maxReplay time.Duration
 }
 
-func NewSubscriber(ctx context.Context, db db.DB, log *slog.Logger) (*subscriber, error) {
+func NewSubscriber(ctx context.Context, db db.DB, buffer *ingest.Buffer, tracker *velocity.Tracker, log *slog.Logger) (*subscriber, error) {
 	xrpcClient := &xrpc.Client{
 		Host: bskySocialUri,
 	}
@@ -54,6 +108,27 @@ func NewSubscriber(ctx context.Context, db db.DB, log *slog.Logger) (*subscriber
 	if classifierURL == "" {
 		return nil, fmt.Errorf("missing env var CLASSIFIER_URL")
 	}
+	shadowMode := os.Getenv("CLASSIFIER_SHADOW_MODE") == "true"
+	candidateClassifierURL := os.Getenv("CANDIDATE_CLASSIFIER_URL")
+	if candidateClassifierURL != "" && !shadowMode {
+		log.Warn("CANDIDATE_CLASSIFIER_URL is only used when CLASSIFIER_SHADOW_MODE is enabled")
+	}
+	maxBackdate := defaultMaxBackdate
+	if raw := os.Getenv("MAX_POST_BACKDATE"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("MAX_POST_BACKDATE must be a non-negative duration: %q", raw)
+		}
+		maxBackdate = d
+	}
+	maxReplay := defaultMaxReplay
+	if raw := os.Getenv("FIREHOSE_MAX_REPLAY"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("FIREHOSE_MAX_REPLAY must be a non-negative duration: %q", raw)
+		}
+		maxReplay = d
+	}
 	auth, err := atproto.ServerCreateSession(ctx, xrpcClient, &atproto.ServerCreateSession_Input{
 		Identifier: handle,
 		Password:   password,
@@ -89,13 +164,28 @@ func NewSubscriber(ctx context.Context, db db.DB, log *slog.Logger) (*subscriber
 		}
 	}()
 
-	return &subscriber{
+	s := &subscriber{
 		ctx:           ctx,
 		db:            db,
 		log:           log,
 		xrpcClient:    xrpcClient,
 		classifierURL: classifierURL,
-	}, nil
+
+		shadowMode:             shadowMode,
+		candidateClassifierURL: candidateClassifierURL,
+		maxBackdate:            maxBackdate,
+		maxReplay:              maxReplay,
+		velocity:               tracker,
+		buffer:                 buffer,
+	}
+	s.checkpointedUS.Store(time.Now().UnixMicro())
+	return s, nil
+}
+
+// OnPostAdded registers a function called with every post the subscriber adds to the feeds
+// It must be called before Run
+func (s *subscriber) OnPostAdded(fn func(post db.Post)) {
+	s.postAdded = append(s.postAdded, fn)
 }
 
 func (s *subscriber) refreshTokens() error {
@@ -111,41 +201,103 @@ func (s *subscriber) refreshTokens() error {
 	return nil
 }
 
-func (s *subscriber) connect() error {
+// connect reads from the firehose until ctx is cancelled or the connection fails, then
+// handles the events already read before returning
+func (s *subscriber) connect(ctx context.Context) error {
+	cursor, err := s.loadCursor(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load firehose cursor: %w", err)
+	}
+	// events read but not handled on the previous connection are read again from the cursor
+	s.watermark.reset()
 	config := client.DefaultClientConfig()
 	config.WebsocketURL = jetstreamUri
 	config.Compress = true
-	s.sched = parallel.NewScheduler(2, "jetstream", s.log, func(ctx context.Context, event *models.Event) error {
-		return s.handleCommit(event)
+	// handlers don't stop with ctx, so events already read are handled while draining
+	handleCtx, cancelHandlers := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelHandlers()
+	sched := parallel.NewScheduler(2, "jetstream", s.log, func(_ context.Context, event *models.Event) error {
+		return s.handleEvent(handleCtx, event)
 	})
-	c, err := client.NewClient(config, s.log, s.sched)
+	defer s.drain(sched, cancelHandlers)
+	// events and bytes read are exported by the jetstream client as jetstream_client_events_read and jetstream_client_bytes_read
+	c, err := client.NewClient(config, s.log, trackingScheduler{Scheduler: sched, watermark: &s.watermark})
 	if err != nil {
 		s.log.Warn(fmt.Sprintf("failed to create client: %s", err.Error()))
 		return err
 	}
+	s.connected.Store(true)
+	defer s.connected.Store(false)
+	return c.ConnectAndRead(ctx, cursor)
+}
 
-	// Every 5 seconds print the events read and bytes read and average event size
+// drain waits for the scheduler to handle the events it accepted, cancelling the handlers after drainTimeout
+func (s *subscriber) drain(sched *parallel.Scheduler, cancelHandlers context.CancelFunc) {
+	done := make(chan struct{})
 	go func() {
-		ticker := time.NewTicker(5 * time.Second)
-		for {
-			select {
-			case <-ticker.C:
-				eventsRead := c.EventsRead.Load()
-				bytesRead := c.BytesRead.Load()
-				if eventsRead == 0 {
-					s.log.Info("stats", "no events read")
-					continue
-				}
-				avgEventSize := bytesRead / eventsRead
-				s.log.Info("stats", "events_read", eventsRead, "bytes_read", bytesRead, "avg_event_size", avgEventSize)
-			}
-		}
+		sched.Shutdown()
+		close(done)
 	}()
-	return c.ConnectAndRead(s.ctx, nil)
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		s.log.Warn(fmt.Sprintf("firehose events were not handled within %s, cancelling their handlers", drainTimeout))
+		cancelHandlers()
+		<-done
+	}
+}
+
+// Lag returns how long ago the relay emitted the last event the subscriber handled,
+// it fails while the subscriber isn't reading from the firehose
+func (s *subscriber) Lag() (time.Duration, error) {
+	if !s.connected.Load() {
+		return 0, fmt.Errorf("not connected to the firehose")
+	}
+	last := s.lastEventUS.Load()
+	if last == 0 {
+		return 0, fmt.Errorf("no events received yet")
+	}
+	return time.Since(time.UnixMicro(last)), nil
+}
+
+// CheckpointLag returns how long ago the relay emitted the event of the last cursor checkpoint
+// stored, it grows while the buffer fails to write the engagement of the events handled since
+func (s *subscriber) CheckpointLag() time.Duration {
+	return time.Since(time.UnixMicro(s.checkpointedUS.Load()))
 }
 
-func (s *subscriber) Run() error {
-	return s.connect()
+// CheckClassifier checks that the classifier answers its health check
+func (s *subscriber) CheckClassifier(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/healthcheck", s.classifierURL), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("classifier health check failed with status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Run reads from the firehose until ctx is cancelled, reconnecting when the connection fails.
+// Events already read when ctx is cancelled are handled before Run returns.
+func (s *subscriber) Run(ctx context.Context) error {
+	for {
+		err := s.connect(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.log.Warn(fmt.Sprintf("firehose connection failed: %v, retrying in 1 second...", err))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
 }
 
 const (
@@ -154,7 +306,37 @@ const (
 	CollectionKindFeedLike   = "app.bsky.feed.like"
 )
 
-func (s *subscriber) handleCommit(event *models.Event) error {
+// handleEvent handles an event from the firehose, recording how far behind the relay the subscriber is
+func (s *subscriber) handleEvent(ctx context.Context, event *models.Event) error {
+	defer func() {
+		// events whose handlers were cancelled while draining are replayed on the next start
+		if ctx.Err() == nil {
+			s.watermark.handled(event.TimeUS)
+		}
+	}()
+	if event.TimeUS > 0 {
+		eventLag.Set(time.Since(time.UnixMicro(event.TimeUS)).Seconds())
+		s.lastEventUS.Store(event.TimeUS)
+	}
+	if event.Commit == nil {
+		return nil
+	}
+	// every collection is streamed, only the ones the feeds use get their own label
+	collection := event.Commit.Collection
+	switch collection {
+	case CollectionKindFeedPost, CollectionKindFeedLike, CollectionKindFeedRepost:
+	default:
+		collection = "other"
+	}
+	eventsProcessed.WithLabelValues(collection, event.Commit.Operation).Inc()
+	err := s.handleCommit(ctx, event)
+	if err != nil {
+		handlerErrors.WithLabelValues(collection, event.Commit.Operation).Inc()
+	}
+	return err
+}
+
+func (s *subscriber) handleCommit(ctx context.Context, event *models.Event) error {
 	if event.Commit == nil {
 		return nil
 	}
@@ -162,19 +344,19 @@ func (s *subscriber) handleCommit(event *models.Event) error {
 	case models.CommitOperationCreate:
 		switch event.Commit.Collection {
 		case CollectionKindFeedPost:
-			err := s.handleCreatePost(event)
+			err := s.handleCreatePost(ctx, event)
 			if err != nil {
 				s.log.Warn(fmt.Sprintf("failed to handle create %s: %s", CollectionKindFeedPost, err.Error()))
 				return err
 			}
 		case CollectionKindFeedLike:
-			err := s.handleCreateLike(event)
+			err := s.handleCreateLike(ctx, event)
 			if err != nil {
 				s.log.Warn(fmt.Sprintf("failed to handle create %s: %s", CollectionKindFeedLike, err.Error()))
 				return err
 			}
 		case CollectionKindFeedRepost:
-			err := s.handleCreateRepost(event)
+			err := s.handleCreateRepost(ctx, event)
 			if err != nil {
 				s.log.Warn(fmt.Sprintf("failed to handle create %s: %s", CollectionKindFeedRepost, err.Error()))
 				return err
@@ -183,19 +365,19 @@ func (s *subscriber) handleCommit(event *models.Event) error {
 	case models.CommitOperationDelete:
 		switch event.Commit.Collection {
 		case CollectionKindFeedPost:
-			err := s.handleDeletePost(event)
+			err := s.handleDeletePost(ctx, event)
 			if err != nil {
 				s.log.Warn(fmt.Sprintf("failed to handle delete %s: %s", CollectionKindFeedPost, err.Error()))
 				return err
 			}
 		case CollectionKindFeedLike:
-			err := s.handleDeleteLike(event)
+			err := s.handleDeleteLike(ctx, event)
 			if err != nil {
 				s.log.Warn(fmt.Sprintf("failed to handle delete %s: %s", CollectionKindFeedLike, err.Error()))
 				return err
 			}
 		case CollectionKindFeedRepost:
-			err := s.handleDeleteRepost(event)
+			err := s.handleDeleteRepost(ctx, event)
 			if err != nil {
 				s.log.Warn(fmt.Sprintf("failed to handle delete %s: %s", CollectionKindFeedRepost, err.Error()))
 				return err
@@ -0,0 +1,150 @@
+// Package velocity tracks how fast indexed posts are gaining engagement, to
+// surface posts whose engagement is accelerating.
+package velocity
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+)
+
+const (
+	// bucketSize is the resolution of the sliding window counters
+	bucketSize = 5 * time.Minute
+	// recentWindow is the window the current engagement rate is measured over
+	recentWindow = time.Hour
+	// horizon is how much history is kept per post, the baseline rate is measured
+	// over the part of the horizon before the recent window
+	horizon = 6 * time.Hour
+
+	numBuckets    = int(horizon / bucketSize)
+	recentBuckets = int(recentWindow / bucketSize)
+)
+
+type postKey struct {
+	did  string
+	rkey string
+}
+
+// series counts engagement in a ring of buckets, head is the bucket number
+// (time / bucketSize) of the newest bucket
+type series struct {
+	counts    [numBuckets]uint32
+	head      int64
+	firstSeen int64
+}
+
+// advance moves the ring forward to the given bucket, clearing buckets that fell out of the window
+func (s *series) advance(bucket int64) {
+	if bucket <= s.head {
+		return
+	}
+	for b := max(s.head+1, bucket-int64(numBuckets)+1); b <= bucket; b++ {
+		s.counts[b%int64(numBuckets)] = 0
+	}
+	s.head = bucket
+}
+
+// Tracker keeps sliding window engagement counters for indexed posts in memory
+type Tracker struct {
+	mu    sync.Mutex
+	posts map[postKey]*series
+	// started is when counting began, engagement from before it is unknown
+	started time.Time
+}
+
+func NewTracker() *Tracker {
+	return newTracker(time.Now())
+}
+
+func newTracker(started time.Time) *Tracker {
+	return &Tracker{
+		posts:   map[postKey]*series{},
+		started: started,
+	}
+}
+
+// Warm reports whether the tracker has counted engagement for longer than the recent window.
+// Until then every post looks like it has no baseline, so its score is inflated and shouldn't be used.
+func (t *Tracker) Warm(now time.Time) bool {
+	return now.Sub(t.started) > recentWindow
+}
+
+// Record counts a like or repost of an indexed post
+func (t *Tracker) Record(did, rkey string, at time.Time) {
+	bucket := at.UnixNano() / int64(bucketSize)
+	key := postKey{did: did, rkey: rkey}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.posts[key]
+	if !ok {
+		s = &series{head: bucket, firstSeen: bucket}
+		t.posts[key] = s
+	}
+	if bucket <= s.head-int64(numBuckets) {
+		// older than the horizon
+		return
+	}
+	s.advance(bucket)
+	s.counts[bucket%int64(numBuckets)]++
+	// held engagement is recorded when its post is indexed, after engagement received since
+	s.firstSeen = min(s.firstSeen, bucket)
+}
+
+// Scores returns the velocity of every tracked post, posts without engagement
+// within the horizon are dropped from the tracker
+func (t *Tracker) Scores(now time.Time) []db.Velocity {
+	bucket := now.UnixNano() / int64(bucketSize)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	velocities := make([]db.Velocity, 0, len(t.posts))
+	for key, s := range t.posts {
+		s.advance(bucket)
+		var recent, baseline uint32
+		for i := 0; i < numBuckets; i++ {
+			count := s.counts[(bucket-int64(i)+int64(numBuckets))%int64(numBuckets)]
+			if i < recentBuckets {
+				recent += count
+			} else {
+				baseline += count
+			}
+		}
+		if recent == 0 && baseline == 0 {
+			delete(t.posts, key)
+			continue
+		}
+
+		recentRate := float64(recent) / recentWindow.Hours()
+		// the baseline only covers the time the post has been tracked for
+		baselineBuckets := min(bucket-s.firstSeen+1, int64(numBuckets)) - int64(recentBuckets)
+		baselineRate := 0.0
+		if baselineBuckets > 0 {
+			baselineRate = float64(baseline) / (time.Duration(baselineBuckets) * bucketSize).Hours()
+		}
+
+		velocities = append(velocities, db.Velocity{
+			DID:          key.did,
+			Rkey:         key.rkey,
+			RecentRate:   recentRate,
+			BaselineRate: baselineRate,
+			Score:        Score(recentRate, baselineRate, recent),
+		})
+	}
+	return velocities
+}
+
+// Score rates how much a post's engagement is accelerating. The ratio of the
+// recent rate to the baseline rate is scaled by the recent volume, so a post
+// going from one like to three doesn't outrank one going from fifty to a hundred.
+// Posts that are not accelerating score zero.
+func Score(recentRate, baselineRate float64, recent uint32) float64 {
+	acceleration := (recentRate + 1) / (baselineRate + 1)
+	if acceleration <= 1 {
+		return 0
+	}
+	return math.Log2(acceleration) * math.Log2(1+float64(recent))
+}
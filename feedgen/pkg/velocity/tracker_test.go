@@ -0,0 +1,122 @@
+package velocity
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/medhir/bsky-feed-generator/feedgen/pkg/db"
+)
+
+const author = "did:plc:author"
+
+// start is the beginning of a bucket, so offsets from it land in predictable buckets
+var start = time.Unix(0, 0).Add(1000 * bucketSize)
+
+func at(offset time.Duration) time.Time {
+	return start.Add(offset)
+}
+
+func scores(tracker *Tracker, now time.Time) map[string]db.Velocity {
+	byRkey := map[string]db.Velocity{}
+	for _, velocity := range tracker.Scores(now) {
+		byRkey[velocity.Rkey] = velocity
+	}
+	return byRkey
+}
+
+func assertRates(t *testing.T, velocity db.Velocity, recentRate, baselineRate float64, recent uint32) {
+	t.Helper()
+	if math.Abs(velocity.RecentRate-recentRate) > 1e-9 || math.Abs(velocity.BaselineRate-baselineRate) > 1e-9 {
+		t.Errorf("rates of %s = %v/h recent, %v/h baseline, want %v/h and %v/h",
+			velocity.Rkey, velocity.RecentRate, velocity.BaselineRate, recentRate, baselineRate)
+	}
+	if want := Score(recentRate, baselineRate, recent); math.Abs(velocity.Score-want) > 1e-9 {
+		t.Errorf("score of %s = %v, want %v", velocity.Rkey, velocity.Score, want)
+	}
+}
+
+func TestRecentWindowAndBaseline(t *testing.T) {
+	tracker := newTracker(start)
+	// the first like starts the baseline, it is 90 minutes old when scored
+	tracker.Record(author, "a", at(30*time.Minute))
+	// within the recent hour
+	tracker.Record(author, "a", at(70*time.Minute))
+	tracker.Record(author, "a", at(115*time.Minute))
+
+	velocity, ok := scores(tracker, at(2*time.Hour))["a"]
+	if !ok {
+		t.Fatal("post a is not scored")
+	}
+	// the baseline covers the 35 minutes between the first like and the recent window
+	assertRates(t, velocity, 2, 1/(35*time.Minute).Hours(), 2)
+}
+
+func TestBucketBoundaries(t *testing.T) {
+	tracker := newTracker(start)
+	// the first and last five minute buckets of the recent hour
+	tracker.Record(author, "a", at(time.Hour))
+	tracker.Record(author, "a", at(2*time.Hour-time.Nanosecond))
+	// the newest baseline bucket, recorded late like engagement held until its post is indexed
+	tracker.Record(author, "a", at(time.Hour-time.Nanosecond))
+
+	velocity := scores(tracker, at(2*time.Hour-time.Nanosecond))["a"]
+	assertRates(t, velocity, 2, 1/bucketSize.Hours(), 2)
+}
+
+func TestBucketsRotateOverTheHorizon(t *testing.T) {
+	tracker := newTracker(start)
+	tracker.Record(author, "a", at(0))
+	tracker.Record(author, "b", at(0))
+	// the ring wraps around to the bucket of the first like, which is cleared before counting
+	tracker.Record(author, "a", at(horizon))
+
+	byRkey := scores(tracker, at(horizon))
+	velocity, ok := byRkey["a"]
+	if !ok {
+		t.Fatal("post a is not scored")
+	}
+	assertRates(t, velocity, 1, 0, 1)
+	// b has no engagement within the horizon anymore and is dropped
+	if _, ok := byRkey["b"]; ok {
+		t.Error("post b without engagement within the horizon is still scored")
+	}
+	if _, ok := scores(tracker, at(horizon))["b"]; ok {
+		t.Error("post b is scored again after being dropped")
+	}
+
+	// engagement from before the horizon is ignored
+	tracker.Record(author, "a", at(time.Minute))
+	assertRates(t, scores(tracker, at(horizon))["a"], 1, 0, 1)
+}
+
+func TestWarmAfterRestart(t *testing.T) {
+	tracker := newTracker(start)
+	tracker.Record(author, "a", at(10*time.Minute))
+	tracker.Record(author, "a", at(2*time.Hour))
+	if !tracker.Warm(at(2 * time.Hour)) {
+		t.Fatal("tracker is not warm after two hours")
+	}
+	before := scores(tracker, at(2*time.Hour))["a"]
+
+	// after a restart the same engagement has no baseline, so its score is inflated
+	restarted := newTracker(at(2 * time.Hour))
+	restarted.Record(author, "a", at(2*time.Hour))
+	after := scores(restarted, at(2*time.Hour))["a"]
+	if after.Score <= before.Score {
+		t.Errorf("score after a restart = %v, want more than %v without a baseline", after.Score, before.Score)
+	}
+	for _, tt := range []struct {
+		since time.Duration
+		warm  bool
+	}{
+		{0, false},
+		{recentWindow - time.Nanosecond, false},
+		{recentWindow, false},
+		{recentWindow + time.Nanosecond, true},
+	} {
+		if warm := restarted.Warm(at(2*time.Hour + tt.since)); warm != tt.warm {
+			t.Errorf("Warm %s after a restart = %v, want %v", tt.since, warm, tt.warm)
+		}
+	}
+}